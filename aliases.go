@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// aliasCmd groups the commands editing the host field of entries.
+func aliasCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "alias",
+		Short: "Add or remove host aliases on known_hosts lines",
+	}
+
+	add := &cobra.Command{
+		Use:   "add <host> <alias>...",
+		Short: "Add aliases to every line listing host",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+
+			store := storeFor(cmd)
+			if err := addAliases(store, path, args[0], args[1:]); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+
+	rm := &cobra.Command{
+		Use:   "rm <alias>...",
+		Short: "Remove aliases from their lines, dropping lines left without a host",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			host, _ := cmd.Flags().GetString("host")
+
+			store := storeFor(cmd)
+			if err := removeAliasesFrom(store, path, host, args); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	rm.Flags().String("host", "", "Only edit lines that also list this host")
+
+	cmd.AddCommand(add, rm)
+	return cmd
+}
+
+// splitCmd rewrites multi-address lines into one line per address.
+func splitCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "split [host|glob|cidr]...",
+		Short: "Split multi-address lines into one line per address",
+		Long:  "Split multi-address lines into one line per address. Without hosts or filters every line is split.",
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			query, err := optionalSelection(cmd, args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			store := storeFor(cmd)
+			if err := splitEntries(store, path, query); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	addQueryFlags(cmd)
+	return cmd
+}
+
+// consolidateCmd merges lines carrying the identical key into one line.
+func consolidateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "consolidate [host|glob|cidr]...",
+		Short: "Merge lines with the identical key into one host,alias,ip line",
+		Long:  "Merge lines with the identical key into one host,alias,ip line. Without hosts or filters every line is considered.",
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			query, err := optionalSelection(cmd, args)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			store := storeFor(cmd)
+			if err := consolidateEntries(store, path, query); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	addQueryFlags(cmd)
+	return cmd
+}
+
+// optionalSelection is like selectionFromArgs but selects every entry when
+// neither hosts nor filters are given.
+func optionalSelection(cmd *cobra.Command, args []string) (*knownhosts.Query, error) {
+	targets, err := targetsQuery(args)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := queryFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return knownhosts.And(targets, filters), nil
+}
+
+func addAliases(store knownhosts.Store, knownHostsPath, host string, aliases []string) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	for _, alias := range aliases {
+		n, skipped, err := collection.AddAlias(host, alias)
+		if err != nil {
+			return fmt.Errorf("failed to add alias %q to %q: %w", alias, host, err)
+		}
+		if skipped > 0 {
+			fmt.Fprintf(os.Stderr, "%s: added to %d line(s), skipped %d hashed line(s)\n", alias, n, skipped)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: added to %d line(s)\n", alias, n)
+		}
+	}
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after alias add: %w", err)
+	}
+	return nil
+}
+
+func removeAliasesFrom(store knownhosts.Store, knownHostsPath, host string, aliases []string) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	for _, alias := range aliases {
+		targets := make([]*knownhosts.Host, 0)
+		for _, h := range collection.Entries {
+			if h.HasAddress(alias) && (host == "" || h.HasAddress(host)) {
+				targets = append(targets, h)
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("alias %q not found", alias)
+		}
+		if err := collection.ArchiveAlias(targets, alias, knownhosts.OpAliasRemove, ""); err != nil {
+			return err
+		}
+		rewritten, removed := collection.RemoveAliasFrom(targets, alias)
+		fmt.Fprintf(os.Stderr, "%s: rewrote %d line(s), removed %d line(s)\n", alias, rewritten, removed)
+	}
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after alias rm: %w", err)
+	}
+	return nil
+}
+
+func splitEntries(store knownhosts.Store, knownHostsPath string, query *knownhosts.Query) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	added := collection.Split(collection.Select(query))
+	if added == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to split")
+		return nil
+	}
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after split: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Split into %d additional line(s)\n", added)
+	return nil
+}
+
+func consolidateEntries(store knownhosts.Store, knownHostsPath string, query *knownhosts.Query) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	removed := collection.Consolidate(collection.Select(query))
+	if removed == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to consolidate")
+		return nil
+	}
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after consolidate: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Merged %d line(s)\n", removed)
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// auditCmd groups the read-only security checks.
+func auditCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Check known_hosts files for security problems",
+		// Audits only read the files.
+		PersistentPreRun: reportExpiredStashes,
+	}
+	cmd.AddCommand(auditReuseCmd(), auditKeysCmd())
+	return cmd
+}
+
+// auditReuseCmd reports keys shared by several hosts.
+func auditReuseCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reuse [file]...",
+		Short: "Report host keys present for more than one host",
+		Long: `Report host keys present for more than one distinct host, e.g. VMs cloned from one
+image. Plaintext and hashed entries of all given files (default: --file) are compared.
+Entries count as one host only when proven: the addresses on one line belong together,
+across every key of the files, and a hashed entry joins the plaintext name or address it
+matches. Hashed entries matching none count as hosts of their own and are reported as
+possible reuse. @cert-authority and @revoked keys are ignored. Exits with status 1 when
+a reused key is found.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			format, _ := cmd.Flags().GetString("format")
+
+			found, err := auditReuse(auditFiles(cmd, args), format)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if found {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().String("format", "", `Output format: "json" or empty for text`)
+	return cmd
+}
+
+// auditKeysCmd reports weak and deprecated host keys.
+func auditKeysCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys [file]...",
+		Short: "Report weak and deprecated host keys",
+		Long: `Decode every key of the given files (default: --file) and report malformed keys,
+denied or unknown algorithms, RSA keys under --min-rsa-bits and ECDSA keys on deprecated
+curves, with file, line and severity. Exits with status 1 when a finding is at least as
+severe as --fail-on.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			format, _ := cmd.Flags().GetString("format")
+			failOn, _ := cmd.Flags().GetString("fail-on")
+
+			threshold, err := knownhosts.ParseSeverity(failOn)
+			if err != nil {
+				log.Fatal(err)
+			}
+			entries, err := loadEntries(auditFiles(cmd, args))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			findings := knownhosts.AuditKeys(entries, keyRulesFromFlags(cmd))
+			if err := writeFindings(os.Stdout, format, findings, knownhosts.KeyRuleDescriptions); err != nil {
+				log.Fatal(err)
+			}
+			if len(findings) == 0 && format == "" {
+				fmt.Fprintln(os.Stderr, "No weak keys")
+			}
+			if failsAt(findings, threshold) {
+				os.Exit(1)
+			}
+		},
+	}
+	defaults := knownhosts.DefaultKeyRules()
+	cmd.Flags().String("format", "", `Output format: "json", "sarif", "github" or empty for text`)
+	cmd.Flags().StringSlice("allow", defaults.Allow, "Only accept these key algorithms")
+	cmd.Flags().StringSlice("deny", defaults.Deny, "Always reject these key algorithms")
+	cmd.Flags().Int("min-rsa-bits", defaults.MinRSABits, "Minimum RSA key size")
+	cmd.Flags().StringSlice("weak-curve", defaults.WeakCurves, "ECDSA curves to report as deprecated, e.g. nistp256")
+	cmd.Flags().String("fail-on", "warning", "Exit non-zero for findings of this severity or worse: info, warning, error")
+	return cmd
+}
+
+func keyRulesFromFlags(cmd *cobra.Command) knownhosts.KeyRules {
+	rules := knownhosts.DefaultKeyRules()
+	rules.Allow, _ = cmd.Flags().GetStringSlice("allow")
+	rules.Deny, _ = cmd.Flags().GetStringSlice("deny")
+	rules.MinRSABits, _ = cmd.Flags().GetInt("min-rsa-bits")
+	rules.WeakCurves, _ = cmd.Flags().GetStringSlice("weak-curve")
+	return rules
+}
+
+// auditFiles returns the files named on the command line, or the --file
+// path when there are none.
+func auditFiles(cmd *cobra.Command, args []string) []string {
+	if len(args) > 0 {
+		return args
+	}
+	path, _ := cmd.Flags().GetString("file")
+	if path == "" {
+		path = getKnownHostsPath()
+	}
+	return []string{path}
+}
+
+// loadEntries parses every file and returns their entries in order. Each
+// entry records its file in Source.
+func loadEntries(paths []string) ([]*knownhosts.Host, error) {
+	entries := make([]*knownhosts.Host, 0)
+	for _, path := range paths {
+		collection, err := knownhosts.ParseKnownHosts(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		entries = append(entries, collection.Entries...)
+	}
+	return entries, nil
+}
+
+// keyGroupView is the JSON form of a knownhosts.KeyGroup.
+type keyGroupView struct {
+	Type        string                `json:"type"`
+	Fingerprint string                `json:"fingerprint"`
+	Hosts       int                   `json:"hosts"`
+	Unresolved  int                   `json:"unresolved_hashed,omitempty"`
+	Possible    bool                  `json:"possible,omitempty"`
+	Entries     []knownhosts.HostView `json:"entries"`
+}
+
+func auditReuse(paths []string, format string) (bool, error) {
+	entries, err := loadEntries(paths)
+	if err != nil {
+		return false, err
+	}
+	reused := knownhosts.ReusedKeys(entries)
+
+	switch format {
+	case "json":
+		views := make([]keyGroupView, 0, len(reused))
+		for _, g := range reused {
+			v := keyGroupView{
+				Type:        g.Type,
+				Fingerprint: g.Fingerprint(),
+				Hosts:       g.Hosts,
+				Unresolved:  g.Unresolved,
+				Possible:    !g.Certain(),
+			}
+			for _, h := range g.Entries {
+				v.Entries = append(v.Entries, h.View(h.Source))
+			}
+			views = append(views, v)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return len(reused) > 0, enc.Encode(views)
+	case "":
+	default:
+		return false, fmt.Errorf("unknown format %q: expected json", format)
+	}
+
+	if len(reused) == 0 {
+		fmt.Fprintln(os.Stderr, "No reused keys")
+		return false, nil
+	}
+	for _, g := range reused {
+		switch {
+		case !g.Certain():
+			fmt.Printf("%s %s possibly shared by %d hosts (%d hashed, matching no plaintext name):\n", g.Type, g.Fingerprint(), g.Hosts, g.Unresolved)
+		case g.Unresolved > 0:
+			fmt.Printf("%s %s shared by %d hosts (%d hashed, matching no plaintext name):\n", g.Type, g.Fingerprint(), g.Hosts, g.Unresolved)
+		default:
+			fmt.Printf("%s %s shared by %d hosts:\n", g.Type, g.Fingerprint(), g.Hosts)
+		}
+		for _, h := range g.Entries {
+			fmt.Printf("  %s:%d: %s\n", h.Source, h.LineNumber, h.HostField())
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// fmtCmd rewrites known_hosts files in canonical form, or checks that they
+// already are.
+func fmtCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fmt [file]...",
+		Short: "Rewrite known_hosts files in canonical form",
+		Long: `Rewrite known_hosts files in canonical form: single spaces, LF line endings,
+lowercase host names, canonical IPv6 addresses, [host]:22 written as host, and the keys
+of one host grouped together and sorted. Comment lines are kept, moving with the entry
+below them; those above the first entry stay at the top. Without files the --file path
+is formatted.
+
+With --check nothing is written; the differences are printed as a unified diff and the
+command exits with status 1 when a file is not canonical.`,
+		PersistentPreRun: expireStashesWhen(func(cmd *cobra.Command, args []string) bool {
+			check, _ := cmd.Flags().GetBool("check")
+			return !check
+		}),
+		Run: func(cmd *cobra.Command, args []string) {
+			files := args
+			if len(files) == 0 {
+				path, _ := cmd.Flags().GetString("file")
+				if path == "" {
+					path = getKnownHostsPath()
+				}
+				files = []string{path}
+			}
+			check, _ := cmd.Flags().GetBool("check")
+			sortKey, _ := cmd.Flags().GetString("sort")
+
+			store := storeFor(cmd)
+			clean := true
+			for _, path := range files {
+				canonical, err := formatKnownHosts(store, path, sortKey, check)
+				if err != nil {
+					log.Fatal(err)
+				}
+				clean = clean && canonical
+			}
+			if !check {
+				reportDryRun(store)
+			}
+
+			if check && !clean {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().Bool("check", false, "Only report files that are not canonical, exiting non-zero")
+	cmd.Flags().String("sort", "host", "Sort entries by: "+strings.Join(knownhosts.SortKeys, ", "))
+	return cmd
+}
+
+// formatKnownHosts canonicalizes one file and reports whether it already
+// was canonical. In check mode the file is left untouched and the needed
+// changes are printed as a diff.
+func formatKnownHosts(store knownhosts.Store, knownHostsPath, sortKey string, check bool) (bool, error) {
+	data, err := store.ReadFile(knownHostsPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", knownHostsPath, err)
+	}
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+	if err := collection.Canonicalize(sortKey); err != nil {
+		return false, err
+	}
+
+	formatted := collection.Render()
+	if bytes.Equal(data, formatted) {
+		return true, nil
+	}
+
+	if check {
+		fmt.Fprintf(os.Stderr, "%s is not canonically formatted\n", knownHostsPath)
+		preview := knownhosts.NewDryRunStore()
+		if err := preview.WriteFile(knownHostsPath, formatted, false); err != nil {
+			return false, fmt.Errorf("failed to diff %s: %w", knownHostsPath, err)
+		}
+		fmt.Print(preview.Diff())
+		return false, nil
+	}
+
+	// SaveToFile writes what Render returned and re-keys the metadata
+	// sidecar by the canonical host fields.
+	if err := collection.SaveToFile(knownHostsPath); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", knownHostsPath, err)
+	}
+	fmt.Fprintf(os.Stderr, "Formatted %s\n", knownHostsPath)
+	return false, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/spf13/cobra"
+)
+
+// isDryRun reports whether the global --dry-run flag is set.
+func isDryRun(cmd *cobra.Command) bool {
+	dry, _ := cmd.Flags().GetBool("dry-run")
+	return dry
+}
+
+// storeFor returns the store mutating commands write through: an in-memory
+// store when --dry-run is set, the filesystem otherwise.
+func storeFor(cmd *cobra.Command) knownhosts.Store {
+	if isDryRun(cmd) {
+		return knownhosts.NewDryRunStore()
+	}
+	return knownhosts.DiskStore{}
+}
+
+// reportDryRun prints the changes recorded by a dry-run store as a unified
+// diff on stdout. It does nothing for other stores.
+func reportDryRun(store knownhosts.Store) {
+	dry, ok := store.(*knownhosts.DryRunStore)
+	if !ok {
+		return
+	}
+	if !dry.Changed() {
+		fmt.Fprintln(os.Stderr, "Dry run: no changes")
+		return
+	}
+	fmt.Print(dry.Diff())
+	fmt.Fprintln(os.Stderr, "Dry run: no files were changed")
+}
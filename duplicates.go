@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// dedupeCmd removes lines repeating an earlier line.
+func dedupeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dedupe",
+		Short: "Remove exact duplicate lines from known_hosts",
+		Long: `Remove lines that repeat an earlier line: same marker, key type, key and set of
+hosts (compared case-insensitively and ignoring order). The first occurrence is kept.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+
+			store := storeFor(cmd)
+			if err := dedupeKnownHosts(store, path); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+}
+
+// conflictsCmd lists host/type pairs with several keys and optionally keeps
+// one of them.
+func conflictsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "conflicts [host]...",
+		Short: "List hosts with several different keys of the same type",
+		Long: `List host and key type pairs for which known_hosts holds more than one distinct key.
+Hashed lines are included when they match a host written in plaintext elsewhere.
+
+With --keep, every listed conflict that includes a key with that fingerprint is resolved:
+the host is dropped from the lines carrying the other keys, leaving their remaining
+aliases untouched. The SHA256: tag is optional and a prefix of at least 8 characters is
+enough, as long as it matches only one key of each conflict; nothing is changed otherwise.`,
+		// Only --keep writes files.
+		PersistentPreRun: expireStashesWhen(func(cmd *cobra.Command, args []string) bool {
+			keep, _ := cmd.Flags().GetString("keep")
+			return keep != ""
+		}),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			format, _ := cmd.Flags().GetString("format")
+			keep, _ := cmd.Flags().GetString("keep")
+
+			if keep == "" {
+				if err := listConflicts(path, args, format); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			store := storeFor(cmd)
+			if err := resolveConflicts(store, path, args, keep); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	cmd.Flags().String("format", "", `Output format: "json" or empty for text`)
+	cmd.Flags().String("keep", "", "Resolve conflicts by keeping the key with this fingerprint (or a prefix of 8+ characters)")
+	return cmd
+}
+
+func dedupeKnownHosts(store knownhosts.Store, knownHostsPath string) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	dups := collection.Duplicates()
+	if len(dups) == 0 {
+		fmt.Fprintln(os.Stderr, "No duplicates")
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Removing %d duplicate line%s from %s:\n", len(dups), plural(len(dups), "", "s"), collection.File)
+	for _, h := range dups {
+		fmt.Fprintf(os.Stderr, "  %d: %s\n", h.LineNumber, h.String())
+	}
+
+	collection.RemoveEntries(dups)
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after dedupe: %w", err)
+	}
+	return nil
+}
+
+// conflictView is the JSON form of a knownhosts.Conflict.
+type conflictView struct {
+	Host    string                `json:"host"`
+	Type    string                `json:"type"`
+	Entries []knownhosts.HostView `json:"entries"`
+}
+
+// selectConflicts returns the conflicts of the collection, limited to the
+// given hosts when any are given.
+func selectConflicts(collection *knownhosts.HostCollection, hosts []string) []knownhosts.Conflict {
+	conflicts := collection.Conflicts()
+	if len(hosts) == 0 {
+		return conflicts
+	}
+	selected := make([]knownhosts.Conflict, 0, len(conflicts))
+	for _, c := range conflicts {
+		for _, host := range hosts {
+			if c.Host == knownhosts.CanonicalHostname(host) {
+				selected = append(selected, c)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func listConflicts(knownHostsPath string, hosts []string, format string) error {
+	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+	conflicts := selectConflicts(collection, hosts)
+
+	switch format {
+	case "json":
+		views := make([]conflictView, 0, len(conflicts))
+		for _, c := range conflicts {
+			v := conflictView{Host: c.Host, Type: c.Type}
+			for _, h := range c.Entries {
+				v.Entries = append(v.Entries, h.View(collection.File))
+			}
+			views = append(views, v)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	case "":
+	default:
+		return fmt.Errorf("unknown format %q: expected json", format)
+	}
+
+	if len(conflicts) == 0 {
+		fmt.Fprintln(os.Stderr, "No conflicts")
+		return nil
+	}
+	for _, c := range conflicts {
+		fmt.Printf("%s %s: %d keys\n", c.Host, c.Type, len(c.Keys()))
+		for _, h := range c.Entries {
+			fmt.Printf("  line %d: %s  %s\n", h.LineNumber, h.Fingerprint(), strings.TrimSpace(h.HostField()+" "+h.Comment))
+		}
+	}
+	return nil
+}
+
+// minFingerprintPrefix is the shortest fingerprint prefix --keep accepts,
+// not counting the "SHA256:" tag.
+const minFingerprintPrefix = 8
+
+// keepFingerprint normalizes a --keep value to a fingerprint prefix without
+// the "SHA256:" tag, which is optional as in the fp: query term.
+func keepFingerprint(value string) (string, error) {
+	prefix := strings.TrimPrefix(value, "SHA256:")
+	if len(prefix) < minFingerprintPrefix {
+		return "", fmt.Errorf("fingerprint %q is too short: give at least %d characters after SHA256:", value, minFingerprintPrefix)
+	}
+	return prefix, nil
+}
+
+func resolveConflicts(store knownhosts.Store, knownHostsPath string, hosts []string, fingerprint string) error {
+	prefix, err := keepFingerprint(fingerprint)
+	if err != nil {
+		return err
+	}
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	// Every conflict is checked before any is resolved, so an ambiguous
+	// prefix changes nothing.
+	type resolution struct {
+		conflict knownhosts.Conflict
+		keep     *knownhosts.Host
+	}
+	resolutions := make([]resolution, 0)
+	for _, c := range selectConflicts(collection, hosts) {
+		matches := make([]*knownhosts.Host, 0, 1)
+		for _, h := range c.Keys() {
+			if strings.HasPrefix(strings.TrimPrefix(h.Fingerprint(), "SHA256:"), prefix) {
+				matches = append(matches, h)
+			}
+		}
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			resolutions = append(resolutions, resolution{conflict: c, keep: matches[0]})
+		default:
+			candidates := make([]string, 0, len(matches))
+			for _, h := range matches {
+				candidates = append(candidates, h.Fingerprint())
+			}
+			return fmt.Errorf("fingerprint %s is ambiguous for %s %s, it matches:\n  %s",
+				fingerprint, c.Host, c.Type, strings.Join(candidates, "\n  "))
+		}
+	}
+
+	resolved := 0
+	for _, r := range resolutions {
+		c, keep := r.conflict, r.keep
+		if err := collection.ArchiveAlias(c.Stale(keep), c.Host, knownhosts.OpConflict, "kept "+keep.Fingerprint()); err != nil {
+			return err
+		}
+		rewritten, removed := collection.ResolveConflict(c, keep)
+		fmt.Fprintf(os.Stderr, "%s %s: kept %s, rewrote %d line(s), removed %d line(s)\n",
+			c.Host, c.Type, keep.Fingerprint(), rewritten, removed)
+		resolved++
+	}
+	if resolved == 0 {
+		return fmt.Errorf("no conflict has a key with fingerprint %s", fingerprint)
+	}
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after resolving conflicts: %w", err)
+	}
+	return nil
+}
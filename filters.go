@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/spf13/cobra"
+)
+
+// addQueryFlags registers the entry filter flags shared by commands that
+// select a subset of known_hosts entries.
+func addQueryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("query", "q", "", "Filter expression, e.g. 'type:ed25519 cidr:10.1.0.0/16'")
+	cmd.Flags().StringArray("match", nil, "Only entries with an address matching the glob (repeatable)")
+	cmd.Flags().StringArray("regex", nil, "Only entries with an address matching the regular expression (repeatable)")
+	cmd.Flags().StringArray("type", nil, "Only entries whose key type contains the value (repeatable)")
+	cmd.Flags().StringArray("fingerprint", nil, "Only entries whose SHA256 fingerprint starts with the value (repeatable)")
+	cmd.Flags().StringArray("line", nil, "Only the entry on this line of its file (repeatable)")
+	cmd.Flags().StringArray("cidr", nil, "Only entries with an IP address inside the network (repeatable)")
+	cmd.Flags().Bool("hashed", false, "Only entries with a hashed host field")
+	cmd.Flags().Bool("plain", false, "Only entries with a plaintext host field")
+	cmd.Flags().StringArray("marker", nil, "Only entries with the marker: cert-authority, revoked or none (repeatable)")
+	cmd.Flags().StringArray("source", nil, "Only entries read from the file (repeatable)")
+}
+
+// queryFromFlags builds a query from the flags registered by addQueryFlags.
+// Repeated values of one flag are ORed, different flags are ANDed.
+func queryFromFlags(cmd *cobra.Command) (*knownhosts.Query, error) {
+	parts := make([]*knownhosts.Query, 0)
+
+	if expr, _ := cmd.Flags().GetString("query"); expr != "" {
+		q, err := knownhosts.ParseQuery(expr)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, q)
+	}
+
+	for _, f := range []struct{ flag, field string }{
+		{"match", "glob"},
+		{"regex", "re"},
+		{"type", "type"},
+		{"fingerprint", "fp"},
+		{"line", "line"},
+		{"cidr", "cidr"},
+		{"marker", "marker"},
+		{"source", "source"},
+	} {
+		values, _ := cmd.Flags().GetStringArray(f.flag)
+		alternatives := make([]*knownhosts.Query, 0, len(values))
+		for _, v := range values {
+			q, err := knownhosts.NewTerm(f.field, v)
+			if err != nil {
+				return nil, err
+			}
+			alternatives = append(alternatives, q)
+		}
+		parts = append(parts, knownhosts.Or(alternatives...))
+	}
+
+	hashed, _ := cmd.Flags().GetBool("hashed")
+	plain, _ := cmd.Flags().GetBool("plain")
+	if hashed && plain {
+		return nil, fmt.Errorf("--hashed cannot be combined with --plain")
+	}
+	if hashed || plain {
+		value := "plain"
+		if hashed {
+			value = "hashed"
+		}
+		q, err := knownhosts.NewTerm("is", value)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, q)
+	}
+
+	return knownhosts.And(parts...), nil
+}
+
+// targetsQuery turns host arguments into a query: CIDR ranges match IP
+// addresses, arguments with * or ? are globs and anything else must be a
+// literal address of the entry (hashed entries included).
+func targetsQuery(args []string) (*knownhosts.Query, error) {
+	targets := make([]*knownhosts.Query, 0, len(args))
+	for _, arg := range args {
+		if arg == "" {
+			return nil, fmt.Errorf("host is required")
+		}
+
+		field := "addr"
+		if _, _, err := net.ParseCIDR(arg); err == nil {
+			field = "cidr"
+		} else if strings.ContainsAny(arg, "*?") {
+			field = "glob"
+		}
+
+		q, err := knownhosts.NewTerm(field, arg)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, q)
+	}
+	return knownhosts.Or(targets...), nil
+}
+
+// selectionFromArgs combines host arguments with the filter flags. At least
+// one of them must be given so a bare command never selects every entry.
+func selectionFromArgs(cmd *cobra.Command, args []string) (*knownhosts.Query, error) {
+	targets, err := targetsQuery(args)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := queryFromFlags(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if targets.Empty() && filters.Empty() {
+		return nil, fmt.Errorf("at least one host, glob, CIDR range or filter flag is required")
+	}
+	return knownhosts.And(targets, filters), nil
+}
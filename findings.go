@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+)
+
+// findingView is the JSON form of a knownhosts.Finding.
+type findingView struct {
+	Rule        string `json:"rule"`
+	Severity    string `json:"severity"`
+	Message     string `json:"message"`
+	File        string `json:"file"`
+	Line        int    `json:"line"`
+	Host        string `json:"host"`
+	Type        string `json:"type"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// writeFindings prints findings as text, "json", "sarif" or "github"
+// (workflow command annotations). rules maps the rule identifiers to their
+// descriptions for the SARIF rule table.
+func writeFindings(w io.Writer, format string, findings []knownhosts.Finding, rules map[string]string) error {
+	switch format {
+	case "":
+		for _, f := range findings {
+			fmt.Fprintf(w, "%s:%d: %s: %s [%s] %s\n",
+				f.Entry.Source, f.Entry.LineNumber, f.Severity, f.Message, f.Rule, f.Entry.HostField())
+		}
+		return nil
+	case "json":
+		views := make([]findingView, 0, len(findings))
+		for _, f := range findings {
+			views = append(views, findingView{
+				Rule:        f.Rule,
+				Severity:    string(f.Severity),
+				Message:     f.Message,
+				File:        f.Entry.Source,
+				Line:        f.Entry.LineNumber,
+				Host:        f.Entry.HostField(),
+				Type:        f.Entry.Type,
+				Fingerprint: f.Entry.Fingerprint(),
+			})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	case "sarif":
+		return writeSARIF(w, findings, rules)
+	case "github":
+		for _, f := range findings {
+			level := string(f.Severity)
+			if f.Severity == knownhosts.SeverityInfo {
+				level = "notice"
+			}
+			fmt.Fprintf(w, "::%s file=%s,line=%d,title=%s::%s: %s\n",
+				level, f.Entry.Source, f.Entry.LineNumber, f.Rule, f.Message, f.Entry.HostField())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %q: expected json, sarif or github", format)
+}
+
+// SARIF 2.1.0 subset understood by code scanning tools.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifact `json:"artifactLocation"`
+	Region           sarifRegion   `json:"region"`
+}
+
+type sarifArtifact struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+func writeSARIF(w io.Writer, findings []knownhosts.Finding, rules map[string]string) error {
+	ids := make([]string, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	driver := sarifDriver{
+		Name:           "khm",
+		InformationURI: "https://github.com/FlameInTheDark/khm",
+		Rules:          make([]sarifRule, 0, len(ids)),
+	}
+	for _, id := range ids {
+		driver.Rules = append(driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: rules[id]}})
+	}
+
+	results := make([]sarifResult, 0, len(findings))
+	for _, f := range findings {
+		level := string(f.Severity)
+		if f.Severity == knownhosts.SeverityInfo {
+			level = "note"
+		}
+		results = append(results, sarifResult{
+			RuleID:  f.Rule,
+			Level:   level,
+			Message: sarifMessage{Text: f.Message + ": " + f.Entry.HostField()},
+			Locations: []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifact{URI: filepath.ToSlash(f.Entry.Source)},
+				Region:           sarifRegion{StartLine: f.Entry.LineNumber},
+			}}},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	})
+}
+
+// failsAt reports whether any finding is at least as severe as threshold.
+func failsAt(findings []knownhosts.Finding, threshold knownhosts.Severity) bool {
+	for _, f := range findings {
+		if f.Severity.Rank() >= threshold.Rank() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+)
+
+// templateFuncs are available to --format templates in addition to the
+// standard text/template builtins.
+var templateFuncs = template.FuncMap{
+	// join concatenates a list with a separator: {{join .Addresses ","}}
+	"join": func(items []string, sep string) string {
+		return strings.Join(items, sep)
+	},
+	// short truncates long values such as keys and hashes: {{short .Key}}
+	"short": func(s string) string {
+		if len(s) <= 16 {
+			return s
+		}
+		return s[:16] + "..."
+	},
+	// fingerprint computes the SHA256 fingerprint of a key blob: {{fingerprint .Key}}
+	"fingerprint": knownhosts.KeyFingerprint,
+	// upper converts a value to upper case: {{upper .Type}}
+	"upper": strings.ToUpper,
+}
+
+// hostPrinter renders entries either as JSON or through a user supplied
+// text/template, one execution per entry.
+type hostPrinter struct {
+	json bool
+	tmpl *template.Template
+}
+
+// newHostPrinter parses a --format value. "json" selects JSON output, any
+// other non-empty value is treated as a Go template over knownhosts.HostView.
+func newHostPrinter(format string) (*hostPrinter, error) {
+	if format == "json" {
+		return &hostPrinter{json: true}, nil
+	}
+
+	// Allow "\n" and "\t" escapes since shells make literal newlines awkward.
+	format = strings.NewReplacer(`\n`, "\n", `\t`, "\t").Replace(format)
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+
+	tmpl, err := template.New("format").Funcs(templateFuncs).Option("missingkey=error").Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format template: %w", err)
+	}
+	return &hostPrinter{tmpl: tmpl}, nil
+}
+
+func (p *hostPrinter) Print(w io.Writer, file string, hosts []*knownhosts.Host) error {
+	views := make([]knownhosts.HostView, 0, len(hosts))
+	for _, h := range hosts {
+		views = append(views, h.View(file))
+	}
+
+	if p.json {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	}
+
+	for _, v := range views {
+		if err := p.tmpl.Execute(w, v); err != nil {
+			return fmt.Errorf("failed to render entry on line %d: %w", v.Line, err)
+		}
+	}
+	return nil
+}
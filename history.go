@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// historyCmd shows the keys a host has had, from the current entries and
+// the archive of keys khm removed or replaced.
+func historyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history <host>",
+		Short: "Show the timeline of keys a host has had",
+		Long: "Show when the keys of a host were added and removed. Every key khm deletes, rotates, garbage collects " +
+			"or drops from a stash is archived in known_hosts.history.json with the time, user, operation and reason.",
+		Example: `  khm history web1.example
+  khm history '[10.0.3.17]:2222' --format json`,
+		Args:             cobra.ExactArgs(1),
+		PersistentPreRun: reportExpiredStashes,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			format, _ := cmd.Flags().GetString("format")
+			if err := showHistory(path, args[0], format); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	cmd.Flags().String("format", "", "Output format: json")
+
+	return cmd
+}
+
+func showHistory(path, host, format string) error {
+	collection, err := knownhosts.ParseKnownHosts(path)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	events, err := collection.Timeline(host)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(events)
+	case "":
+	default:
+		return fmt.Errorf("unknown format %q: expected json", format)
+	}
+
+	if len(events) == 0 {
+		fmt.Fprintf(os.Stderr, "No keys known for %s\n", host)
+		return nil
+	}
+	fmt.Printf("%s:\n", host)
+	for _, e := range events {
+		fmt.Printf("  %s\n", e)
+	}
+	return nil
+}
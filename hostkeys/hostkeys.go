@@ -0,0 +1,290 @@
+// Package hostkeys verifies SSH host keys against the known_hosts files khm
+// manages, for Go programs using golang.org/x/crypto/ssh.
+//
+// The callback matches entries the way ssh does: hashed host names,
+// [host]:port addresses, wildcard and negated patterns, @revoked keys and
+// @cert-authority lines, which validate host certificates. Temporary
+// entries (khm add --ttl) are ignored once expired. With TOFU set, keys of
+// hosts that have no known key yet are appended to the file the way khm
+// add does, and trusted from then on.
+//
+//	callback, err := hostkeys.New(filepath.Join(home, ".ssh", "known_hosts"), hostkeys.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	client, err := ssh.Dial("tcp", "web1.example:22", &ssh.ClientConfig{
+//		User:            "deploy",
+//		Auth:            auth,
+//		HostKeyCallback: callback,
+//	})
+//
+// Rejections are reported with the error types of
+// golang.org/x/crypto/ssh/knownhosts: a *knownhosts.KeyError whose Want is
+// empty for unknown hosts and lists the known keys when the key changed, and
+// a *knownhosts.RevokedError for revoked keys. Only the entries of the host
+// name accept a key; entries for the remote IP address can reject a key
+// they do not list, but never vouch for the name.
+package hostkeys
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHosts is a parsed known_hosts file together with its khm metadata.
+type KnownHosts struct {
+	hc *knownhosts.HostCollection
+}
+
+// Load parses the known_hosts file at path and its metadata sidecar.
+func Load(path string) (*KnownHosts, error) {
+	hc, err := knownhosts.ParseKnownHosts(path)
+	if err != nil {
+		return nil, err
+	}
+	return &KnownHosts{hc: hc}, nil
+}
+
+// File returns the path the known hosts were loaded from.
+func (k *KnownHosts) File() string {
+	return k.hc.File
+}
+
+// Options configure the callback.
+type Options struct {
+	// TOFU trusts the key of a host on first use: when no key at all is
+	// known for the host, the key is accepted and appended to the
+	// known_hosts file. Hosts with known keys are never extended, so a
+	// server offering an unknown key type is still rejected.
+	TOFU bool
+	// Hash writes the host names of TOFU entries hashed.
+	Hash bool
+	// Now returns the time used for certificate validity and entry
+	// expiry. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// New loads the known_hosts file at path and returns a callback checking
+// host keys against it.
+func New(path string, opts Options) (ssh.HostKeyCallback, error) {
+	k, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return HostKeyCallback(k, opts), nil
+}
+
+// HostKeyCallback returns a callback checking host keys against k. The
+// callback is safe for concurrent use; TOFU entries it adds are visible
+// through k.
+func HostKeyCallback(k *KnownHosts, opts Options) ssh.HostKeyCallback {
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	c := &checker{hc: k.hc, opts: opts}
+	return c.check
+}
+
+type checker struct {
+	mu   sync.Mutex
+	hc   *knownhosts.HostCollection
+	opts Options
+}
+
+func (c *checker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addresses := lookupAddresses(hostname, remote)
+	now := c.opts.Now()
+	entries := c.hc.TrustedFor(addresses[0], now)
+	ipEntries := make([]*knownhosts.Host, 0)
+	if len(addresses) > 1 {
+		ipEntries = c.hc.TrustedFor(addresses[1], now)
+	}
+
+	if err := c.checkRevoked(append(entries, ipEntries...), key); err != nil {
+		return err
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		for _, h := range entries {
+			if h.Marker == "cert-authority" && sameKey(h, cert.SignatureKey) {
+				return c.checkCertificate(hostname, remote, cert, entries)
+			}
+		}
+		// Without a trusted authority the certified key is checked on its
+		// own, as ssh does.
+		key = cert.Key
+	}
+
+	// Only the entries of the host name can accept the key. The remote
+	// address is looked up as well, as ssh does with CheckHostIP, but a
+	// key known for the IP alone proves nothing about the name, which a
+	// spoofed DNS answer may point anywhere; it can only reject.
+	known, matched := c.match(entries, key)
+	if len(known) > 0 && !matched {
+		return &xknownhosts.KeyError{Want: known}
+	}
+	if ipKnown, ipMatched := c.match(ipEntries, key); len(ipKnown) > 0 && !ipMatched {
+		return &xknownhosts.KeyError{Want: ipKnown}
+	}
+	if matched {
+		return nil
+	}
+
+	if c.opts.TOFU {
+		return c.trust(addresses[0], key)
+	}
+	return &xknownhosts.KeyError{}
+}
+
+// match returns the plain keys among entries and whether key is one of
+// them.
+func (c *checker) match(entries []*knownhosts.Host, key ssh.PublicKey) ([]xknownhosts.KnownKey, bool) {
+	known := make([]xknownhosts.KnownKey, 0)
+	matched := false
+	for _, h := range entries {
+		if h.Marker != "" {
+			continue
+		}
+		if sameKey(h, key) {
+			matched = true
+		}
+		if k, err := knownKey(c.hc, h); err == nil {
+			known = append(known, k)
+		}
+	}
+	return known, matched
+}
+
+// checkRevoked rejects key, or the authority that signed it, when a
+// @revoked entry lists it.
+func (c *checker) checkRevoked(entries []*knownhosts.Host, key ssh.PublicKey) error {
+	candidates := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		candidates = append(candidates, cert.Key, cert.SignatureKey)
+	}
+	for _, h := range entries {
+		if h.Marker != "revoked" {
+			continue
+		}
+		for _, k := range candidates {
+			if sameKey(h, k) {
+				revoked, err := knownKey(c.hc, h)
+				if err != nil {
+					return err
+				}
+				return &xknownhosts.RevokedError{Revoked: revoked}
+			}
+		}
+	}
+	return nil
+}
+
+// checkCertificate validates a host certificate signed by one of the
+// @cert-authority keys among entries: its type, principals, validity and
+// signature.
+func (c *checker) checkCertificate(hostname string, remote net.Addr, cert *ssh.Certificate, entries []*knownhosts.Host) error {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, _ string) bool {
+			for _, h := range entries {
+				if h.Marker == "cert-authority" && sameKey(h, auth) {
+					return true
+				}
+			}
+			return false
+		},
+		Clock: c.opts.Now,
+	}
+	if _, _, err := net.SplitHostPort(hostname); err != nil {
+		hostname = net.JoinHostPort(hostname, "22")
+	}
+	return checker.CheckHostKey(hostname, remote, cert)
+}
+
+// trust appends key for address through khm's write path: the file is read
+// again so concurrent changes are kept, the entry is checked for conflicts
+// and the file is saved with a backup and metadata.
+func (c *checker) trust(address string, key ssh.PublicKey) error {
+	if c.hc.File == "" {
+		return fmt.Errorf("hostkeys: cannot trust %s: the collection has no file", address)
+	}
+	entry := &knownhosts.Host{
+		Addresses: []string{address},
+		Type:      key.Type(),
+		Key:       base64.StdEncoding.EncodeToString(key.Marshal()),
+		Meta:      &knownhosts.Metadata{Source: "tofu"},
+	}
+
+	current, err := knownhosts.ParseKnownHostsFrom(c.hc.Store, c.hc.File)
+	if errors.Is(err, fs.ErrNotExist) {
+		current = knownhosts.NewHostCollection(c.hc.File)
+		current.Store = c.hc.Store
+	} else if err != nil {
+		return fmt.Errorf("hostkeys: failed to read %s: %w", c.hc.File, err)
+	}
+	if _, err := current.AddEntry(entry, c.opts.Hash, false); err != nil {
+		return fmt.Errorf("hostkeys: cannot trust %s: %w", address, err)
+	}
+	if err := current.SaveToFile(current.File); err != nil {
+		return fmt.Errorf("hostkeys: failed to save %s: %w", current.File, err)
+	}
+	*c.hc = *current
+	return nil
+}
+
+// lookupAddresses returns the known_hosts spellings of the host ssh dialed
+// and of the remote address when it differs, e.g. "[web1]:2222" and
+// "[10.0.0.5]:2222".
+func lookupAddresses(hostname string, remote net.Addr) []string {
+	addresses := []string{knownhostsAddress(hostname)}
+	if tcp, ok := remote.(*net.TCPAddr); ok && tcp.IP != nil {
+		ip := knownhosts.FormatAddress(tcp.IP.String(), tcp.Port)
+		if ip != addresses[0] {
+			addresses = append(addresses, ip)
+		}
+	}
+	return addresses
+}
+
+// knownhostsAddress turns "host:port" into the known_hosts form.
+func knownhostsAddress(hostname string) string {
+	host, portStr, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return hostname
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return hostname
+	}
+	return knownhosts.FormatAddress(host, port)
+}
+
+func sameKey(h *knownhosts.Host, key ssh.PublicKey) bool {
+	blob, err := base64.StdEncoding.DecodeString(h.Key)
+	return err == nil && bytes.Equal(blob, key.Marshal())
+}
+
+func knownKey(hc *knownhosts.HostCollection, h *knownhosts.Host) (xknownhosts.KnownKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(h.Key)
+	if err != nil {
+		return xknownhosts.KnownKey{}, err
+	}
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return xknownhosts.KnownKey{}, err
+	}
+	return xknownhosts.KnownKey{Key: key, Filename: hc.File, Line: h.LineNumber}, nil
+}
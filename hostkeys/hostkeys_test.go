@@ -0,0 +1,264 @@
+package hostkeys
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"golang.org/x/crypto/ssh"
+	xknownhosts "golang.org/x/crypto/ssh/knownhosts"
+)
+
+var testNow = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// testSigner returns a deterministic ed25519 signer, distinct per seed.
+func testSigner(t *testing.T, seed byte) ssh.Signer {
+	t.Helper()
+	signer, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func authorized(key ssh.PublicKey) string {
+	return key.Type() + " " + base64.StdEncoding.EncodeToString(key.Marshal())
+}
+
+// hostCert returns a host certificate for key signed by ca.
+func hostCert(t *testing.T, key ssh.PublicKey, ca ssh.Signer, principals []string, after, before time.Time) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(after.Unix()),
+		ValidBefore:     uint64(before.Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeKnownHosts writes lines to a known_hosts file in a fresh directory.
+func writeKnownHosts(t *testing.T, lines []string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	content := strings.Join(lines, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func remoteAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 22}
+}
+
+// checkResult describes an error for comparison: "" for success, "key" with
+// the number of wanted keys, "revoked" or "other".
+func checkResult(err error) (string, int) {
+	var keyErr *xknownhosts.KeyError
+	var revokedErr *xknownhosts.RevokedError
+	switch {
+	case err == nil:
+		return "", 0
+	case errors.As(err, &keyErr):
+		return "key", len(keyErr.Want)
+	case errors.As(err, &revokedErr):
+		return "revoked", 0
+	default:
+		return "other", 0
+	}
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	keyA := testSigner(t, 1).PublicKey()
+	keyB := testSigner(t, 2).PublicKey()
+	ca := testSigner(t, 3)
+	hashed, err := knownhosts.HashHostname("web1.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashedPort, err := knownhosts.HashHostname("[web1.example]:2222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	validCert := hostCert(t, keyA, ca, []string{"web1.example"}, testNow.Add(-time.Hour), testNow.Add(time.Hour))
+	expiredCert := hostCert(t, keyA, ca, []string{"web1.example"}, testNow.Add(-2*time.Hour), testNow.Add(-time.Hour))
+
+	tests := []struct {
+		name     string
+		lines    []string
+		expired  []int // lines whose TTL has passed
+		hostname string
+		remote   string
+		key      ssh.PublicKey
+		result   string
+		want     int
+	}{
+		{"known key", []string{"web1.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+		{"changed key", []string{"web1.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyB, "key", 1},
+		{"unknown host", []string{"web2.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+		{"second key type", []string{"web1.example " + authorized(keyB), "web1.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+		{"alias line", []string{"web1.example,10.0.0.5 " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+
+		// Hashed names.
+		{"hashed name", []string{hashed + " " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+		{"hashed name changed key", []string{hashed + " " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyB, "key", 1},
+		{"hashed name with port", []string{hashedPort + " " + authorized(keyA)}, nil, "web1.example:2222", "10.0.0.5", keyA, "", 0},
+		{"hashed name other port", []string{hashedPort + " " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+
+		// Ports.
+		{"port", []string{"[web1.example]:2222 " + authorized(keyA)}, nil, "web1.example:2222", "10.0.0.5", keyA, "", 0},
+		{"port not on 22", []string{"[web1.example]:2222 " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+		{"plain name not on other port", []string{"web1.example " + authorized(keyA)}, nil, "web1.example:2222", "10.0.0.5", keyA, "key", 0},
+
+		// Wildcards and negation.
+		{"wildcard", []string{"*.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+		{"negated name", []string{"*.example,!web1.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+		{"negation spares others", []string{"*.example,!web2.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+
+		// @revoked.
+		{"revoked", []string{"web1.example " + authorized(keyA), "@revoked * " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "revoked", 0},
+		{"revoked for the IP", []string{"web1.example " + authorized(keyA), "@revoked 10.0.0.5 " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "revoked", 0},
+		{"revoked other key", []string{"web1.example " + authorized(keyA), "@revoked * " + authorized(keyB)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+		{"revoked certified key", []string{"@cert-authority *.example " + authorized(ca.PublicKey()), "@revoked * " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", validCert, "revoked", 0},
+		{"revoked authority", []string{"@cert-authority *.example " + authorized(ca.PublicKey()), "@revoked * " + authorized(ca.PublicKey())}, nil, "web1.example:22", "10.0.0.5", validCert, "revoked", 0},
+
+		// @cert-authority.
+		{"certificate", []string{"@cert-authority *.example " + authorized(ca.PublicKey())}, nil, "web1.example:22", "10.0.0.5", validCert, "", 0},
+		{"certificate other principal", []string{"@cert-authority *.example " + authorized(ca.PublicKey())}, nil, "web2.example:22", "10.0.0.5", validCert, "other", 0},
+		{"expired certificate", []string{"@cert-authority *.example " + authorized(ca.PublicKey())}, nil, "web1.example:22", "10.0.0.5", expiredCert, "other", 0},
+		{"authority for other hosts", []string{"@cert-authority *.test " + authorized(ca.PublicKey())}, nil, "web1.example:22", "10.0.0.5", validCert, "key", 0},
+		{"authority for the IP only", []string{"@cert-authority 10.0.0.5 " + authorized(ca.PublicKey())}, nil, "web1.example:22", "10.0.0.5", validCert, "key", 0},
+		{"certificate without authority uses its key", []string{"web1.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", validCert, "", 0},
+		{"authority is not a host key", []string{"@cert-authority *.example " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+
+		// Temporary entries.
+		{"expired entry", []string{"web1.example " + authorized(keyA)}, []int{1}, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+		{"expired entry beside a current one", []string{"web1.example " + authorized(keyB), "web1.example " + authorized(keyA)}, []int{1}, "web1.example:22", "10.0.0.5", keyA, "", 0},
+
+		// The remote IP can reject, never accept.
+		{"IP key does not vouch for the name", []string{"web1.example " + authorized(keyA), "10.9.9.9 " + authorized(keyB)}, nil, "web1.example:22", "10.9.9.9", keyB, "key", 1},
+		{"IP key alone leaves the name unknown", []string{"10.0.0.5 " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 0},
+		{"IP key mismatch rejects", []string{"web1.example " + authorized(keyA), "10.0.0.5 " + authorized(keyB)}, nil, "web1.example:22", "10.0.0.5", keyA, "key", 1},
+		{"IP matches too", []string{"web1.example " + authorized(keyA), "10.0.0.5 " + authorized(keyA)}, nil, "web1.example:22", "10.0.0.5", keyA, "", 0},
+		{"dialed by IP", []string{"10.0.0.5 " + authorized(keyA)}, nil, "10.0.0.5:22", "10.0.0.5", keyA, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := Load(writeKnownHosts(t, tt.lines))
+			if err != nil {
+				t.Fatal(err)
+			}
+			past := testNow.Add(-time.Minute)
+			for _, line := range tt.expired {
+				k.hc.Entries[line-1].Meta = &knownhosts.Metadata{ExpiresAt: &past}
+			}
+
+			callback := HostKeyCallback(k, Options{Now: func() time.Time { return testNow }})
+			result, want := checkResult(callback(tt.hostname, remoteAddr(tt.remote), tt.key))
+			if result != tt.result || want != tt.want {
+				t.Errorf("got %q with %d wanted keys, want %q with %d", result, want, tt.result, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostKeyCallbackTOFU(t *testing.T) {
+	keyA := testSigner(t, 1).PublicKey()
+	keyB := testSigner(t, 2).PublicKey()
+
+	tests := []struct {
+		name     string
+		lines    []string
+		hash     bool
+		hostname string
+		key      ssh.PublicKey
+		result   string
+		// line is the prefix of the entry TOFU appends, empty when the
+		// file must stay unchanged.
+		line string
+	}{
+		{"new host", nil, false, "web1.example:22", keyA, "", "web1.example " + authorized(keyA)},
+		{"new host with port", nil, false, "web1.example:2222", keyA, "", "[web1.example]:2222 " + authorized(keyA)},
+		{"new host hashed", nil, true, "web1.example:22", keyA, "", "|1|"},
+		{"other hosts known", []string{"web2.example " + authorized(keyB)}, false, "web1.example:22", keyA, "", "web1.example " + authorized(keyA)},
+		{"changed key", []string{"web1.example " + authorized(keyA)}, false, "web1.example:22", keyB, "key", ""},
+		{"known key", []string{"web1.example " + authorized(keyA)}, false, "web1.example:22", keyA, "", ""},
+		{"IP key mismatch", []string{"10.0.0.5 " + authorized(keyB)}, false, "web1.example:22", keyA, "key", ""},
+		{"revoked", []string{"@revoked * " + authorized(keyA)}, false, "web1.example:22", keyA, "revoked", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeKnownHosts(t, tt.lines)
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			k, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			callback := HostKeyCallback(k, Options{TOFU: true, Hash: tt.hash, Now: func() time.Time { return testNow }})
+			if result, _ := checkResult(callback(tt.hostname, remoteAddr("10.0.0.5"), tt.key)); result != tt.result {
+				t.Fatalf("got %q, want %q", result, tt.result)
+			}
+
+			after, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.line == "" {
+				if !bytes.Equal(before, after) {
+					t.Fatalf("file changed:\n%s", after)
+				}
+				return
+			}
+			if !hasLinePrefix(string(after), tt.line) {
+				t.Fatalf("file lacks a line starting with %q:\n%s", tt.line, after)
+			}
+
+			// The trusted key holds from now on, for this callback and a
+			// new one, and a different key is refused.
+			reloaded, err := New(path, Options{TOFU: true, Now: func() time.Time { return testNow }})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, cb := range []ssh.HostKeyCallback{callback, reloaded} {
+				if err := cb(tt.hostname, remoteAddr("10.0.0.5"), tt.key); err != nil {
+					t.Errorf("trusted key refused: %v", err)
+				}
+				if result, _ := checkResult(cb(tt.hostname, remoteAddr("10.0.0.5"), keyB)); result != "key" {
+					t.Errorf("different key after TOFU got %q, want a key error", result)
+				}
+			}
+		})
+	}
+}
+
+func hasLinePrefix(content, prefix string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
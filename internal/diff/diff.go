@@ -0,0 +1,225 @@
+// Package diff renders line based unified diffs for previewing file changes.
+package diff
+
+import (
+	"fmt"
+	"strings"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// maxCells bounds the size of the LCS table; beyond it the changed region is
+// shown as a plain replacement, which is still a valid (if larger) diff.
+const maxCells = 4 << 20
+
+type opKind byte
+
+const (
+	opEqual  opKind = ' '
+	opDelete opKind = '-'
+	opInsert opKind = '+'
+)
+
+type op struct {
+	kind opKind
+	// a and b are the zero-based line indexes in the old and new text.
+	a, b int
+}
+
+// Unified returns a unified diff from a to b, or an empty string when the
+// inputs are identical.
+func Unified(oldName, newName string, a, b []string) string {
+	ops := edits(a, b)
+
+	changed := false
+	for _, o := range ops {
+		if o.kind != opEqual {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+
+	for start := 0; start < len(ops); {
+		// Find the next change.
+		for start < len(ops) && ops[start].kind == opEqual {
+			start++
+		}
+		if start >= len(ops) {
+			break
+		}
+
+		// Extend the hunk while changes are separated by at most 2*context lines.
+		end := start
+		for i := start; i < len(ops); i++ {
+			if ops[i].kind != opEqual {
+				end = i + 1
+				continue
+			}
+			if i-end >= 2*context {
+				break
+			}
+		}
+
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to > len(ops) {
+			to = len(ops)
+		}
+
+		writeHunk(&out, ops[from:to], a, b)
+		start = to
+	}
+
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, ops []op, a, b []string) {
+	aStart, bStart := -1, -1
+	aCount, bCount := 0, 0
+	for _, o := range ops {
+		if o.kind != opInsert {
+			if aStart < 0 {
+				aStart = o.a
+			}
+			aCount++
+		}
+		if o.kind != opDelete {
+			if bStart < 0 {
+				bStart = o.b
+			}
+			bCount++
+		}
+	}
+	// An empty side is reported as the line before the hunk.
+	if aStart < 0 {
+		aStart = ops[0].a - 1
+	}
+	if bStart < 0 {
+		bStart = ops[0].b - 1
+	}
+
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+	for _, o := range ops {
+		switch o.kind {
+		case opEqual:
+			out.WriteString(" " + a[o.a] + "\n")
+		case opDelete:
+			out.WriteString("-" + a[o.a] + "\n")
+		case opInsert:
+			out.WriteString("+" + b[o.b] + "\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// edits computes a minimal edit script after trimming the common prefix and
+// suffix. Insert ops carry the position in a
+// they are inserted before, delete ops the position in b they precede.
+func edits(a, b []string) []op {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]op, 0, len(a)+len(b))
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, op{kind: opEqual, a: i, b: i})
+	}
+
+	midA := a[prefix : len(a)-suffix]
+	midB := b[prefix : len(b)-suffix]
+	for _, o := range lcs(midA, midB) {
+		o.a += prefix
+		o.b += prefix
+		ops = append(ops, o)
+	}
+
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, op{kind: opEqual, a: len(a) - suffix + i, b: len(b) - suffix + i})
+	}
+	return ops
+}
+
+// lcs aligns a and b along a longest common subsequence computed with the
+// classic dynamic programming table.
+func lcs(a, b []string) []op {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 || n*m > maxCells {
+		return replaceAll(n, m)
+	}
+
+	// table[i][j] is the LCS length of a[i:] and b[j:].
+	width := m + 1
+	table := make([]int32, (n+1)*width)
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				table[i*width+j] = table[(i+1)*width+j+1] + 1
+			} else if table[(i+1)*width+j] >= table[i*width+j+1] {
+				table[i*width+j] = table[(i+1)*width+j]
+			} else {
+				table[i*width+j] = table[i*width+j+1]
+			}
+		}
+	}
+
+	ops := make([]op, 0, n+m)
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, op{kind: opEqual, a: i, b: j})
+			i++
+			j++
+		case table[(i+1)*width+j] >= table[i*width+j+1]:
+			ops = append(ops, op{kind: opDelete, a: i, b: j})
+			i++
+		default:
+			ops = append(ops, op{kind: opInsert, a: i, b: j})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, op{kind: opDelete, a: i, b: j})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, op{kind: opInsert, a: i, b: j})
+	}
+	return ops
+}
+
+// replaceAll deletes every old line and inserts every new one.
+func replaceAll(n, m int) []op {
+	ops := make([]op, 0, n+m)
+	for i := 0; i < n; i++ {
+		ops = append(ops, op{kind: opDelete, a: i, b: 0})
+	}
+	for j := 0; j < m; j++ {
+		ops = append(ops, op{kind: opInsert, a: n, b: j})
+	}
+	return ops
+}
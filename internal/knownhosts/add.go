@@ -0,0 +1,144 @@
+package knownhosts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrDuplicate is returned when an address already has the exact key.
+	ErrDuplicate = errors.New("duplicate entry")
+	// ErrConflict is returned when an address already has a different key
+	// of the same type.
+	ErrConflict = errors.New("conflicting key")
+)
+
+// FormatAddress returns the known_hosts spelling of host on port: the bare
+// name for the default port and "[host]:port" otherwise.
+func FormatAddress(host string, port int) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == 0 || port == 22 {
+		return host
+	}
+	return "[" + host + "]:" + strconv.Itoa(port)
+}
+
+// HashHostname returns the hashed form "|1|salt|hash" of a host name, as
+// written by ssh with HashKnownHosts enabled.
+func HashHostname(name string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(CanonicalHostname(name)))
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" +
+		base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// ValidateAddress rejects host fields that would corrupt a known_hosts line.
+func ValidateAddress(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("empty host")
+	}
+	if strings.ContainsAny(addr, ", \t\r\n") {
+		return fmt.Errorf("invalid host %q", addr)
+	}
+	if strings.HasPrefix(addr, "[") {
+		end := strings.Index(addr, "]:")
+		if end < 0 {
+			return fmt.Errorf("invalid host %q: expected [host]:port", addr)
+		}
+		if _, err := strconv.Atoi(addr[end+2:]); err != nil {
+			return fmt.Errorf("invalid port in %q", addr)
+		}
+	} else if strings.Count(addr, ":") == 1 && net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid host %q: use [host]:port or --port", addr)
+	}
+	return nil
+}
+
+// AddEntry validates entry and adds it to the collection. The entry must
+// carry plain addresses; with hash set, one hashed line per address is
+// created instead, as ssh-keygen -H does. Unless force is set, AddEntry
+// refuses entries whose key is already known for one of the addresses
+// (ErrDuplicate) or whose address already has a different key of the same
+// type (ErrConflict). The added entries get a copy of entry.Meta stamped
+// with the time they were added. It returns the entries added.
+func (hc *HostCollection) AddEntry(entry *Host, hash, force bool) ([]*Host, error) {
+	if entry == nil || len(entry.Addresses) == 0 {
+		return nil, fmt.Errorf("at least one host is required")
+	}
+	for _, addr := range entry.Addresses {
+		if err := ValidateAddress(addr); err != nil {
+			return nil, err
+		}
+	}
+	if entry.Marker != "" && entry.Marker != "cert-authority" && entry.Marker != "revoked" {
+		return nil, fmt.Errorf("unknown marker %q: expected cert-authority or revoked", entry.Marker)
+	}
+	if err := ValidateKey(entry.Type, entry.Key); err != nil {
+		return nil, err
+	}
+
+	if !force {
+		if err := hc.checkNewEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	added := make([]*Host, 0, len(entry.Addresses))
+	if hash {
+		for _, addr := range entry.Addresses {
+			hashed, err := HashHostname(addr)
+			if err != nil {
+				return nil, err
+			}
+			h := *entry
+			h.Addresses = []string{hashed}
+			h.IsHashed = true
+			h.HashValue = hashed
+			added = append(added, &h)
+		}
+	} else {
+		h := *entry
+		h.Addresses = append([]string(nil), entry.Addresses...)
+		added = append(added, &h)
+	}
+
+	now := time.Now().UTC()
+	for _, h := range added {
+		h.Source = hc.File
+		h.Meta = entry.Meta.Clone()
+		if meta := h.EnsureMeta(); meta.AddedAt == nil {
+			meta.AddedAt = &now
+		}
+		hc.AddHost(h)
+	}
+	return added, nil
+}
+
+func (hc *HostCollection) checkNewEntry(entry *Host) error {
+	for _, addr := range entry.Addresses {
+		for _, h := range hc.UniqueHosts() {
+			if h.Marker != entry.Marker || !h.HasAddress(addr) {
+				continue
+			}
+			if h.Type == entry.Type && h.Key == entry.Key {
+				return fmt.Errorf("%w: %s already has this %s key on line %d", ErrDuplicate, addr, h.Type, h.LineNumber)
+			}
+			if h.Type == entry.Type && entry.Marker == "" {
+				return fmt.Errorf("%w: %s has a different %s key on line %d (%s)", ErrConflict, addr, h.Type, h.LineNumber, h.Fingerprint())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package knownhosts
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AddAlias appends alias to the host field of every plain entry listing
+// host. Entries that already list alias are left alone, and hashed entries,
+// which cannot carry a plaintext alias, are skipped. It returns the number
+// of entries rewritten and of hashed entries skipped; it fails only when
+// no plaintext entry lists host.
+func (hc *HostCollection) AddAlias(host, alias string) (rewritten, skipped int, err error) {
+	if err := ValidateAddress(alias); err != nil {
+		return 0, 0, err
+	}
+
+	targets := make([]*Host, 0)
+	for _, h := range hc.Entries {
+		if !h.HasAddress(host) {
+			continue
+		}
+		if h.IsHashed {
+			skipped++
+			continue
+		}
+		targets = append(targets, h)
+	}
+	if len(targets) == 0 {
+		if skipped > 0 {
+			return 0, skipped, fmt.Errorf("host only has hashed lines; aliases can only be added to plaintext entries")
+		}
+		return 0, 0, fmt.Errorf("host not found")
+	}
+
+	rewritten, err = hc.AddAliasTo(targets, alias)
+	return rewritten, skipped, err
+}
+
+// AddAliasTo appends alias to the given entries. Hashed entries cannot carry
+// plaintext aliases and are rejected.
+func (hc *HostCollection) AddAliasTo(hosts []*Host, alias string) (int, error) {
+	if err := ValidateAddress(alias); err != nil {
+		return 0, err
+	}
+	for _, h := range hosts {
+		if h.IsHashed {
+			return 0, fmt.Errorf("line %d is hashed; aliases can only be added to plaintext entries", h.LineNumber)
+		}
+	}
+
+	rewritten := 0
+	for _, h := range hosts {
+		if h.HasAddress(alias) {
+			continue
+		}
+		h.setAddresses(append(append([]string(nil), h.Addresses...), alias))
+		rewritten++
+	}
+	hc.reindex()
+	return rewritten, nil
+}
+
+// Split replaces each of the given entries listing several addresses with
+// one entry per address, in place. Entries with negated patterns are kept
+// whole, since a negation only applies within its own line. It returns the
+// number of lines added.
+func (hc *HostCollection) Split(hosts []*Host) int {
+	split := make(map[*Host]bool, len(hosts))
+	for _, h := range hosts {
+		if h != nil && len(h.Addresses) > 1 && consolidatable(h) {
+			split[h] = true
+		}
+	}
+
+	added := 0
+	entries := make([]*Host, 0, len(hc.Entries))
+	for _, h := range hc.Entries {
+		if !split[h] {
+			entries = append(entries, h)
+			continue
+		}
+		for i, addr := range h.Addresses {
+			part := *h
+			part.Meta = h.Meta.Clone()
+			part.setAddresses([]string{addr})
+			entries = append(entries, &part)
+			if i == 0 {
+				hc.moveComments(h, &part)
+			}
+		}
+		added += len(h.Addresses) - 1
+	}
+	hc.Entries = entries
+	hc.reindex()
+	return added
+}
+
+// Consolidate merges the given plaintext entries that carry the identical
+// marker, type and key into a single line listing all their addresses, kept
+// at the position of the first one. The distinct comments of the merged lines
+// are joined with "; ". Hashed entries and entries with negated
+// patterns are skipped, since merging them would change what they match.
+// It returns the number of lines removed.
+func (hc *HostCollection) Consolidate(hosts []*Host) int {
+	type keyID struct {
+		marker, typ, key string
+	}
+
+	groups := make(map[keyID][]*Host)
+	order := make([]keyID, 0)
+	for _, h := range hosts {
+		if h == nil || !consolidatable(h) {
+			continue
+		}
+		id := keyID{h.Marker, h.Type, h.Key}
+		if _, ok := groups[id]; !ok {
+			order = append(order, id)
+		}
+		groups[id] = append(groups[id], h)
+	}
+
+	drop := make([]*Host, 0)
+	for _, id := range order {
+		group := groups[id]
+		if len(group) < 2 {
+			continue
+		}
+		first := group[0]
+		addrs := append([]string(nil), first.Addresses...)
+		comments := make([]string, 0, 1)
+		if first.Comment != "" {
+			comments = append(comments, first.Comment)
+		}
+		for _, h := range group[1:] {
+			for _, a := range h.Addresses {
+				if !containsAddress(addrs, a) {
+					addrs = append(addrs, a)
+				}
+			}
+			if h.Comment != "" && !containsString(comments, h.Comment) {
+				comments = append(comments, h.Comment)
+			}
+			if !h.Meta.Empty() {
+				first.EnsureMeta().merge(h.Meta)
+			}
+			drop = append(drop, h)
+		}
+		first.setAddresses(addrs)
+		first.Comment = strings.Join(comments, "; ")
+	}
+
+	return hc.RemoveEntries(drop)
+}
+
+// consolidatable reports whether h can be split or merged with other lines
+// without changing which hosts it matches.
+func consolidatable(h *Host) bool {
+	if h.IsHashed {
+		return false
+	}
+	for _, a := range h.Addresses {
+		if strings.HasPrefix(a, "!") || strings.HasPrefix(a, "|") {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAddress(addrs []string, addr string) bool {
+	name := CanonicalHostname(addr)
+	for _, a := range addrs {
+		if sameAddress(a, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package knownhosts
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestAddAliasSkipsHashedLines(t *testing.T) {
+	hashed, err := HashHostname("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		lines     []string
+		rewritten int
+		skipped   int
+		fails     bool
+	}{
+		{"plain", []string{"web1 ssh-ed25519 " + testKeyA}, 1, 0, false},
+		{"plain and hashed", []string{"web1 ssh-ed25519 " + testKeyA, hashed + " ssh-rsa " + testKeyB}, 1, 1, false},
+		{"already listed", []string{"web1,w1 ssh-ed25519 " + testKeyA}, 0, 0, false},
+		{"hashed only", []string{hashed + " ssh-rsa " + testKeyB}, 0, 1, true},
+		{"unknown host", []string{"web2 ssh-ed25519 " + testKeyA}, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHostCollection("")
+			for i, line := range tt.lines {
+				hc.AddHost(parseHostLine(line, i+1))
+			}
+
+			rewritten, skipped, err := hc.AddAlias("web1", "w1")
+			if (err != nil) != tt.fails {
+				t.Fatalf("AddAlias error = %v, want failure %v", err, tt.fails)
+			}
+			if rewritten != tt.rewritten || skipped != tt.skipped {
+				t.Errorf("rewrote %d, skipped %d, want %d and %d", rewritten, skipped, tt.rewritten, tt.skipped)
+			}
+			for _, h := range hc.Entries {
+				if h.IsHashed && len(h.Addresses) != 1 {
+					t.Errorf("hashed line changed: %v", h.Addresses)
+				}
+				if !h.IsHashed && h.HasAddress("web1") && !tt.fails && !slices.Contains(h.Addresses, "w1") {
+					t.Errorf("plain line lacks the alias: %v", h.Addresses)
+				}
+			}
+		})
+	}
+
+	// Explicit selections stay strict.
+	hc := NewHostCollection("")
+	hc.AddHost(parseHostLine(hashed+" ssh-rsa "+testKeyB, 1))
+	if _, err := hc.AddAliasTo(hc.Entries, "w1"); err == nil {
+		t.Error("AddAliasTo accepted a hashed entry")
+	}
+}
@@ -0,0 +1,158 @@
+package knownhosts
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SortKeys lists the orderings accepted by Canonicalize: by host field, by
+// key type, or by first appearance in the file.
+var SortKeys = []string{"host", "type", "file"}
+
+// CanonicalAddress returns the canonical spelling of a plaintext host
+// pattern: lowercase, IPv6 addresses in their shortest form and "[host]:22"
+// written as plain "host". Hashed fields are returned unchanged.
+func CanonicalAddress(addr string) string {
+	if strings.HasPrefix(addr, "|") {
+		return addr
+	}
+
+	negation := ""
+	if strings.HasPrefix(addr, "!") {
+		negation = "!"
+		addr = addr[1:]
+	}
+
+	host := strings.ToLower(strings.TrimSpace(addr))
+	port := ""
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]:"); end >= 0 {
+			host, port = host[1:end], host[end+2:]
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.To4() == nil || !strings.Contains(host, ":")) {
+		host = ip.String()
+	}
+
+	if port == "" {
+		return negation + host
+	}
+	if p, err := strconv.Atoi(port); err == nil {
+		return negation + FormatAddress(host, p)
+	}
+	return negation + "[" + host + "]:" + port
+}
+
+// Canonicalize rewrites the collection into its canonical form: plaintext
+// addresses are canonicalized and deduplicated, the keys of one host field
+// are grouped together ordered by type, and the groups are ordered by
+// sortKey (one of SortKeys). Hashed lines keep their relative order after
+// the plaintext ones, since their host field carries no usable order.
+func (hc *HostCollection) Canonicalize(sortKey string) error {
+	switch sortKey {
+	case "host", "type", "file":
+	default:
+		return fmt.Errorf("unknown sort key %q: expected one of %s", sortKey, strings.Join(SortKeys, ", "))
+	}
+
+	for _, h := range hc.Entries {
+		h.Marker = strings.ToLower(h.Marker)
+		if h.IsHashed {
+			continue
+		}
+		addrs := make([]string, 0, len(h.Addresses))
+		for _, a := range h.Addresses {
+			a = CanonicalAddress(a)
+			if !containsString(addrs, a) {
+				addrs = append(addrs, a)
+			}
+		}
+		h.setAddresses(addrs)
+	}
+
+	type group struct {
+		label   string
+		hashed  bool
+		entries []*Host
+	}
+	index := make(map[string]int)
+	groups := make([]*group, 0)
+	for _, h := range hc.Entries {
+		label := h.HostField()
+		i, ok := index[label]
+		if !ok {
+			i = len(groups)
+			index[label] = i
+			groups = append(groups, &group{label: label, hashed: h.IsHashed})
+		}
+		groups[i].entries = append(groups[i].entries, h)
+	}
+
+	for _, g := range groups {
+		sort.SliceStable(g.entries, func(i, j int) bool {
+			return g.entries[i].Type < g.entries[j].Type
+		})
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.hashed != b.hashed {
+			return !a.hashed
+		}
+		if a.hashed || sortKey == "file" {
+			return false
+		}
+		if sortKey == "type" && a.entries[0].Type != b.entries[0].Type {
+			return a.entries[0].Type < b.entries[0].Type
+		}
+		return lessHostField(a.entries[0], b.entries[0])
+	})
+
+	entries := make([]*Host, 0, len(hc.Entries))
+	for _, g := range groups {
+		entries = append(entries, g.entries...)
+	}
+	hc.Entries = entries
+	hc.reindex()
+	return nil
+}
+
+// lessHostField orders plaintext entries by marker, then by their first
+// address: names alphabetically before IP addresses, which are compared
+// numerically.
+func lessHostField(a, b *Host) bool {
+	if a.Marker != b.Marker {
+		return a.Marker < b.Marker
+	}
+	x, y := a.Addresses[0], b.Addresses[0]
+	ipX, ipY := addressIP(x), addressIP(y)
+	switch {
+	case ipX == nil && ipY == nil:
+		if x != y {
+			return x < y
+		}
+		return a.HostField() < b.HostField()
+	case ipX == nil:
+		return true
+	case ipY == nil:
+		return false
+	}
+
+	if c := bytes.Compare(ipX.To16(), ipY.To16()); c != 0 {
+		return c < 0
+	}
+	return a.HostField() < b.HostField()
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package knownhosts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// formatFile runs what khm fmt does on path and reports whether the file
+// already was canonical, as fmt --check would.
+func formatFile(t *testing.T, path string, write bool) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc, err := ParseKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hc.Canonicalize("host"); err != nil {
+		t.Fatal(err)
+	}
+	canonical := string(hc.Render()) == string(data)
+	if write && !canonical {
+		if err := hc.SaveToFile(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return canonical
+}
+
+func TestFormatKeepsComments(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			"one entry and a comment",
+			"# managed by puppet\nweb1.example ssh-ed25519 " + testKeyA + "\n",
+			"# managed by puppet\nweb1.example ssh-ed25519 " + testKeyA + "\n",
+		},
+		{
+			"comments move with the entry below",
+			"# top\n\nweb2.example ssh-ed25519 " + testKeyA + "\n\n# first\nweb1.example  ssh-ed25519 " + testKeyB + "\n# end\n",
+			"# top\n\n# first\nweb1.example ssh-ed25519 " + testKeyB + "\nweb2.example ssh-ed25519 " + testKeyA + "\n# end\n",
+		},
+		{
+			"blank lines collapse",
+			"\n\n# a\n\n\nWEB1.example ssh-ed25519 " + testKeyA + "\n\n\n",
+			"# a\n\nweb1.example ssh-ed25519 " + testKeyA + "\n",
+		},
+		{
+			"only comments",
+			"# nothing yet\n",
+			"# nothing yet\n",
+		},
+		{
+			"unparseable lines are kept",
+			"web1.example ssh-ed25519 " + testKeyA + "\nbroken.example ssh-ed25519\n",
+			"web1.example ssh-ed25519 " + testKeyA + "\nbroken.example ssh-ed25519\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(path, []byte(tt.in), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			canonical := formatFile(t, path, true)
+			if want := tt.in == tt.want; canonical != want {
+				t.Errorf("first check reported canonical = %v, want %v", canonical, want)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("formatted file:\n%s\nwant:\n%s", got, tt.want)
+			}
+			if !formatFile(t, path, false) {
+				t.Error("the formatted file does not pass the check")
+			}
+		})
+	}
+}
+
+func TestSaveKeepsCommentsOfRemovedEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	in := strings.Join([]string{
+		"# header",
+		"web1.example ssh-ed25519 " + testKeyA,
+		"# about web2",
+		"web2.example ssh-ed25519 " + testKeyA,
+		"web3.example ssh-ed25519 " + testKeyB,
+		"# about web4",
+		"web4.example ssh-ed25519 " + testKeyB,
+	}, "\n") + "\n"
+	if err := os.WriteFile(path, []byte(in), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hc, err := ParseKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc.RemoveEntries([]*Host{hc.Entries[1], hc.Entries[3]})
+
+	want := strings.Join([]string{
+		"# header",
+		"web1.example ssh-ed25519 " + testKeyA,
+		"# about web2",
+		"web3.example ssh-ed25519 " + testKeyB,
+		"# about web4",
+	}, "\n") + "\n"
+	if got := string(hc.Render()); got != want {
+		t.Errorf("rendered:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,152 @@
+package knownhosts
+
+import (
+	"sort"
+	"strings"
+)
+
+// Conflict is a host and key type for which the file lists more than one
+// distinct key. ssh accepts any of them, which makes a rotated or spoofed
+// key easy to miss.
+type Conflict struct {
+	// Host is the canonical host name or pattern the entries share.
+	Host string
+	Type string
+	// Entries lists every entry involved, in file order.
+	Entries []*Host
+}
+
+// Keys returns one entry per distinct key of the conflict, in file order.
+func (c Conflict) Keys() []*Host {
+	seen := make(map[string]bool)
+	keys := make([]*Host, 0, len(c.Entries))
+	for _, h := range c.Entries {
+		if !seen[h.Key] {
+			seen[h.Key] = true
+			keys = append(keys, h)
+		}
+	}
+	return keys
+}
+
+// Duplicates returns the entries that repeat an earlier entry: same marker,
+// type, key and set of addresses (compared case-insensitively and ignoring
+// order). Hashed entries are duplicates only of the identical hash.
+func (hc *HostCollection) Duplicates() []*Host {
+	seen := make(map[string]bool)
+	dups := make([]*Host, 0)
+	for _, h := range hc.Entries {
+		id := duplicateKey(h)
+		if seen[id] {
+			dups = append(dups, h)
+			continue
+		}
+		seen[id] = true
+	}
+	return dups
+}
+
+func duplicateKey(h *Host) string {
+	addrs := make([]string, 0, len(h.Addresses))
+	for _, a := range h.Addresses {
+		if !h.IsHashed {
+			a = CanonicalHostname(a)
+		}
+		if !containsString(addrs, a) {
+			addrs = append(addrs, a)
+		}
+	}
+	sort.Strings(addrs)
+	return h.Marker + " " + strings.Join(addrs, ",") + " " + h.Type + " " + h.Key
+}
+
+// Conflicts returns the host and type pairs with more than one distinct key,
+// sorted by host and type. Marked lines (@cert-authority, @revoked) and
+// negated patterns are not host keys and are ignored. Hashed entries are
+// included when they match a host name written in plaintext elsewhere in
+// the file, since hashed names cannot be compared with each other.
+func (hc *HostCollection) Conflicts() []Conflict {
+	type pair struct{ host, typ string }
+	byPair := make(map[pair][]*Host)
+	hashed := make([]*Host, 0)
+
+	for _, h := range hc.Entries {
+		if h.Marker != "" {
+			continue
+		}
+		if h.IsHashed {
+			hashed = append(hashed, h)
+			continue
+		}
+		for _, a := range h.Addresses {
+			if strings.HasPrefix(a, "!") {
+				continue
+			}
+			p := pair{CanonicalHostname(a), h.Type}
+			if !containsHost(byPair[p], h) {
+				byPair[p] = append(byPair[p], h)
+			}
+		}
+	}
+
+	for p, entries := range byPair {
+		for _, h := range hashed {
+			if h.Type == p.typ && matchHashed(h.HashValue, p.host) {
+				entries = append(entries, h)
+			}
+		}
+		byPair[p] = entries
+	}
+
+	position := make(map[*Host]int, len(hc.Entries))
+	for i, h := range hc.Entries {
+		position[h] = i
+	}
+
+	conflicts := make([]Conflict, 0)
+	for p, entries := range byPair {
+		c := Conflict{Host: p.host, Type: p.typ, Entries: entries}
+		if len(c.Keys()) < 2 {
+			continue
+		}
+		sort.SliceStable(c.Entries, func(i, j int) bool {
+			return position[c.Entries[i]] < position[c.Entries[j]]
+		})
+		conflicts = append(conflicts, c)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Host != conflicts[j].Host {
+			return conflicts[i].Host < conflicts[j].Host
+		}
+		return conflicts[i].Type < conflicts[j].Type
+	})
+	return conflicts
+}
+
+// ResolveConflict keeps the key of keep for the conflicting host and drops
+// the host from every entry carrying another key. Other aliases on those
+// lines are left alone; lines left without a host are removed. It returns
+// the number of entries rewritten and removed.
+func (hc *HostCollection) ResolveConflict(c Conflict, keep *Host) (rewritten, removed int) {
+	return hc.RemoveAliasFrom(c.Stale(keep), c.Host)
+}
+
+// Stale returns the entries of c whose key is not the key of keep.
+func (c Conflict) Stale(keep *Host) []*Host {
+	stale := make([]*Host, 0, len(c.Entries))
+	for _, h := range c.Entries {
+		if h.Key != keep.Key {
+			stale = append(stale, h)
+		}
+	}
+	return stale
+}
+
+func containsHost(hosts []*Host, h *Host) bool {
+	for _, e := range hosts {
+		if e == h {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package knownhosts
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// EntryGroup collects the entries that share an identical host field, i.e.
+// the keys of one host (or one set of aliases).
+type EntryGroup struct {
+	// Label is the host field, prefixed with the marker when present, or
+	// the section name for groups made by GroupBy.
+	Label   string
+	Entries []*Host
+}
+
+// HostField returns the address field of the entry as written in the file,
+// prefixed with "@marker " for marked lines.
+func (h *Host) HostField() string {
+	field := strings.Join(h.Addresses, ",")
+	if h.Marker != "" {
+		field = "@" + h.Marker + " " + field
+	}
+	return field
+}
+
+// GroupEntries groups entries by host field, sorted by label. Entries keep
+// their relative order within a group.
+func GroupEntries(entries []*Host) []EntryGroup {
+	index := make(map[string]int)
+	groups := make([]EntryGroup, 0)
+	for _, h := range entries {
+		if h == nil {
+			continue
+		}
+		label := h.HostField()
+		i, ok := index[label]
+		if !ok {
+			i = len(groups)
+			index[label] = i
+			groups = append(groups, EntryGroup{Label: label})
+		}
+		groups[i].Entries = append(groups[i].Entries, h)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Label < groups[j].Label
+	})
+	return groups
+}
+
+// SectionFields lists the fields accepted by GroupBy.
+var SectionFields = []string{"tag", "type", "domain", "file"}
+
+// GroupBy sorts entries into named sections by field: "tag" (one section per
+// metadata tag, so an entry may appear in several), "type" (key type),
+// "domain" (domain suffix of the plaintext names) or "file" (source file).
+// Entries without a value land in a "(none)" section and hashed entries in
+// "(hashed)" when grouping by domain. Sections are sorted by name, with the
+// parenthesized catch-all sections last; entries keep their order.
+func GroupBy(entries []*Host, field string) ([]EntryGroup, error) {
+	var names func(h *Host) []string
+	switch field {
+	case "tag":
+		names = func(h *Host) []string {
+			if h.Meta == nil {
+				return nil
+			}
+			return h.Meta.Tags
+		}
+	case "type":
+		names = func(h *Host) []string { return []string{h.Type} }
+	case "domain":
+		names = func(h *Host) []string {
+			if h.IsHashed {
+				return []string{"(hashed)"}
+			}
+			out := make([]string, 0, 1)
+			for _, a := range h.Addresses {
+				host := addressHost(strings.TrimPrefix(a, "!"))
+				if net.ParseIP(host) != nil {
+					continue
+				}
+				suffix := domainSuffix(host)
+				if suffix != "" && !containsString(out, suffix) {
+					out = append(out, suffix)
+				}
+			}
+			return out
+		}
+	case "file":
+		names = func(h *Host) []string { return []string{h.Source} }
+	default:
+		return nil, fmt.Errorf("unknown group field %q: expected %s", field, strings.Join(SectionFields, ", "))
+	}
+
+	index := make(map[string]int)
+	groups := make([]EntryGroup, 0)
+	for _, h := range entries {
+		if h == nil {
+			continue
+		}
+		labels := names(h)
+		if len(labels) == 0 || (len(labels) == 1 && labels[0] == "") {
+			labels = []string{"(none)"}
+		}
+		for _, label := range labels {
+			i, ok := index[label]
+			if !ok {
+				i = len(groups)
+				index[label] = i
+				groups = append(groups, EntryGroup{Label: label})
+			}
+			groups[i].Entries = append(groups[i].Entries, h)
+		}
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i].Label, groups[j].Label
+		if ca, cb := strings.HasPrefix(a, "("), strings.HasPrefix(b, "("); ca != cb {
+			return cb
+		}
+		return a < b
+	})
+	return groups, nil
+}
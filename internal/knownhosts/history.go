@@ -0,0 +1,264 @@
+package knownhosts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Operations recorded in the history archive.
+const (
+	OpDelete      = "delete"
+	OpAliasRemove = "alias-rm"
+	OpConflict    = "conflict"
+	OpGC          = "gc"
+	OpRotate      = "rotate"
+	OpStashDrop   = "stash-drop"
+)
+
+// HistoryRecord describes a key that khm removed from a known_hosts file or
+// replaced, so that it can still be looked up after it is gone.
+type HistoryRecord struct {
+	// Host is the host field the key was removed for: the whole line, or
+	// only the alias that was dropped from it. Hashed names stay hashed.
+	Host        string     `json:"host"`
+	Marker      string     `json:"marker,omitempty"`
+	Type        string     `json:"type"`
+	Key         string     `json:"key"`
+	Fingerprint string     `json:"fingerprint"`
+	AddedAt     *time.Time `json:"added_at,omitempty"`
+	RemovedAt   time.Time  `json:"removed_at"`
+	By          string     `json:"by,omitempty"`
+	Operation   string     `json:"operation"`
+	Reason      string     `json:"reason,omitempty"`
+	// ReplacedBy is the fingerprint of the key that took its place.
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// HistoryPath returns the file archiving the keys removed from the
+// known_hosts file at path.
+func HistoryPath(path string) string {
+	return path + ".history.json"
+}
+
+type historyFile struct {
+	Entries []HistoryRecord `json:"entries"`
+}
+
+func newHistoryRecord(h *Host, host, op, reason string, now time.Time) HistoryRecord {
+	r := HistoryRecord{
+		Host:        host,
+		Marker:      h.Marker,
+		Type:        h.Type,
+		Key:         h.Key,
+		Fingerprint: h.Fingerprint(),
+		RemovedAt:   now,
+		By:          currentUser(),
+		Operation:   op,
+		Reason:      reason,
+	}
+	if h.Meta != nil {
+		r.AddedAt = h.Meta.AddedAt
+	}
+	return r
+}
+
+// Archive records the removal of hosts from the file by op in the history
+// archive. Call it before the entries are removed.
+func (hc *HostCollection) Archive(hosts []*Host, op, reason string) error {
+	now := time.Now().UTC()
+	records := make([]HistoryRecord, 0, len(hosts))
+	for _, h := range hosts {
+		if h != nil {
+			records = append(records, newHistoryRecord(h, strings.Join(h.Addresses, ","), op, reason, now))
+		}
+	}
+	return appendHistory(hc.store(), hc.File, records)
+}
+
+// ArchiveAlias records that address is dropped from hosts, as
+// RemoveAliasFrom does. Entries not listing address are skipped.
+func (hc *HostCollection) ArchiveAlias(hosts []*Host, address, op, reason string) error {
+	name := CanonicalHostname(address)
+	now := time.Now().UTC()
+	records := make([]HistoryRecord, 0, len(hosts))
+	for _, h := range hosts {
+		if h == nil {
+			continue
+		}
+		removed := make([]string, 0, 1)
+		for _, a := range h.Addresses {
+			if sameAddress(a, name) {
+				removed = append(removed, a)
+			}
+		}
+		if len(removed) > 0 {
+			records = append(records, newHistoryRecord(h, strings.Join(removed, ","), op, reason, now))
+		}
+	}
+	return appendHistory(hc.store(), hc.File, records)
+}
+
+// ArchiveStashed records the removal of stashed entries in the history of
+// the file each was stashed from.
+func (hc *HostCollection) ArchiveStashed(hosts []*Host, op, reason string) error {
+	now := time.Now().UTC()
+	byOrigin := make(map[string][]HistoryRecord)
+	origins := make([]string, 0)
+	for _, h := range hosts {
+		origin := h.StashOrigin(hc.File)
+		if _, ok := byOrigin[origin]; !ok {
+			origins = append(origins, origin)
+		}
+		byOrigin[origin] = append(byOrigin[origin], newHistoryRecord(h, strings.Join(h.Addresses, ","), op, reason, now))
+	}
+	for _, origin := range origins {
+		if err := appendHistory(hc.store(), origin, byOrigin[origin]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readHistory(store Store, path string) ([]HistoryRecord, error) {
+	data, err := store.ReadFile(HistoryPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return nil, nil
+	}
+	var f historyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", HistoryPath(path), err)
+	}
+	return f.Entries, nil
+}
+
+func appendHistory(store Store, path string, records []HistoryRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	existing, err := readHistory(store, path)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(historyFile{Entries: append(existing, records...)}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.WriteFile(HistoryPath(path), append(data, '\n'), false); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// History returns the archived records of keys removed for address, oldest
+// first. Hashed records match as in HasAddress; address may also be a hashed
+// host field itself.
+func (hc *HostCollection) History(address string) ([]HistoryRecord, error) {
+	records, err := readHistory(hc.store(), hc.File)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]HistoryRecord, 0)
+	for _, r := range records {
+		h := &Host{}
+		h.setAddresses(strings.Split(r.Host, ","))
+		if historyMatch(h, address) {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].RemovedAt.Before(out[j].RemovedAt) })
+	return out, nil
+}
+
+// KeyEvent is one step in the timeline of the keys of a host.
+type KeyEvent struct {
+	// At is when it happened; zero when the time was not recorded.
+	At          time.Time `json:"at"`
+	Action      string    `json:"action"` // "added" or "removed"
+	Type        string    `json:"type"`
+	Fingerprint string    `json:"fingerprint"`
+	// Current is set on the additions of keys that are still in the file.
+	Current    bool   `json:"current,omitempty"`
+	Operation  string `json:"operation,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	By         string `json:"by,omitempty"`
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// String formats the event on one line.
+func (e KeyEvent) String() string {
+	at := "unknown         "
+	if !e.At.IsZero() {
+		at = e.At.Local().Format("2006-01-02 15:04")
+	}
+	line := fmt.Sprintf("%s  %-7s  %s %s", at, e.Action, e.Type, e.Fingerprint)
+	switch {
+	case e.Current:
+		line += "  (current)"
+	case e.Action == "removed":
+		details := e.Operation
+		if e.By != "" {
+			details += " by " + e.By
+		}
+		if e.Reason != "" {
+			details += ": " + e.Reason
+		}
+		if e.ReplacedBy != "" {
+			details += ", replaced by " + e.ReplacedBy
+		}
+		line += "  " + details
+	}
+	return line
+}
+
+// Timeline returns when the keys of address were added and removed, from the
+// current entries and the history archive, oldest first.
+func (hc *HostCollection) Timeline(address string) ([]KeyEvent, error) {
+	records, err := hc.History(address)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]KeyEvent, 0, 2*len(records))
+	// A key removed from one line may still be on another; it was added once.
+	added := make(map[string]bool)
+	for _, h := range hc.Entries {
+		if historyMatch(h, address) && h.Meta != nil && h.Meta.AddedAt != nil {
+			added[h.Fingerprint()+h.Meta.AddedAt.String()] = true
+		}
+	}
+	for _, r := range records {
+		if r.AddedAt != nil && !added[r.Fingerprint+r.AddedAt.String()] {
+			added[r.Fingerprint+r.AddedAt.String()] = true
+			events = append(events, KeyEvent{At: *r.AddedAt, Action: "added", Type: r.Type, Fingerprint: r.Fingerprint})
+		}
+		events = append(events, KeyEvent{At: r.RemovedAt, Action: "removed", Type: r.Type, Fingerprint: r.Fingerprint,
+			Operation: r.Operation, Reason: r.Reason, By: r.By, ReplacedBy: r.ReplacedBy})
+	}
+	for _, h := range hc.Entries {
+		if !historyMatch(h, address) {
+			continue
+		}
+		e := KeyEvent{Action: "added", Type: h.Type, Fingerprint: h.Fingerprint(), Current: true}
+		if h.Meta != nil && h.Meta.AddedAt != nil {
+			e.At = *h.Meta.AddedAt
+		}
+		events = append(events, e)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events, nil
+}
+
+func historyMatch(h *Host, address string) bool {
+	return h.HasAddress(address) || containsString(h.Addresses, address)
+}
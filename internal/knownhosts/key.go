@@ -0,0 +1,75 @@
+package knownhosts
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+)
+
+// Fingerprint returns the OpenSSH style SHA256 fingerprint of the host key,
+// e.g. "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+// It returns an empty string when the key is not valid base64.
+func (h *Host) Fingerprint() string {
+	if h == nil {
+		return ""
+	}
+	return KeyFingerprint(h.Key)
+}
+
+// KeyFingerprint computes the SHA256 fingerprint of a base64 encoded key blob.
+func KeyFingerprint(key string) string {
+	blob, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(blob) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ValidateKey checks that key is a base64 encoded SSH public key blob whose
+// embedded algorithm name matches keyType.
+func ValidateKey(keyType, key string) error {
+	if keyType == "" {
+		return fmt.Errorf("key type is required")
+	}
+	blob, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("key is not valid base64: %w", err)
+	}
+	r := wireReader{data: blob}
+	name, ok := r.string()
+	if !ok || len(name) == 0 {
+		return fmt.Errorf("key blob is malformed")
+	}
+	if string(name) != keyType {
+		return fmt.Errorf("key blob is %s, not %s", name, keyType)
+	}
+	if r.empty() {
+		return fmt.Errorf("key blob has no key material")
+	}
+	return nil
+}
+
+// wireReader decodes the SSH wire format (RFC 4251) used in key blobs.
+type wireReader struct {
+	data []byte
+}
+
+// string reads a uint32 length prefixed byte string.
+func (r *wireReader) string() ([]byte, bool) {
+	if len(r.data) < 4 {
+		return nil, false
+	}
+	n := binary.BigEndian.Uint32(r.data)
+	if uint64(len(r.data)-4) < uint64(n) {
+		return nil, false
+	}
+	s := r.data[4 : 4+n]
+	r.data = r.data[4+n:]
+	return s, true
+}
+
+func (r *wireReader) empty() bool {
+	return len(r.data) == 0
+}
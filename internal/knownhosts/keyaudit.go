@@ -0,0 +1,210 @@
+package knownhosts
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Severity ranks audit findings.
+type Severity string
+
+const (
+	SeverityInfo    Severity = "info"
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Rank orders severities: info < warning < error. Unknown values rank 0.
+func (s Severity) Rank() int {
+	switch s {
+	case SeverityInfo:
+		return 1
+	case SeverityWarning:
+		return 2
+	case SeverityError:
+		return 3
+	}
+	return 0
+}
+
+// ParseSeverity validates a severity name.
+func ParseSeverity(s string) (Severity, error) {
+	sev := Severity(strings.ToLower(s))
+	if sev.Rank() == 0 {
+		return "", fmt.Errorf("unknown severity %q: expected info, warning or error", s)
+	}
+	return sev, nil
+}
+
+// Finding is one problem reported for an entry.
+type Finding struct {
+	// Rule identifies the check, e.g. "rsa-key-size".
+	Rule     string
+	Severity Severity
+	Message  string
+	Entry    *Host
+}
+
+// KeyInfo describes a decoded public key blob.
+type KeyInfo struct {
+	// Algorithm is the type name embedded in the blob.
+	Algorithm string
+	// Bits is the modulus size for RSA and DSA and the curve size for
+	// ECDSA and Ed25519 keys.
+	Bits int
+	// Curve is the curve identifier of ECDSA keys, e.g. "nistp256".
+	Curve string
+}
+
+// DecodeKey parses the base64 key blob of an entry.
+func DecodeKey(key string) (KeyInfo, error) {
+	blob, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	r := wireReader{data: blob}
+	name, ok := r.string()
+	if !ok || len(name) == 0 {
+		return KeyInfo{}, fmt.Errorf("key blob is malformed")
+	}
+	info := KeyInfo{Algorithm: string(name)}
+
+	switch info.Algorithm {
+	case "ssh-rsa":
+		// e, then the modulus n
+		if _, ok := r.string(); !ok {
+			return info, fmt.Errorf("rsa key blob is truncated")
+		}
+		n, ok := r.string()
+		if !ok {
+			return info, fmt.Errorf("rsa key blob is truncated")
+		}
+		info.Bits = new(big.Int).SetBytes(n).BitLen()
+	case "ssh-dss":
+		p, ok := r.string()
+		if !ok {
+			return info, fmt.Errorf("dsa key blob is truncated")
+		}
+		info.Bits = new(big.Int).SetBytes(p).BitLen()
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521",
+		"sk-ecdsa-sha2-nistp256@openssh.com":
+		curve, ok := r.string()
+		if !ok {
+			return info, fmt.Errorf("ecdsa key blob is truncated")
+		}
+		info.Curve = string(curve)
+		info.Bits = curveBits[info.Curve]
+	case "ssh-ed25519", "sk-ssh-ed25519@openssh.com":
+		info.Bits = 256
+	}
+	return info, nil
+}
+
+var curveBits = map[string]int{"nistp256": 256, "nistp384": 384, "nistp521": 521}
+
+// KeyRules configures AuditKeys.
+type KeyRules struct {
+	// Allow, when not empty, is the complete list of acceptable algorithms.
+	Allow []string
+	// Deny lists algorithms that are always reported as errors.
+	Deny []string
+	// MinRSABits is the smallest acceptable RSA modulus.
+	MinRSABits int
+	// WeakCurves lists ECDSA curves reported as deprecated.
+	WeakCurves []string
+}
+
+// DefaultKeyRules flags what current OpenSSH releases refuse or discourage:
+// DSA keys, RSA keys under 2048 bits and unknown algorithms.
+func DefaultKeyRules() KeyRules {
+	return KeyRules{
+		Deny:       []string{"ssh-dss"},
+		MinRSABits: 2048,
+	}
+}
+
+// KnownAlgorithms are the host key algorithms understood by OpenSSH.
+var KnownAlgorithms = []string{
+	"ssh-ed25519",
+	"sk-ssh-ed25519@openssh.com",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"sk-ecdsa-sha2-nistp256@openssh.com",
+	"ssh-rsa",
+	"ssh-dss",
+}
+
+// KeyRuleDescriptions documents the rule identifiers used in findings.
+var KeyRuleDescriptions = map[string]string{
+	"malformed-key":        "Key blob cannot be decoded or does not match the key type",
+	"denied-algorithm":     "Key algorithm is on the deny list",
+	"disallowed-algorithm": "Key algorithm is not on the allow list",
+	"unknown-algorithm":    "Key algorithm is not known to OpenSSH",
+	"rsa-key-size":         "RSA key is shorter than the required size",
+	"weak-curve":           "ECDSA key uses a deprecated curve",
+}
+
+// Check returns the findings for one entry.
+func (r KeyRules) Check(h *Host) []Finding {
+	findings := make([]Finding, 0)
+	add := func(rule string, sev Severity, format string, args ...interface{}) {
+		findings = append(findings, Finding{Rule: rule, Severity: sev, Message: fmt.Sprintf(format, args...), Entry: h})
+	}
+
+	info, err := DecodeKey(h.Key)
+	if err != nil {
+		add("malformed-key", SeverityError, "%v", err)
+		return findings
+	}
+	if info.Algorithm != h.Type {
+		add("malformed-key", SeverityError, "key blob is %s, not %s", info.Algorithm, h.Type)
+		return findings
+	}
+
+	switch {
+	case containsString(r.Deny, info.Algorithm):
+		add("denied-algorithm", SeverityError, "%s keys are denied", info.Algorithm)
+	case len(r.Allow) > 0 && !containsString(r.Allow, info.Algorithm):
+		add("disallowed-algorithm", SeverityWarning, "%s is not an allowed algorithm", info.Algorithm)
+	case !containsString(KnownAlgorithms, info.Algorithm):
+		add("unknown-algorithm", SeverityWarning, "unknown key algorithm %s", info.Algorithm)
+	}
+
+	if info.Algorithm == "ssh-rsa" && info.Bits < r.MinRSABits {
+		sev := SeverityWarning
+		if info.Bits < 1024 {
+			// OpenSSH 9.1 and later refuse these outright.
+			sev = SeverityError
+		}
+		add("rsa-key-size", sev, "RSA key has %d bits, minimum is %d", info.Bits, r.MinRSABits)
+	}
+
+	if info.Curve != "" && containsString(r.WeakCurves, info.Curve) {
+		add("weak-curve", SeverityWarning, "ECDSA key uses deprecated curve %s", info.Curve)
+	}
+
+	return findings
+}
+
+// AuditKeys applies rules to every entry and returns the findings ordered
+// by file and line.
+func AuditKeys(entries []*Host, rules KeyRules) []Finding {
+	findings := make([]Finding, 0)
+	for _, h := range entries {
+		if h != nil {
+			findings = append(findings, rules.Check(h)...)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i].Entry, findings[j].Entry
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.LineNumber < b.LineNumber
+	})
+	return findings
+}
@@ -0,0 +1,148 @@
+package knownhosts
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+)
+
+// Matches reports whether the entry applies to hostname the same way ssh
+// would check it. The hostname may be given as "host" or "[host]:port";
+// port 22 is treated as the bare host name. Hashed entries are verified
+// against the HMAC stored in the line, wildcard patterns (* and ?) are
+// expanded and negated patterns (!pattern) exclude the entry.
+func (h *Host) Matches(hostname string) bool {
+	if h == nil {
+		return false
+	}
+	name := CanonicalHostname(hostname)
+	if name == "" {
+		return false
+	}
+
+	matched := false
+	for _, addr := range h.Addresses {
+		if strings.HasPrefix(addr, "|") {
+			if matchHashed(addr, name) {
+				matched = true
+			}
+			continue
+		}
+
+		negated := strings.HasPrefix(addr, "!")
+		pattern := strings.ToLower(strings.TrimPrefix(addr, "!"))
+		if !wildcardMatch(pattern, name) {
+			continue
+		}
+		if negated {
+			return false
+		}
+		matched = true
+	}
+	return matched
+}
+
+// HasAddress reports whether address is one of the entry's addresses,
+// compared literally after canonicalization, or matches its hashed field.
+// Unlike Matches it does not expand wildcard patterns.
+func (h *Host) HasAddress(address string) bool {
+	if h == nil {
+		return false
+	}
+	name := CanonicalHostname(address)
+	if name == "" {
+		return false
+	}
+	for _, addr := range h.Addresses {
+		if sameAddress(addr, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddress compares one address field of an entry with a canonical name.
+func sameAddress(addr, name string) bool {
+	if strings.HasPrefix(addr, "|") {
+		return matchHashed(addr, name)
+	}
+	return CanonicalHostname(addr) == name
+}
+
+// CanonicalHostname lowercases the host name and strips the default port,
+// so "[Example.COM]:22" becomes "example.com" and "[a]:2222" stays bracketed.
+func CanonicalHostname(hostname string) string {
+	name := strings.ToLower(strings.TrimSpace(hostname))
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]:22") {
+		name = strings.TrimSuffix(strings.TrimPrefix(name, "["), "]:22")
+	}
+	return name
+}
+
+// Lookup returns every entry matching hostname, ordered by line number.
+func (hc *HostCollection) Lookup(hostname string) []*Host {
+	out := make([]*Host, 0)
+	for _, h := range hc.UniqueHosts() {
+		if h.Matches(hostname) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// matchHashed checks a "|1|salt|hash" field against a host name.
+func matchHashed(field, name string) bool {
+	parts := strings.Split(field, "|")
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), want)
+}
+
+// GlobMatch reports whether s matches the ssh style pattern, where '*'
+// matches any sequence of characters and '?' exactly one.
+func GlobMatch(pattern, s string) bool {
+	return wildcardMatch(pattern, s)
+}
+
+// wildcardMatch implements the ssh pattern syntax where '*' matches any
+// sequence of characters and '?' matches exactly one.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+		default:
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return s == ""
+}
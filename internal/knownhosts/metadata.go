@@ -0,0 +1,316 @@
+package knownhosts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metadata is operational data about an entry that has no room in the
+// known_hosts line. It is kept in a JSON sidecar next to the file (see
+// MetadataPath), keyed by the entry's host field, type and key.
+type Metadata struct {
+	Tags  []string `json:"tags,omitempty"`
+	Note  string   `json:"note,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+	// Source records where the key came from, e.g. "cli" or
+	// "pubkey:/etc/ssh/ssh_host_ed25519_key.pub".
+	Source         string     `json:"source,omitempty"`
+	AddedAt        *time.Time `json:"added_at,omitempty"`
+	LastVerifiedAt *time.Time `json:"last_verified_at,omitempty"`
+	// Replaces is the fingerprint of the key this one replaced in a
+	// rotation (khm rotate).
+	Replaces string `json:"replaces,omitempty"`
+	// ExpiresAt marks a temporary entry, removed by khm gc once passed.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Stash is set while the entry sits in a stash.
+	Stash *StashRecord `json:"stash,omitempty"`
+}
+
+// Empty reports whether m carries no data.
+func (m *Metadata) Empty() bool {
+	return m == nil || (len(m.Tags) == 0 && m.Note == "" && m.Owner == "" && m.Source == "" &&
+		m.AddedAt == nil && m.LastVerifiedAt == nil && m.Replaces == "" && m.ExpiresAt == nil && m.Stash == nil)
+}
+
+// Clone returns a deep copy of m.
+func (m *Metadata) Clone() *Metadata {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	c.Tags = append([]string(nil), m.Tags...)
+	if m.Stash != nil {
+		st := *m.Stash
+		c.Stash = &st
+	}
+	return &c
+}
+
+// HasTag reports whether m carries tag.
+func (m *Metadata) HasTag(tag string) bool {
+	return m != nil && containsString(m.Tags, tag)
+}
+
+// AddTags adds tags that are not present yet and keeps the list sorted.
+func (m *Metadata) AddTags(tags ...string) {
+	for _, t := range tags {
+		if t != "" && !containsString(m.Tags, t) {
+			m.Tags = append(m.Tags, t)
+		}
+	}
+	sort.Strings(m.Tags)
+}
+
+// RemoveTags removes tags.
+func (m *Metadata) RemoveTags(tags ...string) {
+	kept := m.Tags[:0]
+	for _, t := range m.Tags {
+		if !containsString(tags, t) {
+			kept = append(kept, t)
+		}
+	}
+	m.Tags = kept
+}
+
+// merge fills the fields of m that are unset from o and adds o's tags, for
+// entries that are merged into one line.
+func (m *Metadata) merge(o *Metadata) {
+	m.AddTags(o.Tags...)
+	if m.Note == "" {
+		m.Note = o.Note
+	}
+	if m.Owner == "" {
+		m.Owner = o.Owner
+	}
+	if m.Source == "" {
+		m.Source = o.Source
+	}
+	if m.Replaces == "" {
+		m.Replaces = o.Replaces
+	}
+	if m.AddedAt == nil || (o.AddedAt != nil && o.AddedAt.Before(*m.AddedAt)) {
+		m.AddedAt = o.AddedAt
+	}
+	if m.LastVerifiedAt == nil || (o.LastVerifiedAt != nil && o.LastVerifiedAt.After(*m.LastVerifiedAt)) {
+		m.LastVerifiedAt = o.LastVerifiedAt
+	}
+	// A merged line lives as long as the longest lived of its parts.
+	if m.ExpiresAt != nil && (o.ExpiresAt == nil || o.ExpiresAt.After(*m.ExpiresAt)) {
+		m.ExpiresAt = o.ExpiresAt
+	}
+}
+
+// Lines formats the fields of m that are set as "Label: value" lines, or a
+// single "(no metadata)" line.
+func (m *Metadata) Lines() []string {
+	if m.Empty() {
+		return []string{"(no metadata)"}
+	}
+	lines := make([]string, 0, 6)
+	if len(m.Tags) > 0 {
+		lines = append(lines, "Tags: "+strings.Join(m.Tags, ", "))
+	}
+	if m.Owner != "" {
+		lines = append(lines, "Owner: "+m.Owner)
+	}
+	if m.Note != "" {
+		lines = append(lines, "Note: "+m.Note)
+	}
+	if m.Source != "" {
+		lines = append(lines, "Source: "+m.Source)
+	}
+	if m.AddedAt != nil {
+		lines = append(lines, "Added: "+m.AddedAt.Local().Format(time.RFC3339))
+	}
+	if m.LastVerifiedAt != nil {
+		lines = append(lines, "Verified: "+m.LastVerifiedAt.Local().Format(time.RFC3339))
+	}
+	if m.Replaces != "" {
+		lines = append(lines, "Replaces: "+m.Replaces)
+	}
+	if m.ExpiresAt != nil {
+		lines = append(lines, "Expires: "+m.ExpiresAt.Local().Format(time.RFC3339)+" ("+m.Remaining(time.Now())+")")
+	}
+	if m.Stash != nil {
+		lines = append(lines, "Stashed: "+m.Stash.Summary())
+	}
+	return lines
+}
+
+// Expired reports whether m carries an expiry that is not after now.
+func (m *Metadata) Expired(now time.Time) bool {
+	return m != nil && m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// Remaining describes the time left until ExpiresAt, e.g. "1h20m left" or
+// "expired", and is empty for entries without an expiry.
+func (m *Metadata) Remaining(now time.Time) string {
+	if m == nil || m.ExpiresAt == nil {
+		return ""
+	}
+	left := m.ExpiresAt.Sub(now)
+	switch {
+	case left <= 0:
+		return "expired"
+	case left >= 48*time.Hour:
+		return fmt.Sprintf("%dd left", int(left.Hours()/24))
+	case left >= time.Hour:
+		return strings.TrimSuffix(left.Truncate(time.Minute).String(), "0s") + " left"
+	default:
+		return left.Truncate(time.Second).String() + " left"
+	}
+}
+
+// LastSeen returns when the entry was last known to be in use: the later of
+// LastVerifiedAt and AddedAt, or nil when neither is recorded.
+func (m *Metadata) LastSeen() *time.Time {
+	if m == nil {
+		return nil
+	}
+	if m.LastVerifiedAt != nil && (m.AddedAt == nil || m.LastVerifiedAt.After(*m.AddedAt)) {
+		return m.LastVerifiedAt
+	}
+	return m.AddedAt
+}
+
+// EnsureMeta returns the metadata of h, creating it when missing.
+func (h *Host) EnsureMeta() *Metadata {
+	if h.Meta == nil {
+		h.Meta = &Metadata{}
+	}
+	return h.Meta
+}
+
+// MetadataPath returns the sidecar file holding the metadata of the
+// known_hosts file at path.
+func MetadataPath(path string) string {
+	return path + ".meta.json"
+}
+
+// metadataFile is the sidecar format.
+type metadataFile struct {
+	Entries []metadataRecord `json:"entries"`
+}
+
+type metadataRecord struct {
+	Host string `json:"host"`
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	Metadata
+}
+
+func (r metadataRecord) id() string {
+	return r.Host + " " + r.Type + " " + r.Key
+}
+
+func newMetadataRecord(h *Host) metadataRecord {
+	return metadataRecord{Host: h.HostField(), Type: h.Type, Key: h.Key, Metadata: *h.Meta}
+}
+
+// readMetadata reads the sidecar of path. A missing sidecar yields no
+// records and exists == false.
+func readMetadata(store Store, path string) (records []metadataRecord, exists bool, err error) {
+	data, err := store.ReadFile(MetadataPath(path))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if strings.TrimSpace(string(data)) == "" {
+		return nil, true, nil
+	}
+	var f metadataFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, true, fmt.Errorf("failed to parse %s: %w", MetadataPath(path), err)
+	}
+	return f.Entries, true, nil
+}
+
+func writeMetadata(store Store, path string, records []metadataRecord) error {
+	data, err := json.MarshalIndent(metadataFile{Entries: records}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.WriteFile(MetadataPath(path), append(data, '\n'), false); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
+
+// loadMetadata attaches the sidecar records to the parsed entries.
+func (hc *HostCollection) loadMetadata() error {
+	records, exists, err := readMetadata(hc.store(), hc.File)
+	if err != nil {
+		return err
+	}
+	hc.hasMetadata = exists
+
+	byID := make(map[string]*Metadata, len(records))
+	for i := range records {
+		byID[records[i].id()] = &records[i].Metadata
+	}
+	for _, h := range hc.Entries {
+		if m, ok := byID[stashKey(h)]; ok {
+			h.Meta = m.Clone()
+		}
+	}
+	return nil
+}
+
+// SaveMetadata writes only the metadata sidecar of the collection's file,
+// leaving the known_hosts file itself untouched. It is meant for edits that
+// change nothing but metadata, such as tags and notes.
+func (hc *HostCollection) SaveMetadata() error {
+	return hc.saveMetadata(hc.File)
+}
+
+// saveMetadata writes the sidecar for the entries saved to path. Nothing is
+// written when there is no metadata and no sidecar existed.
+func (hc *HostCollection) saveMetadata(path string) error {
+	records := make([]metadataRecord, 0)
+	for _, h := range hc.Entries {
+		if !h.Meta.Empty() {
+			records = append(records, newMetadataRecord(h))
+		}
+	}
+	if len(records) == 0 && !(hc.hasMetadata && path == hc.File) {
+		return nil
+	}
+	return writeMetadata(hc.store(), path, records)
+}
+
+// mergeMetadata adds the metadata of hosts to the sidecar of path, replacing
+// records of the same entries. It is used when entries are appended to a
+// file without rewriting it, as the stash does.
+func mergeMetadata(store Store, path string, hosts []*Host) error {
+	add := make([]metadataRecord, 0)
+	for _, h := range hosts {
+		if !h.Meta.Empty() {
+			add = append(add, newMetadataRecord(h))
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+
+	records, _, err := readMetadata(store, path)
+	if err != nil {
+		return err
+	}
+	replaced := make(map[string]bool, len(add))
+	for _, r := range add {
+		replaced[r.id()] = true
+	}
+	kept := make([]metadataRecord, 0, len(records)+len(add))
+	for _, r := range records {
+		if !replaced[r.id()] {
+			kept = append(kept, r)
+		}
+	}
+	return writeMetadata(store, path, append(kept, add...))
+}
@@ -2,14 +2,21 @@ package knownhosts
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"time"
 )
 
+// Host is a single known_hosts entry, i.e. one line of the file. A line may
+// list several addresses; it is still one entry.
 type Host struct {
+	// Marker is "cert-authority" or "revoked" for lines starting with
+	// @cert-authority or @revoked, empty otherwise.
+	Marker string
+
 	Addresses []string
 	Type      string
 
@@ -22,12 +29,42 @@ type Host struct {
 	IsHashed bool
 
 	HashValue string
+
+	// Source is the file the entry was read from.
+	Source string
+
+	// Meta is the sidecar metadata of the entry, nil when there is none.
+	Meta *Metadata
 }
 
 type HostCollection struct {
+	// Entries holds every line of the file in order and is the source of
+	// truth for saving.
+	Entries []*Host
+
+	// Hosts indexes Entries by each of their addresses. Use the collection
+	// methods to modify entries so the index stays in sync.
 	Hosts map[string][]*Host
 
 	File string
+
+	// Store is used for every file read and write made on behalf of the
+	// collection. Nil means DiskStore.
+	Store Store
+
+	// hasMetadata is set when File had a metadata sidecar when parsed, so
+	// that saving rewrites it even after its last record was removed.
+	hasMetadata bool
+
+	// comments keeps the comment, blank and unparseable lines of the file
+	// so that saving does not lose them: the lines above the first entry
+	// under nil, the others under the entry they precede. trailer holds
+	// the lines after the last entry.
+	comments map[*Host][]string
+	trailer  []string
+	// parsed lists the entries in file order, so the lines above a removed
+	// entry can move to the next one still present.
+	parsed []*Host
 }
 
 func NewHostCollection(filePath string) *HostCollection {
@@ -42,45 +79,108 @@ func NewHostCollection(filePath string) *HostCollection {
 }
 
 func ParseKnownHosts(filePath string) (*HostCollection, error) {
+	return ParseKnownHostsFrom(nil, filePath)
+}
+
+// ParseKnownHostsFrom parses a known_hosts file read through store. The
+// returned collection writes back through the same store. A nil store reads
+// from disk.
+func ParseKnownHostsFrom(store Store, filePath string) (*HostCollection, error) {
 	if filePath == "" {
 		filePath = getDefaultKnownHostsPath()
 	}
+	if store == nil {
+		store = DiskStore{}
+	}
 
-	file, err := os.Open(filePath)
+	data, err := store.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open known_hosts file: %w", err)
 	}
-	defer file.Close()
 
 	collection := NewHostCollection(filePath)
-	scanner := bufio.NewScanner(file)
+	collection.Store = store
+	if err := collection.parse(data); err != nil {
+		return nil, fmt.Errorf("error reading known_hosts file: %w", err)
+	}
+	if err := collection.loadMetadata(); err != nil {
+		return nil, err
+	}
+
+	return collection, nil
+}
+
+func (hc *HostCollection) parse(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
 	lineNumber := 0
+	hc.comments = make(map[*Host][]string)
+	var pending []string
+	var previous *Host
 
 	for scanner.Scan() {
 		lineNumber++
 		line := strings.TrimSpace(scanner.Text())
 
-		if line == "" || strings.HasPrefix(line, "#") {
+		var host *Host
+		if line != "" && !strings.HasPrefix(line, "#") {
+			host = parseHostLine(line, lineNumber)
+		}
+		if host == nil {
+			pending = append(pending, line)
 			continue
 		}
 
-		host := parseHostLine(line, lineNumber)
-		if host != nil {
-			collection.AddHost(host)
+		host.Source = hc.File
+		hc.AddHost(host)
+		hc.parsed = append(hc.parsed, host)
+		if len(pending) > 0 {
+			// The lines above the first entry stay at the top of the file.
+			if previous == nil {
+				hc.comments[nil] = pending
+			} else {
+				hc.comments[host] = pending
+			}
+			pending = nil
 		}
+		previous = host
+	}
+	if previous == nil {
+		hc.comments[nil] = pending
+	} else {
+		hc.trailer = pending
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading known_hosts file: %w", err)
+	return scanner.Err()
+}
+
+// moveComments hands the lines kept above from to to, for an entry that
+// replaces from at its place.
+func (hc *HostCollection) moveComments(from, to *Host) {
+	lines, ok := hc.comments[from]
+	if !ok {
+		return
 	}
+	delete(hc.comments, from)
+	hc.comments[to] = append(lines, hc.comments[to]...)
+}
 
-	return collection, nil
+func (hc *HostCollection) store() Store {
+	if hc.Store == nil {
+		return DiskStore{}
+	}
+	return hc.Store
 }
 
 func parseHostLine(line string, lineNumber int) *Host {
 
 	parts := strings.Fields(line)
 
+	marker := ""
+	if len(parts) > 0 && strings.HasPrefix(parts[0], "@") {
+		marker = strings.TrimPrefix(parts[0], "@")
+		parts = parts[1:]
+	}
+
 	if len(parts) < 3 {
 
 		return nil
@@ -93,6 +193,7 @@ func parseHostLine(line string, lineNumber int) *Host {
 	}
 
 	host := &Host{
+		Marker: marker,
 
 		Addresses:  make([]string, 0, len(rawHosts)),
 		LineNumber: lineNumber,
@@ -143,6 +244,11 @@ func (hc *HostCollection) AddHost(host *Host) {
 		return
 	}
 
+	hc.Entries = append(hc.Entries, host)
+	hc.index(host)
+}
+
+func (hc *HostCollection) index(host *Host) {
 	for _, addr := range host.Addresses {
 		if _, exists := hc.Hosts[addr]; !exists {
 			hc.Hosts[addr] = []*Host{}
@@ -151,6 +257,19 @@ func (hc *HostCollection) AddHost(host *Host) {
 	}
 }
 
+// reindex rebuilds the address index from Entries.
+func (hc *HostCollection) reindex() {
+	hc.Hosts = make(map[string][]*Host)
+	for _, h := range hc.Entries {
+		hc.index(h)
+	}
+}
+
+// UniqueHosts returns every entry once, in file order.
+func (hc *HostCollection) UniqueHosts() []*Host {
+	return append([]*Host(nil), hc.Entries...)
+}
+
 func (hc *HostCollection) GetHostsByAddress(address string) []*Host {
 
 	return hc.Hosts[address]
@@ -165,6 +284,7 @@ func (hc *HostCollection) GetAllAddresses() []string {
 	return addresses
 }
 
+// RemoveHost removes the whole entry found at index under address.
 func (hc *HostCollection) RemoveHost(address string, index int) error {
 
 	hosts, exists := hc.Hosts[address]
@@ -175,13 +295,7 @@ func (hc *HostCollection) RemoveHost(address string, index int) error {
 
 	}
 
-	hc.Hosts[address] = append(hosts[:index], hosts[index+1:]...)
-
-	if len(hc.Hosts[address]) == 0 {
-
-		delete(hc.Hosts, address)
-
-	}
+	hc.RemoveEntries([]*Host{hosts[index]})
 
 	return nil
 
@@ -197,43 +311,55 @@ func (hc *HostCollection) MoveHostToFile(address string, index int, targetFile s
 
 	}
 
-	host := hosts[index]
-
-	if _, err := os.Stat(targetFile); os.IsNotExist(err) {
-
-		file, err := os.Create(targetFile)
-
-		if err != nil {
-
-			return fmt.Errorf("failed to create target file: %w", err)
-
-		}
-
-		file.Close()
-
+	if err := hc.appendToFile(targetFile, hosts[index:index+1]); err != nil {
+		return err
 	}
 
-	file, err := os.OpenFile(targetFile, os.O_APPEND|os.O_WRONLY, 0644)
-
-	if err != nil {
+	return hc.RemoveHost(address, index)
 
-		return fmt.Errorf("failed to open target file: %w", err)
+}
 
+// appendToFile appends the entries as known_hosts lines to path through the
+// collection's store, creating the file when it does not exist, and adds
+// their metadata to its sidecar.
+func (hc *HostCollection) appendToFile(path string, hosts []*Host) error {
+	store := hc.store()
+	data, err := store.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read target file: %w", err)
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		data = append(data, '\n')
 	}
 
-	defer file.Close()
-
-	line := formatKnownHostsLine(host)
-	line += "\n"
-
-	if _, err := file.WriteString(line); err != nil {
+	seen := make(map[*Host]bool)
+	for _, host := range hosts {
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		data = append(data, formatKnownHostsLine(host)+"\n"...)
+	}
 
+	if err := store.WriteFile(path, data, false); err != nil {
 		return fmt.Errorf("failed to write to target file: %w", err)
-
 	}
+	return mergeMetadata(store, path, hosts)
+}
 
-	return hc.RemoveHost(address, index)
+// setAddresses replaces the host field and refreshes the hashed flags.
+func (h *Host) setAddresses(addrs []string) {
+	h.Addresses = addrs
+	h.IsHashed = len(addrs) > 0 && strings.HasPrefix(addrs[0], "|")
+	h.HashValue = ""
+	if h.IsHashed {
+		h.HashValue = addrs[0]
+	}
+}
 
+// String returns the entry formatted as a known_hosts line.
+func (h *Host) String() string {
+	return formatKnownHostsLine(h)
 }
 
 func formatKnownHostsLine(host *Host) string {
@@ -247,6 +373,9 @@ func formatKnownHostsLine(host *Host) string {
 	}
 
 	line := fmt.Sprintf("%s %s %s", addressField, host.Type, host.Key)
+	if host.Marker != "" {
+		line = "@" + host.Marker + " " + line
+	}
 	if host.Comment != "" {
 		line += " " + host.Comment
 	}
@@ -257,67 +386,104 @@ func (hc *HostCollection) Save() error {
 	return hc.SaveToFile(hc.File)
 }
 
+// RemoveAllHosts removes every entry listing address, including the other
+// addresses on those lines. Use RemoveAlias to drop only the address.
 func (hc *HostCollection) RemoveAllHosts(address string) error {
-	if _, exists := hc.Hosts[address]; !exists {
+	hosts, exists := hc.Hosts[address]
+	if !exists || len(hosts) == 0 {
 		return fmt.Errorf("host not found")
 	}
-	delete(hc.Hosts, address)
+	hc.RemoveEntries(hosts)
 	return nil
 }
 
-func (hc *HostCollection) MoveAllHostsToFile(address string, targetFile string) error {
-
-	hosts, exists := hc.Hosts[address]
-
-	if !exists || len(hosts) == 0 {
-
-		return fmt.Errorf("host not found")
-
+// RemoveEntries removes the given entries and returns the number of entries
+// removed.
+func (hc *HostCollection) RemoveEntries(hosts []*Host) int {
+	drop := make(map[*Host]bool, len(hosts))
+	for _, h := range hosts {
+		if h != nil {
+			drop[h] = true
+		}
 	}
 
-	if _, err := os.Stat(targetFile); os.IsNotExist(err) {
-
-		file, err := os.Create(targetFile)
-
-		if err != nil {
-
-			return fmt.Errorf("failed to create target file: %w", err)
-
+	kept := make([]*Host, 0, len(hc.Entries))
+	removed := 0
+	for _, h := range hc.Entries {
+		if drop[h] {
+			removed++
+			continue
 		}
-
-		file.Close()
-
+		kept = append(kept, h)
 	}
+	hc.Entries = kept
+	hc.reindex()
 
-	file, err := os.OpenFile(targetFile, os.O_APPEND|os.O_WRONLY, 0644)
-
-	if err != nil {
-
-		return fmt.Errorf("failed to open target file: %w", err)
+	return removed
+}
 
+// RemoveAlias rewrites every entry listing address without it. Entries that
+// have no other address left are removed. Addresses are compared as in
+// HasAddress, so hashed entries for address are removed as well. It returns
+// the number of entries rewritten and removed.
+func (hc *HostCollection) RemoveAlias(address string) (rewritten, removed int, err error) {
+	hosts := make([]*Host, 0)
+	for _, h := range hc.Entries {
+		if h.HasAddress(address) {
+			hosts = append(hosts, h)
+		}
 	}
+	if len(hosts) == 0 {
+		return 0, 0, fmt.Errorf("host not found")
+	}
+	rewritten, removed = hc.RemoveAliasFrom(hosts, address)
+	return rewritten, removed, nil
+}
 
-	defer file.Close()
-
-	seen := make(map[*Host]bool)
-	for _, host := range hosts {
-
-		if seen[host] {
+// RemoveAliasFrom drops address from the given entries only, removing the
+// entries that have no other address left.
+func (hc *HostCollection) RemoveAliasFrom(hosts []*Host, address string) (rewritten, removed int) {
+	name := CanonicalHostname(address)
+	drop := make([]*Host, 0)
+	for _, h := range hosts {
+		if h == nil {
 			continue
 		}
-		seen[host] = true
+		kept := make([]string, 0, len(h.Addresses))
+		for _, a := range h.Addresses {
+			if !sameAddress(a, name) {
+				kept = append(kept, a)
+			}
+		}
+		switch {
+		case len(kept) == len(h.Addresses):
+			continue
+		case len(kept) == 0:
+			drop = append(drop, h)
+		default:
+			h.setAddresses(kept)
+			rewritten++
+		}
+	}
+	removed = hc.RemoveEntries(drop)
+	return rewritten, removed
+}
 
-		line := formatKnownHostsLine(host)
-		line += "\n"
-		if _, err := file.WriteString(line); err != nil {
+func (hc *HostCollection) MoveAllHostsToFile(address string, targetFile string) error {
 
-			return fmt.Errorf("failed to write to target file: %w", err)
+	hosts, exists := hc.Hosts[address]
 
-		}
+	if !exists || len(hosts) == 0 {
+
+		return fmt.Errorf("host not found")
 
 	}
 
-	delete(hc.Hosts, address)
+	if err := hc.appendToFile(targetFile, hosts); err != nil {
+		return err
+	}
+
+	hc.RemoveEntries(hosts)
 
 	return nil
 
@@ -336,43 +502,79 @@ func (hc *HostCollection) StashAddress(address string) error {
 }
 
 func (hc *HostCollection) StashAddressWithPath(address, stashPath string) error {
-	hosts, exists := hc.Hosts[address]
-	if !exists || len(hosts) == 0 {
-		return fmt.Errorf("host not found")
+	_, err := hc.StashAddressKeys(address, stashPath, nil)
+	return err
+}
+
+// StashAddressKeys stashes only the keys of address matching q, e.g. the old
+// RSA key during a rotation while the ed25519 key stays. A nil q stashes
+// every key. It returns the number of entries stashed.
+func (hc *HostCollection) StashAddressKeys(address, stashPath string, q *Query) (int, error) {
+	hosts := make([]*Host, 0)
+	for _, h := range hc.Hosts[address] {
+		if q.Match(h) {
+			hosts = append(hosts, h)
+		}
+	}
+	if len(hosts) == 0 {
+		return 0, fmt.Errorf("host not found")
+	}
+	return hc.StashHostsWithPath(hosts, stashPath)
+}
+
+// StashHostsWithPath appends the given entries to the stash file, skipping
+// keys that are already stashed, removes them from the collection and saves
+// known_hosts once. It returns the number of entries removed.
+func (hc *HostCollection) StashHostsWithPath(hosts []*Host, stashPath string) (int, error) {
+	return hc.StashHostsWithOptions(hosts, stashPath, StashOptions{})
+}
+
+// StashHostsWithOptions is StashHostsWithPath recording opts, the current
+// user, the time and the file the entries came from in their metadata.
+func (hc *HostCollection) StashHostsWithOptions(hosts []*Host, stashPath string, opts StashOptions) (int, error) {
+	if len(hosts) == 0 {
+		return 0, fmt.Errorf("host not found")
 	}
 
 	if stashPath == "" {
-		return fmt.Errorf("stash path not available")
+		return 0, fmt.Errorf("stash path not available")
 	}
 
-	if _, err := os.Stat(stashPath); os.IsNotExist(err) {
-		f, err := os.Create(stashPath)
+	now := time.Now().UTC()
+	for _, h := range hosts {
+		if h == nil {
+			continue
+		}
+		record, err := opts.record(hc.File, now)
 		if err != nil {
-			return fmt.Errorf("failed to create stash file: %w", err)
+			return 0, err
 		}
-		f.Close()
+		h.EnsureMeta().Stash = record
 	}
 
-	stash, err := ParseKnownHosts(stashPath)
-	if err != nil {
-		return fmt.Errorf("failed to parse stash_hosts: %w", err)
+	store := hc.store()
+	content, err := store.ReadFile(stashPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read stash file: %w", err)
+	}
+
+	stash := NewHostCollection(stashPath)
+	if err := stash.parse(content); err != nil {
+		return 0, fmt.Errorf("failed to parse stash_hosts: %w", err)
 	}
 
 	existing := make(map[string]struct{})
-	for _, addrs := range stash.Hosts {
-		for _, h := range addrs {
-			key := stashKey(h)
-			if key != "" {
-				existing[key] = struct{}{}
-			}
+	for _, h := range stash.Entries {
+		key := stashKey(h)
+		if key != "" {
+			existing[key] = struct{}{}
 		}
 	}
 
-	f, err := os.OpenFile(stashPath, os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open stash file: %w", err)
+	buf := bytes.NewBuffer(content)
+	if buf.Len() > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		buf.WriteString("\n")
 	}
-	defer f.Close()
 
 	seenHost := make(map[*Host]bool)
 	for _, h := range hosts {
@@ -394,59 +596,142 @@ func (hc *HostCollection) StashAddressWithPath(address, stashPath string) error
 		if line == "" {
 			continue
 		}
-		if _, err := f.WriteString(line + "\n"); err != nil {
-			return fmt.Errorf("failed to write to stash file: %w", err)
-		}
+		buf.WriteString(line + "\n")
+	}
+
+	if err := store.WriteFile(stashPath, buf.Bytes(), false); err != nil {
+		return 0, fmt.Errorf("failed to write to stash file: %w", err)
+	}
+	if err := mergeMetadata(store, stashPath, hosts); err != nil {
+		return 0, fmt.Errorf("failed to stash metadata: %w", err)
 	}
 
-	delete(hc.Hosts, address)
+	removed := hc.RemoveEntries(hosts)
 
 	if err := hc.SaveToFile(hc.File); err != nil {
-		return fmt.Errorf("failed to save known_hosts after stash: %w", err)
+		return 0, fmt.Errorf("failed to save known_hosts after stash: %w", err)
 	}
 
-	return nil
+	return removed, nil
 }
 
 func (hc *HostCollection) UnstashAddress(address string) error {
-	stashPath := hc.StashFilePath()
+	_, err := hc.UnstashAddressKeys(address, nil)
+	return err
+}
+
+// UnstashAddressKeys restores only the stashed keys of address matching q
+// from the default stash. A nil q restores every key. Keys conflicting with
+// known_hosts fail with a *RestoreConflictError. It returns the number of
+// entries added to known_hosts.
+func (hc *HostCollection) UnstashAddressKeys(address string, q *Query) (int, error) {
+	return hc.unstashFrom(hc.StashFilePath(), func(stashCol *HostCollection) []*Host {
+		out := make([]*Host, 0)
+		for _, h := range stashCol.Hosts[address] {
+			if q.Match(h) {
+				out = append(out, h)
+			}
+		}
+		return out
+	}, true, "")
+}
+
+// UnstashEntries restores the given stashed entries, matched by their line
+// content, from the stash file back into known_hosts. resolve handles
+// entries conflicting with known_hosts as described for ApplyStash.
+func (hc *HostCollection) UnstashEntries(entries []*Host, resolve string) error {
+	wanted := make(map[string]bool, len(entries))
+	for _, h := range entries {
+		if k := stashKey(h); k != "" {
+			wanted[k] = true
+		}
+	}
+	_, err := hc.unstashFrom(hc.StashFilePath(), func(stashCol *HostCollection) []*Host {
+		out := make([]*Host, 0)
+		for _, h := range stashCol.Entries {
+			if wanted[stashKey(h)] {
+				out = append(out, h)
+			}
+		}
+		return out
+	}, true, resolve)
+	return err
+}
+
+// unstashFrom copies the entries of the stash file chosen by pick into
+// known_hosts, skipping keys that are already present, and saves known_hosts.
+// With drop set the chosen entries are removed from the stash as well.
+// resolve decides what happens to entries whose host now has a different key
+// of the same type (see KeepCurrent, SwapStashed and KeepBoth); when it is
+// empty such conflicts fail with a *RestoreConflictError before anything is
+// written. It returns the number of entries added.
+func (hc *HostCollection) unstashFrom(stashPath string, pick func(stashCol *HostCollection) []*Host, drop bool, resolve string) (int, error) {
+	return hc.unstashInto(hc.File, stashPath, pick, drop, resolve)
+}
+
+// unstashInto is unstashFrom restoring into the known_hosts file dest.
+func (hc *HostCollection) unstashInto(dest, stashPath string, pick func(stashCol *HostCollection) []*Host, drop bool, resolve string) (int, error) {
 	if stashPath == "" {
-		return fmt.Errorf("stash path not available")
+		return 0, fmt.Errorf("stash path not available")
+	}
+	switch resolve {
+	case "", KeepCurrent, SwapStashed, KeepBoth:
+	default:
+		return 0, fmt.Errorf("unknown conflict resolution %q: expected %s", resolve, strings.Join(Resolutions, ", "))
 	}
 
-	if _, err := os.Stat(stashPath); os.IsNotExist(err) {
-		return fmt.Errorf("stash file not found")
+	store := hc.store()
+	if _, err := store.ReadFile(stashPath); os.IsNotExist(err) {
+		return 0, fmt.Errorf("stash file not found")
 	}
 
-	mainCol, err := ParseKnownHosts(hc.File)
+	mainCol, err := ParseKnownHostsFrom(store, dest)
 	if err != nil {
-		return fmt.Errorf("failed to parse known_hosts: %w", err)
+		return 0, fmt.Errorf("failed to parse known_hosts: %w", err)
 	}
 
-	stashCol, err := ParseKnownHosts(stashPath)
+	stashCol, err := ParseKnownHostsFrom(store, stashPath)
 	if err != nil {
-		return fmt.Errorf("failed to parse stash_hosts: %w", err)
+		return 0, fmt.Errorf("failed to parse stash_hosts: %w", err)
 	}
 
-	existing := make(map[string]struct{})
-	if currentHosts, ok := mainCol.Hosts[address]; ok {
-		for _, h := range currentHosts {
-			k := stashKey(h)
-			if k != "" {
-				existing[k] = struct{}{}
-			}
+	stashHosts := pick(stashCol)
+	if len(stashHosts) == 0 {
+		return 0, fmt.Errorf("no stashed entries for address")
+	}
+
+	conflicts := restoreConflicts(mainCol, stashHosts)
+	if len(conflicts) > 0 && resolve == "" {
+		return 0, &RestoreConflictError{Conflicts: conflicts}
+	}
+
+	// The entries that stay stashed because the current key wins.
+	kept := make(map[*Host]bool)
+	if resolve == KeepCurrent {
+		for _, c := range conflicts {
+			kept[c.Stashed] = true
 		}
 	}
+	var displaced []*Host
+	if resolve == SwapStashed {
+		displaced = displace(mainCol, conflicts)
+	}
 
-	stashHosts, ok := stashCol.Hosts[address]
-	if !ok || len(stashHosts) == 0 {
-		return fmt.Errorf("no stashed entries for address")
+	existing := make(map[string]struct{})
+	for _, h := range mainCol.Entries {
+		k := stashKey(h)
+		if k != "" {
+			existing[k] = struct{}{}
+		}
 	}
 
+	added := 0
+	taken := make([]*Host, 0, len(stashHosts))
 	for _, h := range stashHosts {
-		if h == nil {
+		if h == nil || kept[h] {
 			continue
 		}
+		taken = append(taken, h)
 		k := stashKey(h)
 		if k != "" {
 			if _, dup := existing[k]; dup {
@@ -455,19 +740,52 @@ func (hc *HostCollection) UnstashAddress(address string) error {
 			}
 			existing[k] = struct{}{}
 		}
-		mainCol.AddHost(h)
+		restored := *h
+		restored.Meta = h.Meta.Clone()
+		if restored.Meta != nil {
+			restored.Meta.Stash = nil
+		}
+		restored.Source = mainCol.File
+		mainCol.AddHost(&restored)
+		added++
 	}
 
-	delete(stashCol.Hosts, address)
+	// Nothing added or displaced: known_hosts is left untouched.
+	if added > 0 || len(displaced) > 0 {
+		if err := mainCol.SaveToFile(mainCol.File); err != nil {
+			return 0, fmt.Errorf("failed to save known_hosts after unstash: %w", err)
+		}
+	}
+	if (!drop || len(taken) == 0) && len(displaced) == 0 {
+		return added, nil
+	}
 
-	if err := mainCol.SaveToFile(mainCol.File); err != nil {
-		return fmt.Errorf("failed to save known_hosts after unstash: %w", err)
+	if drop {
+		stashCol.RemoveEntries(taken)
 	}
-	if err := stashCol.SaveToFile(stashCol.File); err != nil {
-		return fmt.Errorf("failed to save stash_hosts after unstash: %w", err)
+	if len(displaced) > 0 {
+		// The replaced keys take the place of the restored ones.
+		inStash := make(map[string]bool, len(stashCol.Entries))
+		for _, h := range stashCol.Entries {
+			inStash[stashKey(h)] = true
+		}
+		record, _ := StashOptions{Reason: "replaced by a restored key"}.record(mainCol.File, time.Now().UTC())
+		for _, h := range displaced {
+			if inStash[stashKey(h)] {
+				continue
+			}
+			inStash[stashKey(h)] = true
+			h.EnsureMeta().Stash = record
+			h.Source = stashCol.File
+			stashCol.AddHost(h)
+		}
+	}
+	// Named stashes disappear once everything was popped.
+	if err := hc.saveStash(stashCol); err != nil {
+		return 0, err
 	}
 
-	return nil
+	return added, nil
 }
 
 func stashKey(h *Host) string {
@@ -481,83 +799,69 @@ func stashKey(h *Host) string {
 	if addrField == "" || h.Type == "" || h.Key == "" {
 		return ""
 	}
+	if h.Marker != "" {
+		addrField = "@" + h.Marker + " " + addrField
+	}
 	return addrField + " " + h.Type + " " + h.Key
 }
 
+// SaveToFile writes the collection to filePath, followed by its metadata
+// sidecar when there is metadata to keep.
 func (hc *HostCollection) SaveToFile(filePath string) error {
-
-	// Create backup first, but only fail if the source file exists and backup truly fails.
-
-	backupPath := filePath + ".backup"
-
-	if err := CopyFile(filePath, backupPath); err != nil && !os.IsNotExist(err) {
-
-		return fmt.Errorf("failed to create backup: %w", err)
-
+	// The store creates a backup first, but only fails if the source file
+	// exists and the backup truly fails.
+	if err := hc.store().WriteFile(filePath, hc.Render(), true); err != nil {
+		return err
 	}
+	return hc.saveMetadata(filePath)
+}
 
-	file, err := os.Create(filePath)
-
-	if err != nil {
-
-		return fmt.Errorf("failed to create file: %w", err)
-
+// Render returns the collection formatted as a known_hosts file, exactly as
+// SaveToFile would write it.
+// Comment lines stay in place: above the entry they preceded when parsed,
+// or above the next remaining entry when that one is gone. Runs of blank
+// lines are collapsed and blank lines at either end dropped.
+func (hc *HostCollection) Render() []byte {
+	present := make(map[*Host]bool, len(hc.Entries))
+	for _, h := range hc.Entries {
+		present[h] = true
+	}
+	carried := make(map[*Host][]string)
+	var carry []string
+	for _, h := range hc.parsed {
+		if !present[h] {
+			carry = append(carry, hc.comments[h]...)
+			continue
+		}
+		if len(carry) > 0 {
+			carried[h] = carry
+			carry = nil
+		}
 	}
 
-	defer file.Close()
-
-	writer := bufio.NewWriter(file)
-
-	// Write header
-
-	header := "# SSH Known Hosts File\n"
-
-	header += "# Managed by ssh-knownhosts-manager\n"
-
-	if _, err := writer.WriteString(header + "\n"); err != nil {
-
-		return fmt.Errorf("failed to write header: %w", err)
-
+	lines := append([]string(nil), hc.comments[nil]...)
+	// Entries are written once each, in file order, with their original addresses.
+	for _, host := range hc.Entries {
+		lines = append(lines, carried[host]...)
+		lines = append(lines, hc.comments[host]...)
+		lines = append(lines, formatKnownHostsLine(host))
 	}
+	lines = append(lines, carry...)
+	lines = append(lines, hc.trailer...)
 
-	// To avoid duplicating multi-address hosts, track which *Host entries have been written.
-	written := make(map[*Host]bool)
-
-	// Collect and sort one representative address per host entry for deterministic output.
-
-	// We iterate over all addresses, but only write each unique Host once using its original addresses.
-	addresses := make([]string, 0, len(hc.Hosts))
-
-	for addr := range hc.Hosts {
-
-		addresses = append(addresses, addr)
-
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
 	}
-
-	sort.Strings(addresses)
-
-	for _, addr := range addresses {
-
-		for _, host := range hc.Hosts[addr] {
-
-			if written[host] {
-				continue
-			}
-			written[host] = true
-
-			line := formatKnownHostsLine(host)
-			if _, err := writer.WriteString(line + "\n"); err != nil {
-
-				return fmt.Errorf("failed to write host: %w", err)
-
-			}
-
+	var buf bytes.Buffer
+	blank := true
+	for _, line := range lines {
+		if line == "" && blank {
+			continue
 		}
-
+		blank = line == ""
+		buf.WriteString(line + "\n")
 	}
-
-	return writer.Flush()
-
+	return buf.Bytes()
 }
 
 func getDefaultKnownHostsPath() string {
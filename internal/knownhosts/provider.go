@@ -0,0 +1,33 @@
+package knownhosts
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// TrustedFor returns the entries that apply to hostname as ssh would match
+// them (hashed names, ports, wildcards and markers included), leaving out
+// temporary entries whose expiry is not after now.
+func (hc *HostCollection) TrustedFor(hostname string, now time.Time) []*Host {
+	out := make([]*Host, 0)
+	for _, h := range hc.Lookup(hostname) {
+		if !h.Meta.Expired(now) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// IsStash reports whether path is the default stash or one of the named
+// stashes of the collection's file.
+func (hc *HostCollection) IsStash(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil || hc.File == "" {
+		return false
+	}
+	if stash, err := filepath.Abs(hc.StashFilePath()); err == nil && abs == stash {
+		return true
+	}
+	dir, err := filepath.Abs(hc.StashDir())
+	return err == nil && filepath.Dir(abs) == dir
+}
@@ -0,0 +1,542 @@
+package knownhosts
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Query selects entries using a small filter language shared by the CLI and
+// the TUI filter. A query is a list of terms that must all match; terms can
+// be combined with OR, negated with NOT or a leading '-', and grouped with
+// parentheses:
+//
+//	type:ed25519 cidr:10.1.0.0/16
+//	(glob:*.staging.example OR glob:*.dev.example) -is:hashed
+//
+// Supported terms:
+//
+//	host:NAME      entry applies to NAME as ssh would match it (hashes, wildcards)
+//	addr:NAME      entry lists NAME literally, or hashes to NAME
+//	glob:PATTERN   an address matches the wildcard pattern (* and ?)
+//	re:REGEXP      an address matches the regular expression
+//	type:TYPE      key type contains TYPE, e.g. type:rsa or type:ssh-ed25519
+//	cidr:NET       a literal IP address lies within NET
+//	is:hashed      host field is hashed
+//	is:plain       host field is not hashed
+//	marker:NAME    entry has @NAME (cert-authority, revoked) or "none"
+//	source:FILE    entry was read from FILE (full path, base name or pattern)
+//	comment:TEXT   comment contains TEXT
+//	fp:PREFIX      SHA256 fingerprint starts with PREFIX
+//	line:N         entry is on line N of its file
+//	tag:NAME       entry metadata carries the tag NAME
+//	owner:NAME     entry metadata owner is NAME
+//	TEXT           any of address, type, comment or hash contains TEXT
+//
+// Values may be double quoted to include spaces. Text matching is case
+// insensitive. A nil or empty Query matches every entry.
+type Query struct {
+	root queryNode
+}
+
+type queryNode interface {
+	match(h *Host) bool
+}
+
+type andNode []queryNode
+
+func (n andNode) match(h *Host) bool {
+	for _, c := range n {
+		if !c.match(h) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode []queryNode
+
+func (n orNode) match(h *Host) bool {
+	for _, c := range n {
+		if c.match(h) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	node queryNode
+}
+
+func (n notNode) match(h *Host) bool {
+	return !n.node.match(h)
+}
+
+type termNode struct {
+	field string
+	value string
+	re    *regexp.Regexp
+	cidr  *net.IPNet
+	line  int
+}
+
+// Match reports whether the entry satisfies the query.
+func (q *Query) Match(h *Host) bool {
+	if h == nil {
+		return false
+	}
+	if q == nil || q.root == nil {
+		return true
+	}
+	return q.root.match(h)
+}
+
+// Empty reports whether the query has no terms and therefore matches everything.
+func (q *Query) Empty() bool {
+	return q == nil || q.root == nil
+}
+
+// Select returns the entries matching q, ordered by line number.
+func (hc *HostCollection) Select(q *Query) []*Host {
+	out := make([]*Host, 0)
+	for _, h := range hc.UniqueHosts() {
+		if q.Match(h) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// NewTerm builds a single-term query, e.g. NewTerm("cidr", "10.0.0.0/8").
+// An empty field is a free-text term.
+func NewTerm(field, value string) (*Query, error) {
+	t, err := newTermNode(field, value)
+	if err != nil {
+		return nil, err
+	}
+	return &Query{root: t}, nil
+}
+
+// And combines queries so that all of them must match. Nil and empty
+// queries are ignored.
+func And(queries ...*Query) *Query {
+	return combine(queries, func(nodes []queryNode) queryNode { return andNode(nodes) })
+}
+
+// Or combines queries so that any of them must match. Nil and empty
+// queries are ignored.
+func Or(queries ...*Query) *Query {
+	return combine(queries, func(nodes []queryNode) queryNode { return orNode(nodes) })
+}
+
+// Not negates a query. Negating an empty query yields an empty query.
+func Not(q *Query) *Query {
+	if q.Empty() {
+		return &Query{}
+	}
+	return &Query{root: notNode{node: q.root}}
+}
+
+func combine(queries []*Query, build func([]queryNode) queryNode) *Query {
+	nodes := make([]queryNode, 0, len(queries))
+	for _, q := range queries {
+		if !q.Empty() {
+			nodes = append(nodes, q.root)
+		}
+	}
+	switch len(nodes) {
+	case 0:
+		return &Query{}
+	case 1:
+		return &Query{root: nodes[0]}
+	}
+	return &Query{root: build(nodes)}
+}
+
+func newTermNode(field, value string) (*termNode, error) {
+	field = strings.ToLower(strings.TrimSpace(field))
+	t := &termNode{field: field, value: value}
+
+	switch field {
+	case "", "comment":
+		t.value = strings.ToLower(value)
+	case "host", "addr", "glob", "source", "fp", "tag":
+		if value == "" {
+			return nil, fmt.Errorf("%s: value is required", field)
+		}
+	case "type":
+		if value == "" {
+			return nil, fmt.Errorf("type: value is required")
+		}
+		t.value = strings.ToLower(value)
+	case "re", "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("re: %w", err)
+		}
+		t.field = "re"
+		t.re = re
+	case "cidr":
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("cidr: invalid network %q", value)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		t.cidr = ipNet
+	case "is":
+		t.value = strings.ToLower(value)
+		if t.value != "hashed" && t.value != "plain" {
+			return nil, fmt.Errorf("is: expected hashed or plain, got %q", value)
+		}
+	case "marker":
+		t.value = strings.ToLower(strings.TrimPrefix(value, "@"))
+	case "owner":
+		t.value = strings.ToLower(value)
+	case "line":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("line: invalid line number %q", value)
+		}
+		t.line = n
+	default:
+		return nil, fmt.Errorf("unknown filter %q", field)
+	}
+
+	return t, nil
+}
+
+func (t *termNode) match(h *Host) bool {
+	switch t.field {
+	case "":
+		return containsFold(h, t.value)
+	case "host":
+		return h.Matches(t.value)
+	case "addr":
+		return h.HasAddress(t.value)
+	case "glob":
+		pattern := strings.ToLower(t.value)
+		for _, a := range plainAddresses(h) {
+			a = strings.ToLower(a)
+			if wildcardMatch(pattern, a) || wildcardMatch(pattern, addressHost(a)) {
+				return true
+			}
+		}
+		return false
+	case "re":
+		for _, a := range plainAddresses(h) {
+			if t.re.MatchString(a) || t.re.MatchString(addressHost(a)) {
+				return true
+			}
+		}
+		return false
+	case "type":
+		return strings.Contains(strings.ToLower(h.Type), t.value)
+	case "cidr":
+		for _, a := range plainAddresses(h) {
+			if ip := addressIP(a); ip != nil && t.cidr.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case "is":
+		return (t.value == "hashed") == h.IsHashed
+	case "marker":
+		if t.value == "none" {
+			return h.Marker == ""
+		}
+		return h.Marker == t.value
+	case "source":
+		return h.Source == t.value ||
+			filepath.Base(h.Source) == t.value ||
+			wildcardMatch(t.value, h.Source)
+	case "comment":
+		return strings.Contains(strings.ToLower(h.Comment), t.value)
+	case "fp":
+		return strings.HasPrefix(h.Fingerprint(), t.value) ||
+			strings.HasPrefix(strings.TrimPrefix(h.Fingerprint(), "SHA256:"), t.value)
+	case "tag":
+		return h.Meta.HasTag(t.value)
+	case "owner":
+		return h.Meta != nil && strings.ToLower(h.Meta.Owner) == t.value
+	case "line":
+		return h.LineNumber == t.line
+	}
+	return false
+}
+
+// containsFold implements free-text terms over the searchable fields.
+func containsFold(h *Host, term string) bool {
+	if term == "" {
+		return true
+	}
+	fields := make([]string, 0, len(h.Addresses)+3)
+	fields = append(fields, h.Addresses...)
+	fields = append(fields, h.Type, h.Comment)
+	if h.IsHashed {
+		fields = append(fields, h.HashValue)
+	}
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// plainAddresses returns the non-hashed, non-negated addresses of an entry.
+func plainAddresses(h *Host) []string {
+	out := make([]string, 0, len(h.Addresses))
+	for _, a := range h.Addresses {
+		if strings.HasPrefix(a, "|") || strings.HasPrefix(a, "!") {
+			continue
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// addressHost strips the brackets and port of "[host]:port" addresses.
+func addressHost(addr string) string {
+	if strings.HasPrefix(addr, "[") {
+		if end := strings.Index(addr, "]"); end > 0 {
+			return addr[1:end]
+		}
+	}
+	return addr
+}
+
+// addressIP parses "10.0.0.1", "[10.0.0.1]:2222" or "[::1]:22" into an IP.
+func addressIP(addr string) net.IP {
+	return net.ParseIP(addressHost(addr))
+}
+
+// ParseQuery parses the filter language described on Query.
+func ParseQuery(s string) (*Query, error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return &Query{root: root}, nil
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *queryParser) isKeyword(tok queryToken, kw string) bool {
+	return !tok.quoted && strings.EqualFold(tok.text, kw)
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	var nodes []queryNode
+	for {
+		n, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			nodes = append(nodes, n)
+		}
+		tok, ok := p.peek()
+		if !ok || !p.isKeyword(tok, "or") {
+			break
+		}
+		p.pos++
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return orNode(nodes), nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	var nodes []queryNode
+	for {
+		tok, ok := p.peek()
+		if !ok || p.isKeyword(tok, "or") || (!tok.quoted && tok.text == ")") {
+			break
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return andNode(nodes), nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	tok, _ := p.peek()
+	p.pos++
+
+	switch {
+	case p.isKeyword(tok, "not"):
+		if _, ok := p.peek(); !ok {
+			return nil, fmt.Errorf("NOT requires a term")
+		}
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: n}, nil
+	case !tok.quoted && tok.text == "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		end, ok := p.peek()
+		if !ok || end.quoted || end.text != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		if n == nil {
+			return nil, fmt.Errorf("empty group")
+		}
+		return n, nil
+	case !tok.quoted && tok.text == ")":
+		return nil, fmt.Errorf("unexpected %q", tok.text)
+	}
+
+	text := tok.text
+	negate := false
+	if !tok.quoted && strings.HasPrefix(text, "-") && len(text) > 1 {
+		negate = true
+		text = text[1:]
+	}
+
+	field, value := "", text
+	if !tok.quoted {
+		if i := strings.Index(text, ":"); i > 0 {
+			candidate := strings.ToLower(text[:i])
+			if isQueryField(candidate) {
+				field, value = candidate, text[i+1:]
+			}
+		}
+	}
+	value = unquote(value)
+
+	t, err := newTermNode(field, value)
+	if err != nil {
+		return nil, err
+	}
+	if negate {
+		return notNode{node: t}, nil
+	}
+	return t, nil
+}
+
+func isQueryField(name string) bool {
+	switch name {
+	case "host", "addr", "glob", "re", "regex", "type", "cidr", "is", "marker", "source", "comment", "fp", "line", "tag", "owner":
+		return true
+	}
+	return false
+}
+
+// unquote strips the quotes of a value written as field:"some value".
+func unquote(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		return strings.ReplaceAll(s[1:len(s)-1], `\"`, `"`)
+	}
+	return s
+}
+
+// tokenizeQuery splits on whitespace, keeping double quoted sections together
+// and separating grouping parentheses from the terms they surround.
+func tokenizeQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(s) {
+		if s[i] == ' ' || s[i] == '\t' || s[i] == '\n' {
+			i++
+			continue
+		}
+
+		start := i
+		inQuote := false
+		for i < len(s) {
+			c := s[i]
+			if c == '\\' && inQuote && i+1 < len(s) {
+				i += 2
+				continue
+			}
+			if c == '"' {
+				inQuote = !inQuote
+			} else if !inQuote && (c == ' ' || c == '\t' || c == '\n') {
+				break
+			}
+			i++
+		}
+		if inQuote {
+			return nil, fmt.Errorf("unterminated quote in %q", s[start:])
+		}
+		word := s[start:i]
+
+		// Leading '(' always opens a group.
+		for strings.HasPrefix(word, "(") {
+			tokens = append(tokens, queryToken{text: "("})
+			word = word[1:]
+		}
+
+		// Trailing ')' closes a group only when it is not balanced within
+		// the word itself, so re:(a|b) stays intact.
+		closing := 0
+		for strings.HasSuffix(word, ")") && strings.Count(word, ")") > strings.Count(word, "(") {
+			word = word[:len(word)-1]
+			closing++
+		}
+
+		if word != "" {
+			quoted := strings.HasPrefix(word, `"`) && strings.HasSuffix(word, `"`) && len(word) >= 2
+			if quoted {
+				word = strings.ReplaceAll(word[1:len(word)-1], `\"`, `"`)
+			}
+			tokens = append(tokens, queryToken{text: word, quoted: quoted})
+		}
+		for ; closing > 0; closing-- {
+			tokens = append(tokens, queryToken{text: ")"})
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,204 @@
+package knownhosts
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	testKeyA = "AAAAC3NzaC1lZDI1NTE5AAAAII7jVCgTq4EdeprUZrIhZwsquWp8zSVCpri96XpI2/Dw"
+	testKeyB = "AAAAC3NzaC1lZDI1NTE5AAAAID7ZbJW7wstA5gU8UT8NlPVSeUuZX1Se8I/QNptEgdOv"
+	// testFingerprintA is the SHA256 fingerprint of testKeyA.
+	testFingerprintA = "SHA256:ron/wasPIEg5n9JhfC5sPSJ+f8AATEia4+HUzH0S+Fw"
+)
+
+// queryHosts returns the entries the query tests match against, one per
+// line in the order listed.
+func queryHosts(t *testing.T) []*Host {
+	t.Helper()
+	hashed, err := HashHostname("db1.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		"web1.example,10.0.0.5 ssh-ed25519 " + testKeyA + " web one",
+		"[web2.staging.example]:2222 ssh-rsa " + testKeyB,
+		hashed + " ssh-ed25519 " + testKeyB,
+		"@cert-authority *.example ssh-ed25519 " + testKeyB + " ca",
+		"@revoked 192.168.1.7 ssh-ed25519 " + testKeyA,
+		"*.dev.example,!jump.dev.example ecdsa-sha2-nistp256 " + testKeyB + " \"team dev\"",
+	}
+	hosts := make([]*Host, 0, len(lines))
+	for i, line := range lines {
+		h := parseHostLine(line, i+1)
+		if h == nil {
+			t.Fatalf("line %d did not parse: %s", i+1, line)
+		}
+		h.Source = "/home/user/.ssh/known_hosts"
+		hosts = append(hosts, h)
+	}
+	hosts[0].Meta = &Metadata{Tags: []string{"prod"}, Owner: "Ops"}
+	return hosts
+}
+
+func TestParseQueryMatch(t *testing.T) {
+	tests := []struct {
+		query string
+		lines []int
+	}{
+		{"", []int{1, 2, 3, 4, 5, 6}},
+		{"web", []int{1, 2}},
+		{"WEB1", []int{1}},
+		{"host:web1.example", []int{1, 4}},
+		{"host:db1.example", []int{3, 4}},
+		{"host:api.dev.example", []int{4, 6}},
+		{"host:jump.dev.example", []int{4}},
+		{"addr:db1.example", []int{3}},
+		{"addr:web2.staging.example", nil},
+		{"addr:[web2.staging.example]:2222", []int{2}},
+		{"glob:*.staging.example", []int{2}},
+		{"glob:web?.example", []int{1}},
+		{"re:^web[0-9]", []int{1, 2}},
+		{"re:(web1|web2)", []int{1, 2}},
+		{"type:ed25519", []int{1, 3, 4, 5}},
+		{"type:RSA", []int{2}},
+		{"cidr:10.0.0.0/8", []int{1}},
+		{"cidr:192.168.1.7", []int{5}},
+		{"is:hashed", []int{3}},
+		{"is:plain", []int{1, 2, 4, 5, 6}},
+		{"marker:cert-authority", []int{4}},
+		{"marker:@revoked", []int{5}},
+		{"marker:none", []int{1, 2, 3, 6}},
+		{"source:known_hosts", []int{1, 2, 3, 4, 5, 6}},
+		{"source:/home/*", []int{1, 2, 3, 4, 5, 6}},
+		{"source:other", nil},
+		{"comment:one", []int{1}},
+		{`comment:"team dev"`, []int{6}},
+		{`"web one"`, []int{1}},
+		{"fp:" + testFingerprintA, []int{1, 5}},
+		{"fp:" + strings.TrimPrefix(testFingerprintA, "SHA256:")[:6], []int{1, 5}},
+		{"line:2", []int{2}},
+		{"tag:prod", []int{1}},
+		{"owner:ops", []int{1}},
+
+		// Terms are ANDed, OR binds looser than AND.
+		{"type:ed25519 is:plain", []int{1, 4, 5}},
+		{"type:rsa OR is:hashed", []int{2, 3}},
+		{"type:rsa or is:hashed", []int{2, 3}},
+		{"line:1 line:2 OR line:3", []int{3}},
+		{"line:1 (line:2 OR line:1)", []int{1}},
+		{"(glob:*.staging.example OR glob:*.dev.example) -is:hashed", []int{2, 6}},
+
+		// Negation.
+		{"-type:ed25519", []int{2, 6}},
+		{"NOT type:ed25519", []int{2, 6}},
+		{"not (type:ed25519 OR type:rsa)", []int{6}},
+		{"NOT NOT line:3", []int{3}},
+		{"-web", []int{3, 4, 5, 6}},
+
+		// Quoted keywords and unknown fields are free text.
+		{`"or"`, nil},
+		{"nosuch:thing", nil},
+	}
+
+	hosts := queryHosts(t)
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseQuery(tt.query)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q): %v", tt.query, err)
+			}
+			var got []int
+			for _, h := range hosts {
+				if q.Match(h) {
+					got = append(got, h.LineNumber)
+				}
+			}
+			if !slices.Equal(got, tt.lines) {
+				t.Errorf("ParseQuery(%q) matched lines %v, want %v", tt.query, got, tt.lines)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"(type:rsa", "missing closing parenthesis"},
+		{"type:rsa)", `unexpected ")"`},
+		{"()", "empty group"},
+		{"NOT", "NOT requires a term"},
+		{`comment:"unterminated`, "unterminated quote"},
+		{"re:[", "re:"},
+		{"cidr:10.0.0.0/33", "cidr: invalid network"},
+		{"cidr:web1", "cidr: invalid network"},
+		{"is:secret", "is: expected hashed or plain"},
+		{"line:0", "line: invalid line number"},
+		{"line:x", "line: invalid line number"},
+		{"type:", "type: value is required"},
+		{"host:", "host: value is required"},
+		{"tag:", "tag: value is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := ParseQuery(tt.query)
+			if err == nil {
+				t.Fatalf("ParseQuery(%q) succeeded, want error containing %q", tt.query, tt.err)
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParseQuery(%q) error = %q, want it to contain %q", tt.query, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestQueryCombinators(t *testing.T) {
+	hosts := queryHosts(t)
+	rsa, err := NewTerm("type", "rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed, err := NewTerm("is", "hashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query *Query
+		lines []int
+	}{
+		{"nil", nil, []int{1, 2, 3, 4, 5, 6}},
+		{"empty and", And(), []int{1, 2, 3, 4, 5, 6}},
+		{"and", And(rsa, hashed), nil},
+		{"and ignores empty", And(rsa, &Query{}, nil), []int{2}},
+		{"or", Or(rsa, hashed), []int{2, 3}},
+		{"not", Not(Or(rsa, hashed)), []int{1, 4, 5, 6}},
+		{"not empty", Not(&Query{}), []int{1, 2, 3, 4, 5, 6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, h := range hosts {
+				if tt.query.Match(h) {
+					got = append(got, h.LineNumber)
+				}
+			}
+			if !slices.Equal(got, tt.lines) {
+				t.Errorf("matched lines %v, want %v", got, tt.lines)
+			}
+		})
+	}
+
+	if _, err := NewTerm("nosuch", "x"); err == nil {
+		t.Error("NewTerm with an unknown field succeeded")
+	}
+	if (&Query{}).Match(nil) {
+		t.Error("an empty query matched a nil entry")
+	}
+}
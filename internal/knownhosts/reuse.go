@@ -0,0 +1,197 @@
+package knownhosts
+
+import (
+	"sort"
+	"strings"
+)
+
+// KeyGroup collects the entries carrying one key blob.
+type KeyGroup struct {
+	Type    string
+	Key     string
+	Entries []*Host
+	// Hosts is the number of distinct hosts among Entries. Entries are only
+	// taken for the same host when that is proven, see hostIndex.
+	Hosts int
+	// Unresolved is the number of Hosts known only by a hashed name that
+	// matches no plaintext name or address in the file. Each may still be
+	// one of the other hosts, so the reuse they add is possible, not
+	// certain.
+	Unresolved int
+}
+
+// Fingerprint returns the SHA256 fingerprint of the group's key.
+func (g KeyGroup) Fingerprint() string {
+	return KeyFingerprint(g.Key)
+}
+
+// Certain reports whether the key is proven to be used by more than one
+// host, without counting hosts with unresolved hashed names.
+func (g KeyGroup) Certain() bool {
+	return g.Hosts-g.Unresolved > 1
+}
+
+// GroupByKey groups entries by key blob, most widely shared keys first.
+// Entries keep their relative order within a group.
+func GroupByKey(entries []*Host) []KeyGroup {
+	return groupByKey(entries, newHostIndex(entries))
+}
+
+func groupByKey(entries []*Host, index *hostIndex) []KeyGroup {
+	positions := make(map[string]int)
+	groups := make([]KeyGroup, 0)
+	for _, h := range entries {
+		if h == nil {
+			continue
+		}
+		id := h.Type + " " + h.Key
+		i, ok := positions[id]
+		if !ok {
+			i = len(groups)
+			positions[id] = i
+			groups = append(groups, KeyGroup{Type: h.Type, Key: h.Key})
+		}
+		groups[i].Entries = append(groups[i].Entries, h)
+	}
+
+	for i := range groups {
+		groups[i].Hosts, groups[i].Unresolved = index.countHosts(groups[i].Entries)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Hosts != groups[j].Hosts {
+			return groups[i].Hosts > groups[j].Hosts
+		}
+		if groups[i].Type != groups[j].Type {
+			return groups[i].Type < groups[j].Type
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
+
+// ReusedKeys returns the keys present for more than one distinct host, such
+// as the host key baked into a cloned VM image, including keys whose reuse
+// is only possible (see KeyGroup.Certain). Marked entries are ignored: a
+// @cert-authority key is meant to be shared and a @revoked key is not
+// trusted anyway, but their host names still tie names together.
+func ReusedKeys(entries []*Host) []KeyGroup {
+	unmarked := make([]*Host, 0, len(entries))
+	for _, h := range entries {
+		if h != nil && h.Marker == "" {
+			unmarked = append(unmarked, h)
+		}
+	}
+
+	reused := make([]KeyGroup, 0)
+	for _, g := range groupByKey(unmarked, newHostIndex(entries)) {
+		if g.Hosts > 1 {
+			reused = append(reused, g)
+		}
+	}
+	return reused
+}
+
+// hostIndex tells which entries name the same host. Nothing is guessed:
+// the addresses listed on one line belong to one host, such as the name and
+// IP address ssh records with CheckHostIP, and so do lines sharing an
+// address, across all keys of the file. A hashed entry joins the host of
+// the plaintext name or address it verifies against; otherwise it stands
+// for a host of its own.
+type hostIndex struct {
+	parent map[string]string
+	names  []string
+	hashed map[string]string
+}
+
+func newHostIndex(entries []*Host) *hostIndex {
+	idx := &hostIndex{parent: make(map[string]string), hashed: make(map[string]string)}
+	for _, h := range entries {
+		if h == nil {
+			continue
+		}
+		first := ""
+		for _, a := range plainAddresses(h) {
+			name := CanonicalHostname(a)
+			if name == "" {
+				continue
+			}
+			if _, ok := idx.parent[name]; !ok {
+				idx.parent[name] = name
+				idx.names = append(idx.names, name)
+			}
+			if first == "" {
+				first = name
+			} else {
+				idx.union(first, name)
+			}
+		}
+	}
+	return idx
+}
+
+func (idx *hostIndex) find(name string) string {
+	for idx.parent[name] != name {
+		idx.parent[name] = idx.parent[idx.parent[name]]
+		name = idx.parent[name]
+	}
+	return name
+}
+
+func (idx *hostIndex) union(a, b string) {
+	if ra, rb := idx.find(a), idx.find(b); ra != rb {
+		idx.parent[rb] = ra
+	}
+}
+
+// hostOf returns an identifier of the host h names and whether it is
+// resolved, i.e. not just an unverified hashed name.
+func (idx *hostIndex) hostOf(h *Host) (string, bool) {
+	for _, a := range plainAddresses(h) {
+		if name := CanonicalHostname(a); name != "" {
+			return idx.find(name), true
+		}
+	}
+	for _, a := range h.Addresses {
+		if !strings.HasPrefix(a, "|") {
+			continue
+		}
+		name, ok := idx.hashed[a]
+		if !ok {
+			for _, n := range idx.names {
+				if matchHashed(a, n) {
+					name = n
+					break
+				}
+			}
+			idx.hashed[a] = name
+		}
+		if name != "" {
+			return idx.find(name), true
+		}
+	}
+	if h.HashValue != "" {
+		return h.HashValue, false
+	}
+	return h.HostField(), false
+}
+
+// countHosts counts the distinct hosts among entries and how many of them
+// are known only by an unresolved hashed name.
+func (idx *hostIndex) countHosts(entries []*Host) (hosts, unresolved int) {
+	seen := make(map[string]bool)
+	for _, h := range entries {
+		id, resolved := idx.hostOf(h)
+		if !resolved {
+			id = "|" + id
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		hosts++
+		if !resolved {
+			unresolved++
+		}
+	}
+	return hosts, unresolved
+}
@@ -0,0 +1,91 @@
+package knownhosts
+
+import "testing"
+
+func TestReusedKeysCountsHosts(t *testing.T) {
+	hash := func(name string) string {
+		t.Helper()
+		hashed, err := HashHostname(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hashed
+	}
+	hashedIP := hash("10.0.0.5")
+
+	tests := []struct {
+		name string
+		// lines are host fields carrying testKeyA, other full lines that
+		// carry testKeyB.
+		lines      []string
+		other      []string
+		hosts      int
+		unresolved int
+	}{
+		{"one line", []string{"web1,10.0.0.5"}, nil, 1, 0},
+		{"aliases join lines", []string{"web1,10.0.0.5", "10.0.0.5,web1.example"}, nil, 1, 0},
+		{"same address with port", []string{"[web1]:2222", "[WEB1]:2222"}, nil, 1, 0},
+		{"default port", []string{"web1", "[web1]:22"}, nil, 1, 0},
+		{"two names", []string{"web1", "web2"}, nil, 2, 0},
+		{"two IPs", []string{"10.0.0.5", "10.0.0.6"}, nil, 2, 0},
+		{"name and an unrelated IP", []string{"web1", "10.9.9.9"}, nil, 2, 0},
+		{"name and IP on separate lines", []string{"web1", "10.0.0.5"}, nil, 2, 0},
+		{"other port", []string{"web1", "[web1]:2222"}, nil, 2, 0},
+
+		// Another line of the file proves the pairing.
+		{"paired by another key", []string{"web1", "10.0.0.5"}, []string{"web1,10.0.0.5 ssh-rsa " + testKeyB}, 1, 0},
+		{"paired by a marked line", []string{"web1", "10.0.0.5"}, []string{"@revoked web1,10.0.0.5 ssh-ed25519 " + testKeyB}, 1, 0},
+		{"paired through a chain", []string{"web1", "10.0.0.5"}, []string{"web1,w1 ssh-rsa " + testKeyB, "w1,10.0.0.5 ssh-rsa " + testKeyB}, 1, 0},
+
+		// Hashed names join a host only when verified.
+		{"hashed matching a name", []string{"web1", hash("web1")}, nil, 1, 0},
+		{"hashed matching an alias", []string{"web1,10.0.0.5", hashedIP}, nil, 1, 0},
+		{"hashed resolved by another key", []string{"web1", hashedIP}, []string{"web1,10.0.0.5 ssh-rsa " + testKeyB}, 1, 0},
+		{"hashed name and IP", []string{hash("web1"), hash("10.0.0.5")}, nil, 2, 2},
+		{"two hashed hosts", []string{hash("web1"), hash("web2")}, nil, 2, 2},
+		{"name and hashed IP", []string{"web1", hashedIP}, nil, 2, 1},
+		{"three hashed", []string{hash("web1"), hash("10.0.0.5"), hash("web2")}, nil, 3, 3},
+		{"same hashed line twice", []string{hashedIP, hashedIP}, nil, 1, 1},
+		{"two names and a hashed one", []string{"web1", "web2", hash("web3")}, nil, 3, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := make([]*Host, 0, len(tt.lines)+len(tt.other))
+			for i, field := range tt.lines {
+				entries = append(entries, parseHostLine(field+" ssh-ed25519 "+testKeyA, i+1))
+			}
+			for i, line := range tt.other {
+				entries = append(entries, parseHostLine(line, len(tt.lines)+i+1))
+			}
+
+			var group *KeyGroup
+			for _, g := range GroupByKey(entries) {
+				if g.Key == testKeyA {
+					group = &g
+					break
+				}
+			}
+			if group == nil {
+				t.Fatal("GroupByKey returned no group for the key")
+			}
+			if group.Hosts != tt.hosts || group.Unresolved != tt.unresolved {
+				t.Errorf("counted %d hosts, %d unresolved, want %d and %d", group.Hosts, group.Unresolved, tt.hosts, tt.unresolved)
+			}
+
+			var reused *KeyGroup
+			for _, g := range ReusedKeys(entries) {
+				if g.Key == testKeyA {
+					reused = &g
+					break
+				}
+			}
+			if got, want := reused != nil, tt.hosts > 1; got != want {
+				t.Fatalf("ReusedKeys reported reuse = %v, want %v", got, want)
+			}
+			if reused != nil && reused.Certain() != (tt.hosts-tt.unresolved > 1) {
+				t.Errorf("Certain() = %v with %d hosts, %d unresolved", reused.Certain(), tt.hosts, tt.unresolved)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package knownhosts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KeyChange is what a rotation does to one key type of a host.
+type KeyChange struct {
+	Type string
+	// Old are the entries holding the previous key of the type; empty when
+	// the host did not have one.
+	Old []*Host
+	// New is the scanned key, nil when the host no longer offers the type.
+	New *Host
+}
+
+// Stale returns the old entries whose key is not the scanned one.
+func (c KeyChange) Stale() []*Host {
+	if c.New == nil {
+		return c.Old
+	}
+	stale := make([]*Host, 0, len(c.Old))
+	for _, h := range c.Old {
+		if h.Key != c.New.Key {
+			stale = append(stale, h)
+		}
+	}
+	return stale
+}
+
+// Unchanged reports whether the scanned key is the one already known.
+func (c KeyChange) Unchanged() bool {
+	return c.New != nil && len(c.Old) > 0 && len(c.Stale()) == 0
+}
+
+// Rotation replaces the keys of one address with freshly scanned ones.
+type Rotation struct {
+	Address string
+	Changes []KeyChange
+}
+
+// Changed reports whether applying r modifies anything.
+func (r *Rotation) Changed() bool {
+	for _, c := range r.Changes {
+		if !c.Unchanged() {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanRotation compares the unmarked entries listing address (hashed ones
+// included, wildcard patterns not) with the scanned keys. Key types the scan
+// did not return are retired unless onlyScanned is set, which is meant for
+// scans limited to some types.
+func (hc *HostCollection) PlanRotation(address string, scanned []*Host, onlyScanned bool) (*Rotation, error) {
+	old := make(map[string][]*Host)
+	for _, h := range hc.Entries {
+		if h.Marker == "" && h.HasAddress(address) {
+			old[h.Type] = append(old[h.Type], h)
+		}
+	}
+	if len(old) == 0 {
+		return nil, fmt.Errorf("no entries for %s", address)
+	}
+
+	r := &Rotation{Address: address}
+	seen := make(map[string]bool)
+	for _, k := range scanned {
+		if seen[k.Type] {
+			continue
+		}
+		seen[k.Type] = true
+		r.Changes = append(r.Changes, KeyChange{Type: k.Type, Old: old[k.Type], New: k})
+	}
+	if !onlyScanned {
+		for t, hosts := range old {
+			if !seen[t] {
+				r.Changes = append(r.Changes, KeyChange{Type: t, Old: hosts})
+			}
+		}
+	}
+	sort.SliceStable(r.Changes, func(i, j int) bool { return r.Changes[i].Type < r.Changes[j].Type })
+	return r, nil
+}
+
+// Rotate applies r: the stale entries are moved to the stash at archivePath
+// with reason, and each is replaced in place by a line with the new key and
+// the same host field, so aliases and hashing are kept. Key types that are
+// new to the host are added after the first old line, with its host field.
+// The new entries carry over the old metadata, and record the rotation
+// (Source "rotate", Replaces) and the time. It returns the entries written
+// and the entries archived.
+func (hc *HostCollection) Rotate(r *Rotation, archivePath, reason string) (written, archived []*Host, err error) {
+	if !r.Changed() {
+		return nil, nil, nil
+	}
+
+	now := time.Now().UTC()
+	after := make(map[*Host][]*Host)
+	seen := make(map[string]bool)
+	var template *Host
+	for _, c := range r.Changes {
+		for _, h := range c.Old {
+			if template == nil || h.LineNumber < template.LineNumber {
+				template = h
+			}
+		}
+	}
+
+	for _, c := range r.Changes {
+		archived = append(archived, c.Stale()...)
+	}
+	// Lines that stay may already hold the new key; do not write it twice.
+	stale := make(map[*Host]bool, len(archived))
+	for _, h := range archived {
+		stale[h] = true
+	}
+	kept := make([]*Host, 0, len(hc.Entries))
+	for _, h := range hc.Entries {
+		if !stale[h] {
+			kept = append(kept, h)
+		}
+	}
+
+	for _, c := range r.Changes {
+		if c.New == nil || c.Unchanged() {
+			continue
+		}
+		targets := c.Stale()
+		if len(targets) == 0 {
+			targets = []*Host{template}
+		}
+		for _, old := range targets {
+			h := rotatedEntry(old, c.New, now)
+			id := stashKey(h)
+			if seen[id] || covered(kept, h) || covered(written, h) {
+				continue
+			}
+			seen[id] = true
+			after[old] = append(after[old], h)
+			written = append(written, h)
+		}
+	}
+
+	entries := make([]*Host, 0, len(hc.Entries)+len(written))
+	for _, h := range hc.Entries {
+		entries = append(entries, h)
+		entries = append(entries, after[h]...)
+		if stale[h] && len(after[h]) > 0 {
+			hc.moveComments(h, after[h][0])
+		}
+	}
+	hc.Entries = entries
+	hc.reindex()
+
+	if len(archived) == 0 {
+		if err := hc.SaveToFile(hc.File); err != nil {
+			return nil, nil, fmt.Errorf("failed to save known_hosts: %w", err)
+		}
+		return written, nil, nil
+	}
+	records := make([]HistoryRecord, 0, len(archived))
+	for _, c := range r.Changes {
+		for _, h := range c.Stale() {
+			rec := newHistoryRecord(h, strings.Join(h.Addresses, ","), OpRotate, reason, now)
+			if c.New != nil {
+				rec.ReplacedBy = c.New.Fingerprint()
+			}
+			records = append(records, rec)
+		}
+	}
+	if err := appendHistory(hc.store(), hc.File, records); err != nil {
+		return nil, nil, err
+	}
+	if _, err := hc.StashHostsWithOptions(archived, archivePath, StashOptions{Reason: reason}); err != nil {
+		return nil, nil, err
+	}
+	return written, archived, nil
+}
+
+// covered reports whether the key of h is already listed for every address
+// of h by one of hosts.
+func covered(hosts []*Host, h *Host) bool {
+	for _, k := range hosts {
+		if k.Marker != "" || k.Type != h.Type || k.Key != h.Key {
+			continue
+		}
+		all := true
+		for _, a := range h.Addresses {
+			if !containsAddress(k.Addresses, a) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// rotatedEntry returns old with the key of k and metadata recording the
+// rotation.
+func rotatedEntry(old, k *Host, now time.Time) *Host {
+	h := &Host{
+		Addresses: append([]string(nil), old.Addresses...),
+		Type:      k.Type,
+		Key:       k.Key,
+		Comment:   old.Comment,
+		IsHashed:  old.IsHashed,
+		HashValue: old.HashValue,
+		Source:    old.Source,
+		Meta:      old.Meta.Clone(),
+	}
+	meta := h.EnsureMeta()
+	meta.Stash = nil
+	meta.Source = "rotate"
+	meta.AddedAt = &now
+	meta.LastVerifiedAt = &now
+	meta.Replaces = ""
+	if old.Type == k.Type {
+		meta.Replaces = old.Fingerprint()
+	}
+	return h
+}
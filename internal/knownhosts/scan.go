@@ -0,0 +1,73 @@
+package knownhosts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScanHostKeys asks the SSH server host on port for its host keys using
+// ssh-keyscan. types limits the key types, using ssh-keyscan's names (rsa,
+// ecdsa, ed25519); empty asks for all of them. The returned entries list the
+// address as known_hosts spells it (FormatAddress).
+func ScanHostKeys(host string, port int, types []string, timeout time.Duration) ([]*Host, error) {
+	if host == "" {
+		return nil, fmt.Errorf("host is required")
+	}
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	args := []string{"-T", strconv.Itoa(int((timeout + time.Second - 1) / time.Second))}
+	if port != 0 && port != 22 {
+		args = append(args, "-p", strconv.Itoa(port))
+	}
+	if len(types) > 0 {
+		args = append(args, "-t", strings.Join(types, ","))
+	}
+	args = append(args, host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+5*time.Second)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ssh-keyscan", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("ssh-keyscan not found in PATH")
+		}
+		// ssh-keyscan exits non-zero when one of several types fails;
+		// whatever it printed is still usable.
+		if stdout.Len() == 0 {
+			return nil, fmt.Errorf("ssh-keyscan %s: %w: %s", host, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	address := FormatAddress(host, port)
+	keys := make([]*Host, 0)
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		h := parseHostLine(line, 0)
+		if h == nil || ValidateKey(h.Type, h.Key) != nil {
+			continue
+		}
+		h.setAddresses([]string{address})
+		h.Comment = ""
+		keys = append(keys, h)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no host keys received from %s", address)
+	}
+	return keys, nil
+}
@@ -0,0 +1,641 @@
+package knownhosts
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultStash names the stash_hosts file next to known_hosts, which is used
+// when no stash name is given.
+const DefaultStash = "default"
+
+// StashInfo describes one stash.
+type StashInfo struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Entries  int       `json:"entries"`
+	Modified time.Time `json:"modified"`
+}
+
+// ValidateStashName rejects names that cannot be used as a file name in the
+// stash directory.
+func ValidateStashName(name string) error {
+	if name == "" {
+		return fmt.Errorf("stash name is required")
+	}
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".meta.json") {
+		return fmt.Errorf("invalid stash name %q", name)
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.', r == '@':
+		default:
+			return fmt.Errorf("invalid stash name %q: use letters, digits, '-', '_', '.' and '@'", name)
+		}
+	}
+	return nil
+}
+
+// StashDir returns the directory holding the named stashes: stash_hosts.d
+// next to known_hosts.
+func (hc *HostCollection) StashDir() string {
+	if hc.File == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(hc.File), "stash_hosts.d")
+}
+
+// NamedStashPath returns the file of the stash called name. An empty name or
+// DefaultStash selects StashFilePath.
+func (hc *HostCollection) NamedStashPath(name string) (string, error) {
+	if name == "" || name == DefaultStash {
+		if path := hc.StashFilePath(); path != "" {
+			return path, nil
+		}
+		return "", fmt.Errorf("stash path not available")
+	}
+	if err := ValidateStashName(name); err != nil {
+		return "", err
+	}
+	if hc.File == "" {
+		return "", fmt.Errorf("stash path not available")
+	}
+	return filepath.Join(hc.StashDir(), name), nil
+}
+
+// Stashes lists the default stash, when it exists, and the named stashes,
+// most recently changed first.
+func (hc *HostCollection) Stashes() ([]StashInfo, error) {
+	stashes := make([]StashInfo, 0)
+	add := func(name, path string) error {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		col, err := ParseKnownHostsFrom(hc.store(), path)
+		if err != nil {
+			return fmt.Errorf("failed to read stash %s: %w", name, err)
+		}
+		stashes = append(stashes, StashInfo{Name: name, Path: path, Entries: len(col.Entries), Modified: fi.ModTime()})
+		return nil
+	}
+
+	if path := hc.StashFilePath(); path != "" {
+		if err := add(DefaultStash, path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	if dir := hc.StashDir(); dir != "" {
+		files, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list stashes: %w", err)
+		}
+		for _, f := range files {
+			if f.IsDir() || ValidateStashName(f.Name()) != nil || strings.HasSuffix(f.Name(), ".backup") {
+				continue
+			}
+			if err := add(f.Name(), filepath.Join(dir, f.Name())); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	sort.SliceStable(stashes, func(i, j int) bool {
+		return stashes[i].Modified.After(stashes[j].Modified)
+	})
+	return stashes, nil
+}
+
+// ApplyStash restores the entries of the stash file matching q (all of them
+// when q is empty) into known_hosts, skipping keys that are already present.
+// With drop set the matching entries are also removed from the stash, as
+// `git stash pop` does; a named stash left empty is deleted. An entry whose
+// host has a different key of the same type in known_hosts is handled as
+// resolve says (KeepCurrent, SwapStashed or KeepBoth); with an empty resolve
+// nothing is restored and a *RestoreConflictError lists the conflicts. It
+// returns the number of entries added to known_hosts.
+func (hc *HostCollection) ApplyStash(stashPath string, q *Query, drop bool, resolve string) (int, error) {
+	return hc.unstashFrom(stashPath, func(stashCol *HostCollection) []*Host {
+		return stashCol.Select(q)
+	}, drop, resolve)
+}
+
+// StashOrigin returns the known_hosts file h was stashed from, or fallback
+// when the stash did not record it.
+func (h *Host) StashOrigin(fallback string) string {
+	if h.Meta != nil && h.Meta.Stash != nil && h.Meta.Stash.From != "" {
+		return h.Meta.Stash.From
+	}
+	return fallback
+}
+
+// RestoreStash restores the entries of the stash file matching q (all of
+// them when q is empty) into the files they were stashed from, or all into
+// target when it is set. Entries without a recorded origin go to the file of
+// hc. drop and resolve work as for ApplyStash; conflicts in any of the files
+// are reported before anything is written. It returns the number of entries
+// added per file.
+func (hc *HostCollection) RestoreStash(stashPath string, q *Query, target string, drop bool, resolve string) (map[string]int, error) {
+	return hc.restoreTo(stashPath, func(stashCol *HostCollection) []*Host {
+		return stashCol.Select(q)
+	}, target, drop, resolve)
+}
+
+// RestoreEntries is RestoreStash for the given stashed entries, matched by
+// their line content. They are removed from the stash.
+func (hc *HostCollection) RestoreEntries(stashPath string, entries []*Host, target, resolve string) (map[string]int, error) {
+	wanted := make(map[string]bool, len(entries))
+	for _, h := range entries {
+		wanted[stashKey(h)] = true
+	}
+	return hc.restoreTo(stashPath, func(stashCol *HostCollection) []*Host {
+		out := make([]*Host, 0, len(entries))
+		for _, h := range stashCol.Entries {
+			if wanted[stashKey(h)] {
+				out = append(out, h)
+			}
+		}
+		return out
+	}, target, true, resolve)
+}
+
+func (hc *HostCollection) restoreTo(stashPath string, pick func(stashCol *HostCollection) []*Host, target string, drop bool, resolve string) (map[string]int, error) {
+	store := hc.store()
+	stashCol, err := ParseKnownHostsFrom(store, stashPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("stash %s not found", stashPath)
+		}
+		return nil, fmt.Errorf("failed to parse stash: %w", err)
+	}
+	picked := pick(stashCol)
+	if len(picked) == 0 {
+		return nil, fmt.Errorf("no matching entries in stash")
+	}
+
+	byDest := make(map[string][]*Host)
+	order := make([]string, 0, 1)
+	for _, h := range picked {
+		dest := target
+		if dest == "" {
+			dest = h.StashOrigin(hc.File)
+		}
+		if dest == "" {
+			return nil, fmt.Errorf("line %d of the stash does not record its origin: choose a target file", h.LineNumber)
+		}
+		if _, ok := byDest[dest]; !ok {
+			order = append(order, dest)
+		}
+		byDest[dest] = append(byDest[dest], h)
+	}
+
+	if resolve == "" {
+		conflicts := make([]RestoreConflict, 0)
+		for _, dest := range order {
+			mainCol, err := ParseKnownHostsFrom(store, dest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", dest, err)
+			}
+			conflicts = append(conflicts, restoreConflicts(mainCol, byDest[dest])...)
+		}
+		if len(conflicts) > 0 {
+			return nil, &RestoreConflictError{Conflicts: conflicts}
+		}
+	}
+
+	restored := make(map[string]int, len(order))
+	for _, dest := range order {
+		keys := make(map[string]bool, len(byDest[dest]))
+		for _, h := range byDest[dest] {
+			keys[stashKey(h)] = true
+		}
+		n, err := hc.unstashInto(dest, stashPath, func(stashCol *HostCollection) []*Host {
+			out := make([]*Host, 0, len(keys))
+			for _, h := range stashCol.Entries {
+				if keys[stashKey(h)] {
+					out = append(out, h)
+				}
+			}
+			return out
+		}, drop, resolve)
+		if err != nil {
+			return restored, fmt.Errorf("failed to restore into %s: %w", dest, err)
+		}
+		restored[dest] = n
+	}
+	return restored, nil
+}
+
+// DropStash discards the entries of the stash file matching q. An empty q
+// deletes the stash file together with its metadata, as does dropping the
+// last entries of a named stash. It returns the number of entries discarded.
+func (hc *HostCollection) DropStash(stashPath string, q *Query) (int, error) {
+	store := hc.store()
+	stashCol, err := ParseKnownHostsFrom(store, stashPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, fmt.Errorf("stash %s not found", stashPath)
+		}
+		return 0, fmt.Errorf("failed to parse stash: %w", err)
+	}
+
+	if q.Empty() {
+		if err := hc.ArchiveStashed(stashCol.Entries, OpStashDrop, ""); err != nil {
+			return 0, err
+		}
+		if err := removeStash(store, stashPath); err != nil {
+			return 0, err
+		}
+		return len(stashCol.Entries), nil
+	}
+
+	dropped := stashCol.Select(q)
+	if len(dropped) == 0 {
+		return 0, fmt.Errorf("no matching entries in stash")
+	}
+	if err := hc.ArchiveStashed(dropped, OpStashDrop, ""); err != nil {
+		return 0, err
+	}
+	stashCol.RemoveEntries(dropped)
+	if err := hc.saveStash(stashCol); err != nil {
+		return 0, err
+	}
+	return len(dropped), nil
+}
+
+func removeStash(store Store, stashPath string) error {
+	if err := store.Remove(stashPath); err != nil {
+		return err
+	}
+	return store.Remove(MetadataPath(stashPath))
+}
+
+// StashRecord describes how an entry came into a stash. It is kept in the
+// entry's metadata while the entry is stashed.
+type StashRecord struct {
+	By     string    `json:"by,omitempty"`
+	At     time.Time `json:"at"`
+	From   string    `json:"from,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	// Expires is when the entry leaves the stash again: it is restored,
+	// or discarded when OnExpiry is "drop". See ExpireStashes.
+	Expires  *time.Time `json:"expires,omitempty"`
+	OnExpiry string     `json:"on_expiry,omitempty"`
+}
+
+// Summary formats the record on one line.
+func (r *StashRecord) Summary() string {
+	var b strings.Builder
+	b.WriteString(r.At.Local().Format("2006-01-02 15:04"))
+	if r.By != "" {
+		b.WriteString(" by " + r.By)
+	}
+	if r.From != "" {
+		b.WriteString(" from " + r.From)
+	}
+	if r.Reason != "" {
+		b.WriteString(": " + r.Reason)
+	}
+	if r.Expires != nil {
+		action := ExpireRestore
+		if r.OnExpiry == ExpireDrop {
+			action = ExpireDrop
+		}
+		fmt.Fprintf(&b, " (%s on %s)", action, r.Expires.Local().Format("2006-01-02 15:04"))
+	}
+	return b.String()
+}
+
+// Actions for stashed entries whose expiry has passed.
+const (
+	ExpireRestore = "restore"
+	ExpireDrop    = "drop"
+)
+
+// StashOptions are recorded with the stashed entries.
+type StashOptions struct {
+	Reason string
+	// Expire, when positive, is how long the entries stay stashed.
+	Expire time.Duration
+	// OnExpiry is ExpireRestore (the default) or ExpireDrop.
+	OnExpiry string
+}
+
+func (o StashOptions) record(from string, now time.Time) (*StashRecord, error) {
+	switch o.OnExpiry {
+	case "", ExpireRestore, ExpireDrop:
+	default:
+		return nil, fmt.Errorf("unknown expiry action %q: expected %s or %s", o.OnExpiry, ExpireRestore, ExpireDrop)
+	}
+	// The origin must stay valid when khm later runs from another directory.
+	if from != "" {
+		if abs, err := filepath.Abs(from); err == nil {
+			from = abs
+		}
+	}
+	r := &StashRecord{By: currentUser(), At: now, From: from, Reason: o.Reason}
+	if o.Expire > 0 {
+		expires := now.Add(o.Expire)
+		r.Expires = &expires
+		if o.OnExpiry == ExpireDrop {
+			r.OnExpiry = ExpireDrop
+		}
+	}
+	return r, nil
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// ExpiryReport tells what ExpireStashes did.
+type ExpiryReport struct {
+	Restored int
+	Dropped  int
+	// Held lists the expired entries that stay stashed because their host
+	// now has a different key of the same type. Their expiry is cleared, so
+	// they are reported once instead of being retried on every run.
+	Held []*Host
+}
+
+// ExpiredStashEntries returns the stashed entries of every stash whose
+// expiry is not after now, without changing any file.
+func (hc *HostCollection) ExpiredStashEntries(now time.Time) ([]*Host, error) {
+	stashes, err := hc.Stashes()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*Host, 0)
+	for _, s := range stashes {
+		stashCol, err := ParseKnownHostsFrom(hc.store(), s.Path)
+		if err != nil {
+			return out, fmt.Errorf("failed to parse stash %s: %w", s.Name, err)
+		}
+		for _, h := range stashCol.Entries {
+			if stashExpired(h, now) {
+				out = append(out, h)
+			}
+		}
+	}
+	return out, nil
+}
+
+func stashExpired(h *Host, now time.Time) bool {
+	return h.Meta != nil && h.Meta.Stash != nil && h.Meta.Stash.Expires != nil && !now.Before(*h.Meta.Stash.Expires)
+}
+
+// ExpireStashes handles the stashed entries of every stash whose expiry is
+// not after now: they are restored into the file they were stashed from, or
+// discarded when they were stashed with ExpireDrop. Entries conflicting with
+// a newer key in known_hosts stay stashed and are listed in the report's
+// Held. Files are only written when something changes.
+func (hc *HostCollection) ExpireStashes(now time.Time) (ExpiryReport, error) {
+	var report ExpiryReport
+	stashes, err := hc.Stashes()
+	if err != nil {
+		return report, err
+	}
+
+	for _, s := range stashes {
+		stashCol, err := ParseKnownHostsFrom(hc.store(), s.Path)
+		if err != nil {
+			return report, fmt.Errorf("failed to parse stash %s: %w", s.Name, err)
+		}
+
+		restore := make(map[string]bool)
+		discard := make([]*Host, 0)
+		for _, h := range stashCol.Entries {
+			if !stashExpired(h, now) {
+				continue
+			}
+			if h.Meta.Stash.OnExpiry == ExpireDrop {
+				discard = append(discard, h)
+			} else {
+				restore[stashKey(h)] = true
+			}
+		}
+
+		if len(discard) > 0 {
+			if err := hc.ArchiveStashed(discard, OpStashDrop, "stash expired"); err != nil {
+				return report, err
+			}
+			stashCol.RemoveEntries(discard)
+			if err := hc.saveStash(stashCol); err != nil {
+				return report, err
+			}
+			report.Dropped += len(discard)
+		}
+
+		if len(restore) == 0 {
+			continue
+		}
+		counts, err := hc.restoreTo(s.Path, func(stashCol *HostCollection) []*Host {
+			out := make([]*Host, 0, len(restore))
+			for _, h := range stashCol.Entries {
+				if restore[stashKey(h)] {
+					out = append(out, h)
+				}
+			}
+			return out
+		}, "", true, KeepCurrent)
+		for _, n := range counts {
+			report.Restored += n
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to restore expired entries of stash %s: %w", s.Name, err)
+		}
+
+		held, err := hc.holdExpired(s.Path, restore)
+		if err != nil {
+			return report, err
+		}
+		report.Held = append(report.Held, held...)
+	}
+	return report, nil
+}
+
+// holdExpired clears the expiry of the entries of the stash at stashPath
+// that were due for restore but are still there, since they conflict with
+// known_hosts, and returns them.
+func (hc *HostCollection) holdExpired(stashPath string, restore map[string]bool) ([]*Host, error) {
+	stashCol, err := ParseKnownHostsFrom(hc.store(), stashPath)
+	if errors.Is(err, os.ErrNotExist) {
+		// A named stash emptied by the restore is gone.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse stash: %w", err)
+	}
+
+	held := make([]*Host, 0)
+	for _, h := range stashCol.Entries {
+		if restore[stashKey(h)] {
+			h.Meta.Stash.Expires = nil
+			h.Meta.Stash.OnExpiry = ""
+			held = append(held, h)
+		}
+	}
+	if len(held) == 0 {
+		return nil, nil
+	}
+	if err := hc.saveStash(stashCol); err != nil {
+		return nil, err
+	}
+	return held, nil
+}
+
+// saveStash writes a stash after entries were taken out of it. A named
+// stash left empty is deleted.
+func (hc *HostCollection) saveStash(stashCol *HostCollection) error {
+	if len(stashCol.Entries) == 0 && stashCol.File != hc.StashFilePath() {
+		if err := removeStash(stashCol.store(), stashCol.File); err != nil {
+			return fmt.Errorf("failed to remove empty stash: %w", err)
+		}
+		return nil
+	}
+	if err := stashCol.SaveToFile(stashCol.File); err != nil {
+		return fmt.Errorf("failed to save stash: %w", err)
+	}
+	return nil
+}
+
+// Resolutions for a stashed entry whose host now has a different key of the
+// same type in known_hosts.
+const (
+	// KeepCurrent leaves known_hosts alone; the entry stays in the stash.
+	KeepCurrent = "keep-current"
+	// SwapStashed restores the entry and stashes the current key in its
+	// place. Only the hosts the two entries share move to the stash.
+	SwapStashed = "swap"
+	// KeepBoth restores the entry next to the current key, leaving the host
+	// with two keys of one type.
+	KeepBoth = "keep-both"
+)
+
+// Resolutions lists the accepted conflict resolutions.
+var Resolutions = []string{KeepCurrent, SwapStashed, KeepBoth}
+
+// RestoreConflict is a stashed entry that would conflict with known_hosts
+// when restored.
+type RestoreConflict struct {
+	Stashed *Host
+	// Current lists the known_hosts entries carrying another key of the
+	// same type for one of the hosts of Stashed.
+	Current []*Host
+}
+
+// RestoreConflictError is returned when entries are restored without a
+// resolution and some of them conflict. It matches ErrConflict.
+type RestoreConflictError struct {
+	Conflicts []RestoreConflict
+}
+
+func (e *RestoreConflictError) Error() string {
+	c := e.Conflicts[0]
+	msg := fmt.Sprintf("%s: stashed %s key %s differs from the key on line %d of known_hosts",
+		ErrConflict, c.Stashed.Type, c.Stashed.Fingerprint(), c.Current[0].LineNumber)
+	if len(e.Conflicts) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Conflicts)-1)
+	}
+	return msg
+}
+
+func (e *RestoreConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// restoreConflicts finds the stashed entries whose hosts have a different
+// key of the same type in known_hosts. Marked lines are not host keys and
+// never conflict.
+func restoreConflicts(mainCol *HostCollection, stashed []*Host) []RestoreConflict {
+	conflicts := make([]RestoreConflict, 0)
+	for _, s := range stashed {
+		if s == nil || s.Marker != "" {
+			continue
+		}
+		current := make([]*Host, 0)
+		for _, c := range mainCol.Entries {
+			if c.Marker == "" && c.Type == s.Type && c.Key != s.Key && len(sharedAddresses(s, c)) > 0 {
+				current = append(current, c)
+			}
+		}
+		if len(current) > 0 {
+			conflicts = append(conflicts, RestoreConflict{Stashed: s, Current: current})
+		}
+	}
+	return conflicts
+}
+
+// sharedAddresses returns the addresses of c, as written in c, naming a host
+// that s lists too. Hashed names are compared through the plaintext names of
+// the other entry, or literally.
+func sharedAddresses(s, c *Host) []string {
+	shared := make([]string, 0)
+	for _, a := range c.Addresses {
+		if strings.HasPrefix(a, "!") {
+			continue
+		}
+		if strings.HasPrefix(a, "|") {
+			for _, name := range s.Addresses {
+				if name == a || !strings.HasPrefix(name, "|") && matchHashed(a, CanonicalHostname(name)) {
+					shared = append(shared, a)
+					break
+				}
+			}
+			continue
+		}
+		if s.HasAddress(a) {
+			shared = append(shared, a)
+		}
+	}
+	return shared
+}
+
+// displace takes the hosts shared with the conflicting stashed entries out
+// of their current entries in mainCol and returns them as entries of their
+// own, ready to be stashed. Lines left without a host are removed.
+func displace(mainCol *HostCollection, conflicts []RestoreConflict) []*Host {
+	displaced := make([]*Host, 0)
+	drop := make([]*Host, 0)
+	for _, rc := range conflicts {
+		for _, c := range rc.Current {
+			if containsHost(drop, c) {
+				continue
+			}
+			shared := sharedAddresses(rc.Stashed, c)
+			if len(shared) == 0 {
+				continue
+			}
+			if len(shared) == len(c.Addresses) {
+				displaced = append(displaced, c)
+				drop = append(drop, c)
+				continue
+			}
+			part := *c
+			part.Meta = c.Meta.Clone()
+			part.setAddresses(shared)
+			displaced = append(displaced, &part)
+
+			kept := make([]string, 0, len(c.Addresses))
+			for _, a := range c.Addresses {
+				if !containsString(shared, a) {
+					kept = append(kept, a)
+				}
+			}
+			c.setAddresses(kept)
+		}
+	}
+	mainCol.RemoveEntries(drop)
+	mainCol.reindex()
+	return displaced
+}
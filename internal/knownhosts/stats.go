@@ -0,0 +1,138 @@
+package knownhosts
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// Stats summarizes a collection and its stash file.
+type Stats struct {
+	Entries int `json:"entries"`
+	// Hosts is the number of distinct host fields.
+	Hosts int `json:"hosts"`
+	// MultiKeyHosts counts host fields with more than one key.
+	MultiKeyHosts int     `json:"multi_key_hosts"`
+	Hashed        int     `json:"hashed"`
+	Plain         int     `json:"plain"`
+	HashedRatio   float64 `json:"hashed_ratio"`
+	// Types counts entries per key type.
+	Types map[string]int `json:"types"`
+	// Markers counts entries per marker; unmarked entries are not counted.
+	Markers    map[string]int `json:"markers"`
+	Duplicates int            `json:"duplicates"`
+	Conflicts  int            `json:"conflicts"`
+	// IPAddresses, DNSNames and Patterns count the plaintext addresses by
+	// kind; Patterns are wildcards and negations.
+	IPAddresses int `json:"ip_addresses"`
+	DNSNames    int `json:"dns_names"`
+	Patterns    int `json:"patterns"`
+	// Domains counts entries per domain suffix (the last two labels of
+	// their DNS names and patterns).
+	Domains map[string]int `json:"domains"`
+	// StashEntries is the number of entries in the default and the named
+	// stashes.
+	StashEntries int `json:"stash_entries"`
+}
+
+// Count is one row of a breakdown such as Stats.Types.
+type Count struct {
+	Name  string
+	Count int
+}
+
+// SortCounts returns the rows of a breakdown, largest first.
+func SortCounts(m map[string]int) []Count {
+	counts := make([]Count, 0, len(m))
+	for name, n := range m {
+		counts = append(counts, Count{Name: name, Count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	return counts
+}
+
+// Stats computes the summary of the collection. The stashes next to the
+// known_hosts file are read through the collection's store; missing stashes
+// count as empty.
+func (hc *HostCollection) Stats() (Stats, error) {
+	s := Stats{
+		Entries: len(hc.Entries),
+		Types:   make(map[string]int),
+		Markers: make(map[string]int),
+		Domains: make(map[string]int),
+	}
+
+	for _, g := range GroupEntries(hc.Entries) {
+		s.Hosts++
+		if len(g.Entries) > 1 {
+			s.MultiKeyHosts++
+		}
+	}
+
+	for _, h := range hc.Entries {
+		s.Types[h.Type]++
+		if h.Marker != "" {
+			s.Markers[h.Marker]++
+		}
+		if h.IsHashed {
+			s.Hashed++
+			continue
+		}
+		s.Plain++
+
+		domains := make(map[string]bool)
+		for _, a := range h.Addresses {
+			host := addressHost(strings.TrimPrefix(a, "!"))
+			switch {
+			case strings.ContainsAny(a, "*?!"):
+				s.Patterns++
+			case net.ParseIP(host) != nil:
+				s.IPAddresses++
+				continue
+			default:
+				s.DNSNames++
+			}
+			if suffix := domainSuffix(host); suffix != "" {
+				domains[suffix] = true
+			}
+		}
+		for suffix := range domains {
+			s.Domains[suffix]++
+		}
+	}
+	if s.Entries > 0 {
+		s.HashedRatio = float64(s.Hashed) / float64(s.Entries)
+	}
+
+	s.Duplicates = len(hc.Duplicates())
+	s.Conflicts = len(hc.Conflicts())
+
+	stashes, err := hc.Stashes()
+	if err != nil {
+		return s, err
+	}
+	for _, st := range stashes {
+		s.StashEntries += st.Entries
+	}
+
+	return s, nil
+}
+
+// domainSuffix returns the last two labels of a host name, or "" for names
+// without a dot and patterns without a literal suffix such as "*.example".
+func domainSuffix(host string) string {
+	labels := strings.Split(strings.ToLower(host), ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	suffix := strings.Join(labels[len(labels)-2:], ".")
+	if strings.ContainsAny(suffix, "*?") {
+		return ""
+	}
+	return suffix
+}
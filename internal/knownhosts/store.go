@@ -0,0 +1,168 @@
+package knownhosts
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/FlameInTheDark/khm/internal/diff"
+)
+
+// Store reads and writes the files touched by collection operations.
+// DiskStore writes straight to disk; DryRunStore keeps every change in
+// memory so it can be reviewed as a diff without touching the files.
+type Store interface {
+	ReadFile(path string) ([]byte, error)
+	// WriteFile replaces the file content. When backup is true the current
+	// content is copied to path+".backup" first.
+	WriteFile(path string, data []byte, backup bool) error
+	// Remove deletes the file. A missing file is not an error.
+	Remove(path string) error
+}
+
+// DiskStore is the default Store operating on the real filesystem.
+type DiskStore struct{}
+
+func (DiskStore) ReadFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (DiskStore) WriteFile(path string, data []byte, backup bool) error {
+	if backup {
+		// Only fail if the source file exists and backup truly fails.
+		if err := CopyFile(path, path+".backup"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to create backup: %w", err)
+		}
+	}
+	// Named stashes live in a directory that may not exist yet.
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
+
+func (DiskStore) Remove(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+	return nil
+}
+
+// DryRunStore records writes in memory. Reads see earlier writes, so a
+// multi-step operation behaves exactly as it would on disk.
+type DryRunStore struct {
+	files map[string]*dryRunFile
+	order []string
+}
+
+type dryRunFile struct {
+	original []byte
+	existed  bool
+	current  []byte
+	removed  bool
+}
+
+func NewDryRunStore() *DryRunStore {
+	return &DryRunStore{files: make(map[string]*dryRunFile)}
+}
+
+func (s *DryRunStore) ReadFile(path string) ([]byte, error) {
+	if f, ok := s.files[path]; ok {
+		if f.removed {
+			return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+		}
+		return append([]byte(nil), f.current...), nil
+	}
+	return os.ReadFile(path)
+}
+
+func (s *DryRunStore) WriteFile(path string, data []byte, _ bool) error {
+	f, err := s.file(path)
+	if err != nil {
+		return err
+	}
+	f.current = append([]byte(nil), data...)
+	f.removed = false
+	return nil
+}
+
+func (s *DryRunStore) Remove(path string) error {
+	f, err := s.file(path)
+	if err != nil {
+		return err
+	}
+	f.current = nil
+	f.removed = true
+	return nil
+}
+
+// file returns the record of path, reading its original content on first
+// use.
+func (s *DryRunStore) file(path string) (*dryRunFile, error) {
+	if f, ok := s.files[path]; ok {
+		return f, nil
+	}
+	f := &dryRunFile{}
+	original, err := os.ReadFile(path)
+	if err == nil {
+		f.original = original
+		f.existed = true
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.files[path] = f
+	s.order = append(s.order, path)
+	return f, nil
+}
+
+// Changed reports whether any recorded write differs from the file on disk.
+func (s *DryRunStore) Changed() bool {
+	for _, path := range s.order {
+		f := s.files[path]
+		if f.removed {
+			if f.existed {
+				return true
+			}
+			continue
+		}
+		if !f.existed || !bytes.Equal(f.original, f.current) {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff renders the pending changes of every written file as a unified diff,
+// in the order the files were first written.
+func (s *DryRunStore) Diff() string {
+	var out strings.Builder
+	for _, path := range s.order {
+		f := s.files[path]
+		if f.removed && !f.existed || !f.removed && f.existed && bytes.Equal(f.original, f.current) {
+			continue
+		}
+		oldName, newName := path, path
+		if !f.existed {
+			oldName = "/dev/null"
+		}
+		if f.removed {
+			newName = "/dev/null"
+		}
+		out.WriteString(diff.Unified(oldName, newName, splitLines(f.original), splitLines(f.current)))
+	}
+	return out.String()
+}
+
+func splitLines(data []byte) []string {
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
@@ -0,0 +1,42 @@
+package knownhosts
+
+import "time"
+
+// ExpiredEntries returns the entries whose metadata expiry (see
+// Metadata.ExpiresAt) is not after now, in file order.
+func (hc *HostCollection) ExpiredEntries(now time.Time) []*Host {
+	out := make([]*Host, 0)
+	for _, h := range hc.Entries {
+		if h.Meta.Expired(now) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// UnseenIPEntries returns the entries listing only literal IP addresses that
+// were last seen (see Metadata.LastSeen) before cutoff. Such entries pile up
+// for short-lived instances whose addresses are reused. Entries without a
+// recorded time are left out, since their age is unknown.
+func (hc *HostCollection) UnseenIPEntries(cutoff time.Time) []*Host {
+	out := make([]*Host, 0)
+	for _, h := range hc.Entries {
+		if h.IsHashed || len(h.Addresses) == 0 {
+			continue
+		}
+		onlyIPs := true
+		for _, a := range h.Addresses {
+			if addressIP(a) == nil {
+				onlyIPs = false
+				break
+			}
+		}
+		if !onlyIPs {
+			continue
+		}
+		if seen := h.Meta.LastSeen(); seen != nil && seen.Before(cutoff) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
@@ -0,0 +1,62 @@
+package knownhosts
+
+import "time"
+
+// HostView is a flat, read-only projection of a Host used for templated and
+// machine-readable output. Field names are part of the --format contract, so
+// only add fields; never rename or remove them.
+type HostView struct {
+	// Address is the first address of the entry, or the hash for hashed entries.
+	Address string `json:"address"`
+	// Addresses lists every address of the entry in file order.
+	Addresses []string `json:"addresses"`
+	// Marker is "cert-authority", "revoked" or empty.
+	Marker string `json:"marker,omitempty"`
+	// Type is the key algorithm, e.g. "ssh-ed25519".
+	Type string `json:"type"`
+	// Key is the base64 encoded public key blob.
+	Key string `json:"key"`
+	// Comment is the trailing free-form comment, if any.
+	Comment string `json:"comment,omitempty"`
+	// Fingerprint is the SHA256 fingerprint of Key.
+	Fingerprint string `json:"fingerprint"`
+	// Hashed is true for entries with a hashed host field.
+	Hashed bool `json:"hashed"`
+	// Line is the line number in File the entry was read from.
+	Line int `json:"line"`
+	// File is the known_hosts file the entry belongs to.
+	File string `json:"file"`
+	// Tags, Owner and Note come from the entry's metadata.
+	Tags  []string `json:"tags,omitempty"`
+	Owner string   `json:"owner,omitempty"`
+	Note  string   `json:"note,omitempty"`
+	// Expires is set for temporary entries (khm add --ttl).
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// View returns the HostView for the entry. file is recorded as-is.
+func (h *Host) View(file string) HostView {
+	v := HostView{
+		Addresses:   append([]string(nil), h.Addresses...),
+		Marker:      h.Marker,
+		Type:        h.Type,
+		Key:         h.Key,
+		Comment:     h.Comment,
+		Fingerprint: h.Fingerprint(),
+		Hashed:      h.IsHashed,
+		Line:        h.LineNumber,
+		File:        file,
+	}
+	if h.IsHashed && h.HashValue != "" {
+		v.Address = h.HashValue
+	} else if len(h.Addresses) > 0 {
+		v.Address = h.Addresses[0]
+	}
+	if h.Meta != nil {
+		v.Tags = append([]string(nil), h.Meta.Tags...)
+		v.Owner = h.Meta.Owner
+		v.Note = h.Meta.Note
+		v.Expires = h.Meta.ExpiresAt
+	}
+	return v
+}
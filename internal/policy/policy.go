@@ -0,0 +1,336 @@
+// Package policy evaluates declarative rules for shared known_hosts files.
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+)
+
+// Policy is the content of a policy file. Each rule is enabled by being
+// present; every rule has its own severity.
+//
+//	rules:
+//	  hashing:
+//	    mode: consistent        # hashed, plain or consistent
+//	  key-types:
+//	    allow: [ssh-ed25519, ecdsa-sha2-nistp256]
+//	  wildcards:
+//	    allow: ["*.corp.example"]
+//	    severity: warning
+//	  owner-comment:
+//	    pattern: 'owner=\S+'
+type Policy struct {
+	Rules Rules `yaml:"rules"`
+}
+
+// Rules lists the supported rules.
+type Rules struct {
+	Hashing      *HashingRule      `yaml:"hashing"`
+	KeyTypes     *KeyTypesRule     `yaml:"key-types"`
+	WeakKeys     *WeakKeysRule     `yaml:"weak-keys"`
+	Wildcards    *WildcardsRule    `yaml:"wildcards"`
+	OwnerComment *OwnerCommentRule `yaml:"owner-comment"`
+}
+
+// HashingRule requires every entry to be hashed ("hashed"), none to be
+// ("plain"), or all entries to follow the majority ("consistent").
+type HashingRule struct {
+	Mode     string `yaml:"mode"`
+	Severity string `yaml:"severity"`
+}
+
+// KeyTypesRule restricts the key algorithms.
+type KeyTypesRule struct {
+	Allow    []string `yaml:"allow"`
+	Severity string   `yaml:"severity"`
+}
+
+// WeakKeysRule applies the checks of `khm audit keys`. Their own
+// severities are kept unless Severity is set.
+type WeakKeysRule struct {
+	MinRSABits int      `yaml:"min-rsa-bits"`
+	Deny       []string `yaml:"deny"`
+	WeakCurves []string `yaml:"weak-curves"`
+	Severity   string   `yaml:"severity"`
+}
+
+// WildcardsRule limits wildcard host patterns to the scopes in Allow, which
+// are globs themselves: "*.corp.example" admits "web*.corp.example".
+type WildcardsRule struct {
+	Allow    []string `yaml:"allow"`
+	Severity string   `yaml:"severity"`
+}
+
+// OwnerCommentRule requires a comment matching Pattern, or any comment when
+// Pattern is empty.
+type OwnerCommentRule struct {
+	Pattern  string `yaml:"pattern"`
+	Severity string `yaml:"severity"`
+}
+
+// RuleDescriptions documents the rule identifiers used in findings.
+var RuleDescriptions = map[string]string{
+	"hashing":       "Entries must follow the hashing policy",
+	"key-types":     "Key algorithm must be on the allow list",
+	"weak-keys":     "Key must not be weak or deprecated",
+	"wildcards":     "Wildcard patterns must stay within the allowed scopes",
+	"owner-comment": "Entry must carry an owner comment",
+}
+
+// Load reads and validates a YAML policy file. Unknown fields are errors so
+// that misspelled rules do not pass silently.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy: %w", err)
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates a YAML policy.
+func Parse(data []byte) (*Policy, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	var p Policy
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	r := p.Rules
+	severities := map[string]string{}
+	if r.Hashing != nil {
+		switch r.Hashing.Mode {
+		case "hashed", "plain", "consistent":
+		default:
+			return fmt.Errorf("hashing: unknown mode %q: expected hashed, plain or consistent", r.Hashing.Mode)
+		}
+		severities["hashing"] = r.Hashing.Severity
+	}
+	if r.KeyTypes != nil {
+		if len(r.KeyTypes.Allow) == 0 {
+			return fmt.Errorf("key-types: allow must list at least one algorithm")
+		}
+		severities["key-types"] = r.KeyTypes.Severity
+	}
+	if r.WeakKeys != nil {
+		severities["weak-keys"] = r.WeakKeys.Severity
+	}
+	if r.Wildcards != nil {
+		severities["wildcards"] = r.Wildcards.Severity
+	}
+	if r.OwnerComment != nil {
+		if _, err := regexp.Compile(r.OwnerComment.Pattern); err != nil {
+			return fmt.Errorf("owner-comment: invalid pattern: %w", err)
+		}
+		severities["owner-comment"] = r.OwnerComment.Severity
+	}
+	for rule, sev := range severities {
+		if sev == "" {
+			continue
+		}
+		if _, err := knownhosts.ParseSeverity(sev); err != nil {
+			return fmt.Errorf("%s: %w", rule, err)
+		}
+	}
+	return nil
+}
+
+// severity returns the configured severity, or def when none is set.
+func severity(configured string, def knownhosts.Severity) knownhosts.Severity {
+	if configured == "" {
+		return def
+	}
+	sev, _ := knownhosts.ParseSeverity(configured)
+	return sev
+}
+
+// Check evaluates the policy against entries and returns the violations
+// ordered by file and line. @revoked entries are exempt from the key-types
+// and weak-keys rules. Entries whose comment contains "khm:ignore" are
+// skipped entirely; "khm:ignore=rule1,rule2" skips only the named rules.
+func (p *Policy) Check(entries []*knownhosts.Host) []knownhosts.Finding {
+	findings := make([]knownhosts.Finding, 0)
+	add := func(h *knownhosts.Host, rule string, sev knownhosts.Severity, format string, args ...interface{}) {
+		if ignored(h, rule) {
+			return
+		}
+		findings = append(findings, knownhosts.Finding{
+			Rule:     rule,
+			Severity: sev,
+			Message:  fmt.Sprintf(format, args...),
+			Entry:    h,
+		})
+	}
+
+	r := p.Rules
+	if r.Hashing != nil {
+		sev := severity(r.Hashing.Severity, knownhosts.SeverityError)
+		mode := r.Hashing.Mode
+		if mode == "consistent" {
+			mode = majorityHashing(entries)
+		}
+		for _, h := range entries {
+			switch {
+			case mode == "hashed" && !h.IsHashed:
+				add(h, "hashing", sev, "entry is not hashed")
+			case mode == "plain" && h.IsHashed:
+				add(h, "hashing", sev, "entry is hashed")
+			}
+		}
+	}
+
+	if r.KeyTypes != nil {
+		sev := severity(r.KeyTypes.Severity, knownhosts.SeverityError)
+		for _, h := range entries {
+			if h.Marker != "revoked" && !contains(r.KeyTypes.Allow, h.Type) {
+				add(h, "key-types", sev, "%s is not an allowed key type", h.Type)
+			}
+		}
+	}
+
+	if r.WeakKeys != nil {
+		rules := knownhosts.DefaultKeyRules()
+		if r.WeakKeys.MinRSABits > 0 {
+			rules.MinRSABits = r.WeakKeys.MinRSABits
+		}
+		if r.WeakKeys.Deny != nil {
+			rules.Deny = r.WeakKeys.Deny
+		}
+		rules.WeakCurves = r.WeakKeys.WeakCurves
+		for _, f := range knownhosts.AuditKeys(trusted(entries), rules) {
+			add(f.Entry, "weak-keys", severity(r.WeakKeys.Severity, f.Severity), "%s", f.Message)
+		}
+	}
+
+	if r.Wildcards != nil {
+		sev := severity(r.Wildcards.Severity, knownhosts.SeverityError)
+		for _, h := range entries {
+			if h.IsHashed {
+				continue
+			}
+			for _, a := range h.Addresses {
+				// A negated pattern only narrows what the line trusts.
+				if strings.HasPrefix(a, "!") || !strings.ContainsAny(a, "*?") {
+					continue
+				}
+				if !withinScope(r.Wildcards.Allow, a) {
+					add(h, "wildcards", sev, "wildcard %s is outside the allowed scopes", a)
+				}
+			}
+		}
+	}
+
+	if r.OwnerComment != nil {
+		sev := severity(r.OwnerComment.Severity, knownhosts.SeverityError)
+		re := regexp.MustCompile(r.OwnerComment.Pattern)
+		for _, h := range entries {
+			comment := stripIgnores(h.Comment)
+			switch {
+			case comment == "":
+				add(h, "owner-comment", sev, "entry has no owner comment")
+			case r.OwnerComment.Pattern != "" && !re.MatchString(comment):
+				add(h, "owner-comment", sev, "comment %q does not match %s", comment, r.OwnerComment.Pattern)
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i].Entry, findings[j].Entry
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.LineNumber < b.LineNumber
+	})
+	return findings
+}
+
+// trusted drops @revoked entries, whose keys are never accepted anyway.
+func trusted(entries []*knownhosts.Host) []*knownhosts.Host {
+	out := make([]*knownhosts.Host, 0, len(entries))
+	for _, h := range entries {
+		if h.Marker != "revoked" {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// majorityHashing returns "hashed" when most entries are hashed, "plain"
+// otherwise.
+func majorityHashing(entries []*knownhosts.Host) string {
+	hashed := 0
+	for _, h := range entries {
+		if h.IsHashed {
+			hashed++
+		}
+	}
+	if hashed*2 > len(entries) {
+		return "hashed"
+	}
+	return "plain"
+}
+
+// withinScope reports whether every host matched by pattern is also matched
+// by one of the allowed globs.
+func withinScope(allow []string, pattern string) bool {
+	for _, scope := range allow {
+		if knownhosts.GlobMatch(strings.ToLower(scope), strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+const ignoreToken = "khm:ignore"
+
+// ignored reports whether the comment of h suppresses rule.
+func ignored(h *knownhosts.Host, rule string) bool {
+	for _, field := range strings.Fields(h.Comment) {
+		if field == ignoreToken {
+			return true
+		}
+		if list, ok := strings.CutPrefix(field, ignoreToken+"="); ok {
+			for _, r := range strings.Split(list, ",") {
+				if r == rule {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// stripIgnores removes ignore directives from a comment.
+func stripIgnores(comment string) string {
+	kept := make([]string, 0)
+	for _, field := range strings.Fields(comment) {
+		if field != ignoreToken && !strings.HasPrefix(field, ignoreToken+"=") {
+			kept = append(kept, field)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
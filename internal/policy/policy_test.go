@@ -0,0 +1,71 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+)
+
+const testKey = "AAAAC3NzaC1lZDI1NTE5AAAAII7jVCgTq4EdeprUZrIhZwsquWp8zSVCpri96XpI2/Dw"
+
+// parseEntries parses known_hosts lines through a temporary file.
+func parseEntries(t *testing.T, lines []string) []*knownhosts.Host {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hc, err := knownhosts.ParseKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hc.Entries
+}
+
+func TestWildcardsRule(t *testing.T) {
+	p, err := Parse([]byte("rules:\n  wildcards:\n    allow: [\"*.corp.example\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		hosts   string
+		comment string
+		// flagged lists the addresses reported, in order.
+		flagged []string
+	}{
+		{"no wildcard", "web1.example", "", nil},
+		{"within scope", "web*.corp.example", "", nil},
+		{"scope itself", "*.corp.example", "", nil},
+		{"outside scope", "*.example", "", []string{"*.example"}},
+		{"question mark", "web?.example", "", []string{"web?.example"}},
+		{"negated exclusion", "*.corp.example,!*.test", "", nil},
+		{"negated outside scope", "web1.example,!db*.example", "", nil},
+		{"negation does not excuse others", "*.example,!*.test", "", []string{"*.example"}},
+		{"ignored", "*.example", "khm:ignore=wildcards", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := strings.TrimSpace(tt.hosts + " ssh-ed25519 " + testKey + " " + tt.comment)
+			var flagged []string
+			for _, f := range p.Check(parseEntries(t, []string{line})) {
+				if f.Rule != "wildcards" {
+					continue
+				}
+				if f.Severity != knownhosts.SeverityError {
+					t.Errorf("severity %q, want %q", f.Severity, knownhosts.SeverityError)
+				}
+				flagged = append(flagged, strings.Fields(strings.TrimPrefix(f.Message, "wildcard "))[0])
+			}
+			if !slices.Equal(flagged, tt.flagged) {
+				t.Errorf("flagged %v, want %v", flagged, tt.flagged)
+			}
+		})
+	}
+}
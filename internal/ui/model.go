@@ -1,11 +1,13 @@
 package ui
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/bubbles/list"
 	"github.com/charmbracelet/bubbles/textinput"
@@ -23,31 +25,117 @@ type Model struct {
 
 	filterText string
 
+	// groupBy selects what one list item stands for: "host" (a host field)
+	// or "key" (every entry carrying one key blob). The section modes of
+	// knownhosts.SectionFields list host items under collapsible headers;
+	// collapsed holds the folded sections as groupBy + ":" + name.
+	groupBy   string
+	collapsed map[string]bool
+
 	showFilter    bool
 	showStash     bool
 	showConfirm   bool
 	showHelp      bool
 	showDetails   bool
 	showStashView bool
+	showAlias     bool
+	showResolve   bool
+	showRestore   bool
+	showStats     bool
 
 	moveTarget textinput.Model
+	aliasInput textinput.Model
 
 	selectedHost       string
 	selectedIndex      int
 	baseKnownHostsPath string
 
+	// detailKey is the key chosen in the details view; s and r act on it.
+	detailKey int
+	// timeline is the key history of the host shown in the details view.
+	timeline []knownhosts.KeyEvent
+
+	// stats is the summary shown by the statistics screen, computed when
+	// it is opened; statsErr is the error computing it.
+	stats    knownhosts.Stats
+	statsErr error
+
+	// totalItems is the number of list items before filtering, shownItems
+	// the number after it. Section headers are not counted.
+	totalItems int
+	shownItems int
+
+	// conflicts are the knownhosts.Conflicts of the collection and
+	// conflicted marks their entries; resolving is the conflict shown by
+	// the key chooser. Like findings and keyGroups they are computed by
+	// analyze when the collection changes, not on every list refresh.
+	conflicts  []knownhosts.Conflict
+	conflicted map[*knownhosts.Host]bool
+	resolving  knownhosts.Conflict
+	// keyGroups caches knownhosts.GroupByKey for the "key" grouping; nil
+	// until that grouping is shown.
+	keyGroups []knownhosts.KeyGroup
+
+	// restoring holds the stash entries waiting for a conflict resolution
+	// and restoreConflicts what they conflict with.
+	restoring        []*knownhosts.Host
+	restoreConflicts []knownhosts.RestoreConflict
+	// restoredTo lists the files the last restore wrote to.
+	restoredTo []string
+
+	// findings holds the weak key audit results of each entry.
+	findings map[*knownhosts.Host][]knownhosts.Finding
+
 	status string
 	width  int
 	height int
 }
 
+// hostItem is one list row: the entries sharing the host field addressLabel.
 type hostItem struct {
 	addressLabel string
 
 	hosts []*knownhosts.Host
+
+	// conflict is set when one of hosts has a different key of the same
+	// type listed elsewhere for one of its addresses.
+	conflict bool
+
+	// keyHosts is set for items of the "key" grouping: the number of
+	// distinct hosts carrying the key.
+	keyHosts int
+
+	// weak is the most severe key audit finding of hosts, if any.
+	weak knownhosts.Severity
+
+	// section is set for section headers: hosts then holds every shown
+	// entry of the section so that stash and delete act on the group.
+	// nested marks the host items listed under a header.
+	section   string
+	collapsed bool
+	groups    int
+	nested    bool
 }
 
+// groupModes is the order in which v cycles through the groupings.
+var groupModes = append([]string{"host", "key"}, knownhosts.SectionFields...)
+
 func (i hostItem) Title() string {
+	if i.section != "" {
+		arrow := "▾"
+		if i.collapsed {
+			arrow = "▸"
+		}
+		return fmt.Sprintf("%s %s  (%d %s, %d %s)", arrow, i.addressLabel,
+			i.groups, plural(i.groups, "host", "hosts"), len(i.hosts), plural(len(i.hosts), "key", "keys"))
+	}
+	if i.nested {
+		return "  " + i.title()
+	}
+	return i.title()
+}
+
+func (i hostItem) title() string {
 
 	if len(i.hosts) == 0 {
 
@@ -57,6 +145,22 @@ func (i hostItem) Title() string {
 
 	host := i.hosts[0]
 
+	// Key groups: show type and fingerprint with the number of hosts
+	if i.keyHosts > 0 {
+		title := fmt.Sprintf("%s (%d host", i.addressLabel, i.keyHosts)
+		if i.keyHosts > 1 {
+			title += "s"
+		}
+		title += ")"
+		if i.keyHosts > 1 && host.Marker == "" {
+			title += " ! shared"
+		}
+		if i.weak.Rank() >= knownhosts.SeverityWarning.Rank() {
+			title += " ! weak"
+		}
+		return title + expiryFlag(i.hosts)
+	}
+
 	// Hashed hosts: show a hash prefix
 	if host.IsHashed && host.HashValue != "" {
 		title := host.HashValue
@@ -72,8 +176,14 @@ func (i hostItem) Title() string {
 		if len(i.hosts) > 1 {
 			title += fmt.Sprintf(" (%d keys)", len(i.hosts))
 		}
+		if i.conflict {
+			title += " ! conflict"
+		}
+		if i.weak.Rank() >= knownhosts.SeverityWarning.Rank() {
+			title += " ! weak"
+		}
 
-		return title
+		return title + expiryFlag(i.hosts)
 	}
 
 	// Regular hosts: show first address
@@ -94,11 +204,47 @@ func (i hostItem) Title() string {
 	if len(i.hosts) > 1 {
 		title += fmt.Sprintf(" (%d keys)", len(i.hosts))
 	}
+	if i.conflict {
+		title += " ! conflict"
+	}
+	if i.weak.Rank() >= knownhosts.SeverityWarning.Rank() {
+		title += " ! weak"
+	}
 
-	return title
+	return title + expiryFlag(i.hosts)
+}
+
+// expiryFlag marks items with temporary entries (khm add --ttl) with the
+// time left until the first of them expires, or "! expired".
+func expiryFlag(hosts []*knownhosts.Host) string {
+	var first *knownhosts.Metadata
+	for _, h := range hosts {
+		if h != nil && h.Meta != nil && h.Meta.ExpiresAt != nil &&
+			(first == nil || h.Meta.ExpiresAt.Before(*first.ExpiresAt)) {
+			first = h.Meta
+		}
+	}
+	if first == nil {
+		return ""
+	}
+	now := time.Now()
+	if first.Expired(now) {
+		return " ! expired"
+	}
+	return " ⏳ " + first.Remaining(now)
 }
 
 func (i hostItem) Description() string {
+	if i.section != "" {
+		return "  " + collectTypes(i.hosts)
+	}
+	if desc := i.description(); i.nested && desc != "" {
+		return "  " + desc
+	}
+	return i.description()
+}
+
+func (i hostItem) description() string {
 
 	if len(i.hosts) == 0 {
 
@@ -108,6 +254,28 @@ func (i hostItem) Description() string {
 
 	host := i.hosts[0]
 
+	// Key groups list the hosts carrying the key
+	if i.keyHosts > 0 {
+		fields := make([]string, 0, len(i.hosts))
+		for _, h := range i.hosts {
+			field := h.HostField()
+			if h.IsHashed && len(field) > 20 {
+				field = field[:20] + "..."
+			}
+			fields = append(fields, field)
+		}
+		return strings.Join(fields, ", ")
+	}
+
+	// Stashed entries say who stashed them, when and why.
+	if host.Meta != nil && host.Meta.Stash != nil {
+		desc := "stashed " + host.Meta.Stash.Summary()
+		if host.Comment != "" {
+			desc = host.Comment + " | " + desc
+		}
+		return desc
+	}
+
 	// Keep description minimal so that the list title carries the important info.
 	// Only show comment here if present.
 	if host.Comment != "" {
@@ -127,6 +295,13 @@ func (i hostItem) FilterValue() string {
 	return i.addressLabel
 }
 
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
 func collectTypes(hosts []*knownhosts.Host) string {
 	if len(hosts) == 0 {
 		return ""
@@ -147,38 +322,6 @@ func collectTypes(hosts []*knownhosts.Host) string {
 
 func NewModel(collection *knownhosts.HostCollection, version string) *Model {
 
-	items := make([]list.Item, 0)
-
-	// Build a stable list of unique address labels from the collection.
-	// HostCollection.Hosts maps address -> []*Host; we sort the keys for stability.
-	addresses := make([]string, 0, len(collection.Hosts))
-
-	for addr := range collection.Hosts {
-
-		addresses = append(addresses, addr)
-
-	}
-
-	sort.Strings(addresses)
-
-	for _, addr := range addresses {
-
-		hosts := collection.Hosts[addr]
-
-		if len(hosts) == 0 {
-			continue
-		}
-
-		// We treat each address key as a label pointing at its group of hosts.
-		items = append(items, hostItem{
-
-			addressLabel: addr,
-
-			hosts: hosts,
-		})
-
-	}
-
 	delegate := list.NewDefaultDelegate()
 	delegate.Styles.SelectedTitle = lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#111111")).
@@ -195,7 +338,7 @@ func NewModel(collection *knownhosts.HostCollection, version string) *Model {
 	// Reduce vertical gaps between items
 	delegate.SetSpacing(0)
 
-	listModel := list.New(items, delegate, 80, 20)
+	listModel := list.New(nil, delegate, 80, 20)
 	listModel.Title = "SSH Known Hosts Manager"
 	if version != "" {
 		listModel.Title += " " + version
@@ -218,7 +361,7 @@ func NewModel(collection *knownhosts.HostCollection, version string) *Model {
 		Padding(0, 1)
 
 	input := textinput.New()
-	input.Placeholder = "Type to filter • Enter to close • Esc to clear"
+	input.Placeholder = "Type to filter (e.g. type:ed25519 cidr:10.0.0.0/8) • Enter to close • Esc to clear"
 	input.CharLimit = 100
 	input.Width = 40
 
@@ -227,87 +370,177 @@ func NewModel(collection *knownhosts.HostCollection, version string) *Model {
 	moveTarget.CharLimit = 200
 	moveTarget.Width = 50
 
-	return &Model{
+	aliasInput := textinput.New()
+	aliasInput.Placeholder = "New alias, e.g. web1.corp or [10.0.0.5]:2222 (Enter to add, Esc to cancel)"
+	aliasInput.CharLimit = 200
+	aliasInput.Width = 50
+
+	m := &Model{
 		list:               listModel,
 		input:              input,
 		collection:         collection,
 		version:            version,
 		moveTarget:         moveTarget,
+		aliasInput:         aliasInput,
 		baseKnownHostsPath: collection.File,
+		groupBy:            "host",
+		collapsed:          make(map[string]bool),
 		status:             "Ready",
 	}
+	m.rebuildList()
+	return m
 }
 
 func (m Model) Init() tea.Cmd {
 	return nil
 }
 
+// rebuildList recomputes the analysis of the collection after it changed
+// and refreshes the list.
 func (m *Model) rebuildList() {
+	m.analyze()
+	m.refreshList()
+}
+
+// analyze computes the conflicts and key findings of the collection.
+func (m *Model) analyze() {
+	m.conflicts = m.collection.Conflicts()
+	m.conflicted = make(map[*knownhosts.Host]bool)
+	for _, c := range m.conflicts {
+		for _, h := range c.Entries {
+			m.conflicted[h] = true
+		}
+	}
+
+	m.findings = make(map[*knownhosts.Host][]knownhosts.Finding)
+	for _, f := range knownhosts.AuditKeys(m.collection.Entries, knownhosts.DefaultKeyRules()) {
+		m.findings[f.Entry] = append(m.findings[f.Entry], f)
+	}
+	m.keyGroups = nil
+}
+
+// refreshList rebuilds the list items for the current filter, grouping and
+// folded sections, reusing the analysis of the last rebuildList.
+func (m *Model) refreshList() {
 	// capture previous selection
 	prevIndex := m.list.Index()
-	prevLabel := ""
+	prevLabel, prevSection := "", ""
 	if sel := m.list.SelectedItem(); sel != nil {
 		if hi, ok := sel.(hostItem); ok {
-			prevLabel = hi.addressLabel
+			prevLabel, prevSection = hi.addressLabel, hi.section
 		}
 	}
 
 	items := make([]list.Item, 0)
-	filter := strings.ToLower(strings.TrimSpace(m.filterText))
-	terms := strings.Fields(filter)
 
-	matches := func(label string, hosts []*knownhosts.Host) bool {
-		if len(terms) == 0 {
-			return true
-		}
+	// The filter uses the same query language as `khm list --query`,
+	// e.g. "type:ed25519 cidr:10.1.0.0/16". Plain words are substring matches.
+	query, err := knownhosts.ParseQuery(m.filterText)
+	if err != nil {
+		m.status = fmt.Sprintf("Invalid filter: %v", err)
+		query = nil
+	}
 
-		// searchable fields: label, all addresses, type, comment, hash
-		fields := []string{strings.ToLower(label)}
+	matches := func(hosts []*knownhosts.Host) bool {
 		for _, h := range hosts {
-			for _, a := range h.Addresses {
-				fields = append(fields, strings.ToLower(a))
-			}
-			if h.Type != "" {
-				fields = append(fields, strings.ToLower(h.Type))
-			}
-			if h.Comment != "" {
-				fields = append(fields, strings.ToLower(h.Comment))
-			}
-			if h.IsHashed && h.HashValue != "" {
-				fields = append(fields, strings.ToLower(h.HashValue))
+			if query.Match(h) {
+				return true
 			}
 		}
+		return false
+	}
 
-		// all terms must match at least one field (AND of ORs)
-		for _, t := range terms {
-			found := false
-			for _, f := range fields {
-				if strings.Contains(f, t) {
-					found = true
-					break
+	weakest := func(hosts []*knownhosts.Host) knownhosts.Severity {
+		var worst knownhosts.Severity
+		for _, h := range hosts {
+			for _, f := range m.findings[h] {
+				if f.Severity.Rank() > worst.Rank() {
+					worst = f.Severity
 				}
 			}
-			if !found {
-				return false
+		}
+		return worst
+	}
+
+	// hostItems builds one item per host field: a line listing several
+	// aliases appears once, grouped with the other keys of exactly the same
+	// aliases.
+	hostItems := func(entries []*knownhosts.Host) (shown []hostItem, total int) {
+		groups := knownhosts.GroupEntries(entries)
+		for _, g := range groups {
+			if matches(g.Entries) {
+				conflict := false
+				for _, h := range g.Entries {
+					conflict = conflict || m.conflicted[h]
+				}
+				shown = append(shown, hostItem{
+					addressLabel: g.Label,
+					hosts:        g.Entries,
+					conflict:     conflict,
+					weak:         weakest(g.Entries),
+				})
 			}
 		}
-		return true
+		return shown, len(groups)
 	}
 
-	// stable ordering of labels
-	addresses := make([]string, 0, len(m.collection.Hosts))
-	for addr := range m.collection.Hosts {
-		addresses = append(addresses, addr)
-	}
-	sort.Strings(addresses)
+	switch m.groupBy {
+	case "host":
+		shown, total := hostItems(m.collection.Entries)
+		for _, it := range shown {
+			items = append(items, it)
+		}
+		m.totalItems, m.shownItems = total, len(shown)
+	case "key":
+		// One item per key blob, most widely shared first.
+		if m.keyGroups == nil {
+			m.keyGroups = knownhosts.GroupByKey(m.collection.Entries)
+		}
+		m.totalItems = len(m.keyGroups)
+		for _, g := range m.keyGroups {
+			if matches(g.Entries) {
+				items = append(items, hostItem{
+					addressLabel: g.Type + " " + g.Fingerprint(),
+					hosts:        g.Entries,
+					keyHosts:     g.Hosts,
+					weak:         weakest(g.Entries),
+				})
+			}
+		}
+		m.shownItems = len(items)
+	default:
+		// Host items under one collapsible header per section. Sections
+		// without matching hosts are left out.
+		sections, err := knownhosts.GroupBy(m.collection.Entries, m.groupBy)
+		if err != nil {
+			m.status = err.Error()
+		}
+		m.totalItems, m.shownItems = 0, 0
+		for _, sec := range sections {
+			shown, total := hostItems(sec.Entries)
+			m.totalItems += total
+			if len(shown) == 0 {
+				continue
+			}
+			m.shownItems += len(shown)
 
-	for _, addr := range addresses {
-		hosts := m.collection.Hosts[addr]
-		if matches(addr, hosts) {
-			items = append(items, hostItem{
-				addressLabel: addr,
-				hosts:        hosts,
-			})
+			header := hostItem{
+				addressLabel: m.groupBy + ": " + sec.Label,
+				section:      sec.Label,
+				collapsed:    m.collapsed[m.groupBy+":"+sec.Label],
+				groups:       len(shown),
+			}
+			for _, it := range shown {
+				header.hosts = append(header.hosts, it.hosts...)
+			}
+			items = append(items, header)
+			if header.collapsed {
+				continue
+			}
+			for _, it := range shown {
+				it.nested = true
+				items = append(items, it)
+			}
 		}
 	}
 
@@ -321,7 +554,7 @@ func (m *Model) rebuildList() {
 	// try to select previous label if still present
 	if prevLabel != "" {
 		for i, it := range items {
-			if hi, ok := it.(hostItem); ok && hi.addressLabel == prevLabel {
+			if hi, ok := it.(hostItem); ok && hi.addressLabel == prevLabel && hi.section == prevSection {
 				m.list.Select(i)
 				return
 			}
@@ -351,6 +584,9 @@ func (m *Model) updateListSize() {
 	if m.showStash {
 		reserved += 1
 	}
+	if m.showAlias {
+		reserved += 1
+	}
 	available := m.height - reserved
 	if available < 5 {
 		available = 5
@@ -379,18 +615,125 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.status = "Delete canceled"
 				m.updateListSize()
 				return m, nil
+			case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+				// Remove a single alias from a multi-address entry
+				aliases := m.selectedAliases()
+				n := int(msg.String()[0] - '0')
+				if n <= len(aliases) {
+					m.showConfirm = false
+					m.updateListSize()
+					return m, m.removeSelectedAlias(aliases[n-1])
+				}
+			}
+			return m, nil
+		}
+
+		// If the key chooser is open, 1-9 keep that key and Esc cancels
+		if m.showResolve {
+			switch msg.String() {
+			case "esc":
+				m.showResolve = false
+				m.status = "Conflict left unresolved"
+				m.updateListSize()
+			case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+				keys := m.resolving.Keys()
+				n := int(msg.String()[0] - '0')
+				if n <= len(keys) {
+					m.showResolve = false
+					m.updateListSize()
+					return m, m.resolveConflict(keys[n-1])
+				}
+			}
+			return m, nil
+		}
+
+		// If a restore conflicts with known_hosts, 1-3 pick a resolution
+		if m.showRestore {
+			resolutions := map[string]string{
+				"1": knownhosts.KeepCurrent,
+				"2": knownhosts.SwapStashed,
+				"3": knownhosts.KeepBoth,
+			}
+			switch msg.String() {
+			case "esc":
+				m.showRestore = false
+				m.restoring = nil
+				m.status = "Restore canceled"
+				m.updateListSize()
+			case "1", "2", "3":
+				m.showRestore = false
+				m.updateListSize()
+				return m, m.restorePending(resolutions[msg.String()])
+			}
+			return m, nil
+		}
+
+		// If the alias prompt is open, every key goes to it
+		if m.showAlias {
+			switch msg.String() {
+			case "enter":
+				m.showAlias = false
+				m.updateListSize()
+				return m, m.addSelectedAlias()
+			case "esc":
+				m.showAlias = false
+				m.aliasInput.SetValue("")
+				m.status = "Alias add canceled"
+				m.updateListSize()
+				return m, nil
+			}
+			var cmd tea.Cmd
+			m.aliasInput, cmd = m.aliasInput.Update(msg)
+			return m, cmd
+		}
+
+		// The statistics screen closes on i, Enter or Esc
+		if m.showStats {
+			switch msg.String() {
+			case "i", "enter", "esc":
+				m.showStats = false
+				m.status = "Closed statistics"
+				return m, nil
+			case "ctrl+c", "q":
+				return m, tea.Quit
 			}
 			return m, nil
 		}
 
-		// If details view is open, Enter/Esc toggle/close it without affecting list navigation
+		// If details view is open, Enter/Esc toggle/close it without affecting list navigation.
+		// Up/Down or 1-9 choose a key, which s stashes or r restores on its own.
 		if m.showDetails {
+			keys := m.detailKeys()
 			switch msg.String() {
 			case "enter", "esc":
 				m.showDetails = false
 				m.status = "Closed host details"
 				m.updateListSize()
 				return m, nil
+			case "up", "k":
+				if m.detailKey > 0 {
+					m.detailKey--
+				}
+			case "down", "j":
+				if m.detailKey < len(keys)-1 {
+					m.detailKey++
+				}
+			case "1", "2", "3", "4", "5", "6", "7", "8", "9":
+				if n := int(msg.String()[0] - '1'); n < len(keys) {
+					m.detailKey = n
+				}
+			case "s":
+				if !m.showStashView && m.detailKey < len(keys) {
+					m.showDetails = false
+					m.updateListSize()
+					return m, m.stashDetailKey(keys[m.detailKey])
+				}
+			case "r":
+				if m.showStashView && m.detailKey < len(keys) {
+					m.showDetails = false
+					m.updateListSize()
+					return m, m.restoreDetailKey(keys[m.detailKey])
+				}
 			}
 			// Ignore other keys while in details mode
 			return m, nil
@@ -413,7 +756,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if m.showFilter {
 				m.showFilter = false
 				m.filterText = m.input.Value()
-				m.rebuildList()
+				m.refreshList()
 				m.updateListSize()
 				return m, nil
 			} else if m.showStash {
@@ -421,14 +764,31 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.updateListSize()
 				return m, m.stashSelectedHost()
 			} else {
+				// Fold or unfold a section header
+				if hi, ok := m.list.SelectedItem().(hostItem); ok && hi.section != "" {
+					key := m.groupBy + ":" + hi.section
+					m.collapsed[key] = !m.collapsed[key]
+					m.refreshList()
+					return m, nil
+				}
+
 				// Toggle host details for the currently selected item
 				if m.list.SelectedItem() == nil || len(m.list.Items()) == 0 {
 					m.status = "No host selected"
 					return m, nil
 				}
 				m.showDetails = !m.showDetails
+				m.detailKey = 0
 				if m.showDetails {
 					m.status = "Showing host details (Enter/Esc to close)"
+					if len(m.detailKeys()) > 1 {
+						action := "s stashes"
+						if m.showStashView {
+							action = "r restores"
+						}
+						m.status = fmt.Sprintf("Showing host details: ↑/↓ or 1-9 choose a key, %s only that key", action)
+					}
+					m.loadTimeline()
 				} else {
 					m.status = "Closed host details"
 				}
@@ -455,6 +815,82 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				return m, textinput.Blink
 			}
 
+		case "a":
+			if !m.showFilter && !m.showStash && !m.showStashView {
+				if m.list.SelectedItem() == nil || len(m.list.Items()) == 0 {
+					m.status = "No host selected"
+					return m, nil
+				}
+				if hi, ok := m.list.SelectedItem().(hostItem); ok && hi.section != "" {
+					m.status = "Select a host to add an alias, not a group"
+					return m, nil
+				}
+				m.showAlias = true
+				m.aliasInput.SetValue("")
+				m.aliasInput.Focus()
+				m.updateListSize()
+				return m, textinput.Blink
+			}
+
+		case "x":
+			if !m.showFilter && !m.showStash && !m.showStashView {
+				return m, m.splitSelectedHost()
+			}
+
+		case "c":
+			if !m.showFilter && !m.showStash && !m.showStashView {
+				return m, m.consolidateSelectedHost()
+			}
+
+		case "p":
+			// Pick which key to keep for a conflicting host
+			if !m.showFilter && !m.showStash && !m.showStashView {
+				hi, ok := m.list.SelectedItem().(hostItem)
+				if !ok || !hi.conflict {
+					m.status = "Selected host has no conflicting keys"
+					return m, nil
+				}
+				c, ok := m.conflictFor(hi)
+				if !ok {
+					m.status = "Selected host has no conflicting keys"
+					return m, nil
+				}
+				m.resolving = c
+				m.showResolve = true
+				m.updateListSize()
+				return m, nil
+			}
+
+		case "i":
+			if !m.showFilter && !m.showStash && !m.showStashView {
+				m.stats, m.statsErr = m.collection.Stats()
+				m.showStats = true
+				m.status = "Showing statistics (i/Esc to close)"
+				return m, nil
+			}
+
+		case "v":
+			// Cycle through the groupings: host, key, tag, type, domain, file
+			if !m.showFilter && !m.showStash {
+				next := 0
+				for i, mode := range groupModes {
+					if mode == m.groupBy {
+						next = (i + 1) % len(groupModes)
+					}
+				}
+				m.groupBy = groupModes[next]
+				switch m.groupBy {
+				case "key":
+					m.status = "Grouped by key: hosts sharing a key are marked ! shared"
+				case "host":
+					m.status = "Grouped by host"
+				default:
+					m.status = fmt.Sprintf("Grouped by %s: Enter folds a section, s/d act on the whole section", m.groupBy)
+				}
+				m.refreshList()
+				return m, nil
+			}
+
 		case "t":
 			// Toggle stash view: show hosts from stash_hosts instead of known_hosts
 			if !m.showFilter && !m.showStash {
@@ -493,7 +929,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.input, cmd = m.input.Update(msg)
 			// live filtering as you type
 			m.filterText = m.input.Value()
-			m.rebuildList()
+			m.refreshList()
 			return m, cmd
 		} else if m.showStash {
 			var cmd tea.Cmd
@@ -512,7 +948,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.showFilter = false
 				m.input.SetValue("")
 				m.filterText = ""
-				m.rebuildList()
+				m.refreshList()
 				m.status = "Filter cleared"
 				m.updateListSize()
 				return m, nil
@@ -535,7 +971,7 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if strings.TrimSpace(m.filterText) != "" {
 				// allow clearing active filter even when prompt is closed
 				m.filterText = ""
-				m.rebuildList()
+				m.refreshList()
 				m.status = "Filter cleared"
 				return m, nil
 			}
@@ -580,6 +1016,12 @@ func (m Model) View() string {
 		view.WriteString(m.renderHelp())
 	} else if m.showConfirm {
 		view.WriteString(m.renderConfirm())
+	} else if m.showResolve {
+		view.WriteString(m.renderResolve())
+	} else if m.showRestore {
+		view.WriteString(m.renderRestoreConflicts())
+	} else if m.showStats {
+		view.WriteString(m.renderStats())
 	} else if m.showDetails {
 		view.WriteString(m.renderDetails())
 	} else if len(m.list.Items()) == 0 {
@@ -600,6 +1042,12 @@ func (m Model) View() string {
 		view.WriteString(m.renderStash())
 	}
 
+	// Alias input
+	if m.showAlias {
+		view.WriteString("\n")
+		view.WriteString(m.renderAlias())
+	}
+
 	padded := m.padToBottom(view.String())
 	return padded + "\n" + m.renderStatusBar()
 }
@@ -624,6 +1072,16 @@ func (m Model) renderStash() string {
 	return label + m.moveTarget.View()
 }
 
+func (m Model) renderAlias() string {
+	style := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#FAFAFA")).
+		Background(lipgloss.Color("#3C3C3C")).
+		Padding(0, 1)
+
+	label := style.Render("Add alias: ")
+	return label + m.aliasInput.View()
+}
+
 func (m Model) renderStatusBar() string {
 	style := lipgloss.NewStyle().
 		Background(lipgloss.Color("#3C3C3C")).
@@ -636,8 +1094,16 @@ func (m Model) renderStatusBar() string {
 		mode = "HELP"
 	case m.showConfirm:
 		mode = "CONFIRM DELETE"
+	case m.showResolve:
+		mode = "RESOLVE CONFLICT"
+	case m.showRestore:
+		mode = "RESTORE CONFLICT"
+	case m.showStats:
+		mode = "STATS"
 	case m.showStash:
 		mode = "STASH"
+	case m.showAlias:
+		mode = "ALIAS"
 	case m.showStashView:
 		mode = "STASH VIEW"
 	case m.showFilter:
@@ -648,8 +1114,8 @@ func (m Model) renderStatusBar() string {
 		mode = "BROWSE"
 	}
 
-	filtered := len(m.list.Items())
-	total := len(m.collection.Hosts)
+	filtered := m.shownItems
+	total := m.totalItems
 	var hints string
 	switch mode {
 	case "BROWSE":
@@ -658,12 +1124,23 @@ func (m Model) renderStatusBar() string {
 		hints = "[Enter close] [Esc clear]"
 	case "STASH":
 		hints = "[Enter confirm] [Esc cancel]"
+	case "ALIAS":
+		hints = "[Enter add] [Esc cancel]"
 	case "STASH VIEW":
 		hints = "[r restore] [t back] [Esc back]"
 	case "CONFIRM DELETE":
 		hints = "[Enter confirm] [Esc cancel]"
+	case "RESOLVE CONFLICT":
+		hints = "[1-9 keep key] [Esc cancel]"
+	case "RESTORE CONFLICT":
+		hints = "[1-3 resolve] [Esc cancel]"
 	case "DETAILS":
-		hints = "[Enter/Esc close]"
+		hints = "[↑/↓ key] [s stash key] [Enter/Esc close]"
+		if m.showStashView {
+			hints = "[↑/↓ key] [r restore key] [Enter/Esc close]"
+		}
+	case "STATS":
+		hints = "[i/Esc close]"
 	case "HELP":
 		hints = "[Esc close]"
 	}
@@ -675,14 +1152,19 @@ func (m Model) renderStatusBar() string {
 		pageInfo = fmt.Sprintf(" | Page: %d/%d", page, pages)
 	}
 
+	grouping := ""
+	if m.groupBy != "host" {
+		grouping = " | By: " + m.groupBy
+	}
+
 	if hints != "" {
-		status := fmt.Sprintf("%s | Hosts: %d/%d%s | [? help] %s",
-			mode, filtered, total, pageInfo, hints)
+		status := fmt.Sprintf("%s | Hosts: %d/%d%s%s | [? help] %s",
+			mode, filtered, total, grouping, pageInfo, hints)
 		return style.Render(status)
 	}
 
-	status := fmt.Sprintf("%s | Hosts: %d/%d%s | [? help]",
-		mode, filtered, total, pageInfo)
+	status := fmt.Sprintf("%s | Hosts: %d/%d%s%s | [? help]",
+		mode, filtered, total, grouping, pageInfo)
 
 	return style.Render(status)
 }
@@ -697,12 +1179,28 @@ func (m Model) renderHelp() string {
 Keyboard Shortcuts:
 
   ↑/↓     Navigate hosts
-  /       Filter hosts (live as you type)
-  d       Delete selected host (with confirmation)
+  /       Filter hosts (live as you type), supports the query syntax:
+            type:ed25519 cidr:10.1.0.0/16 glob:*.example re:^web
+            is:hashed is:plain marker:revoked source:known_hosts
+            OR, NOT / -term and (parentheses) combine terms
+  d       Delete selected host (with confirmation; 1-9 removes one alias)
   s       Stash selected host into stash_hosts
+  a       Add an alias to the selected line(s)
+  x       Split the selected line into one line per address
+  c       Consolidate lines sharing the selected key into one line
+  p       Pick the key to keep for a host marked "! conflict"
+  v       Cycle grouping: host, key (shows hosts sharing a key), tag,
+          key type, domain suffix, source file
+  Enter   On a section header: fold or unfold the section
+  s/d     On a section header: stash or delete every host in it
+  i       Show statistics for known_hosts and the stash
   t       Toggle between known_hosts and stash_hosts view
-  r       Restore selected host from stash_hosts (when in stash view)
+  r       Restore selected host from stash_hosts (when in stash view);
+          if known_hosts now has another key of that type, choose to keep
+          the current key, swap it with the stashed one, or keep both
   Enter   Confirm action / toggle host details
+          In details: ↑/↓ or 1-9 choose a key, s stashes or r restores
+          only that key (e.g. the old RSA key during a rotation)
   Esc     Cancel current action
   ?       Toggle help
   q/Ctrl+C Quit
@@ -711,6 +1209,10 @@ Host Types:
   Regular host
   Hashed host
   (n keys) Multiple keys for same host
+  ! conflict  Several different keys of one type (p to choose)
+  ! shared    Key used by more than one host (key grouping)
+  ! weak      Weak or deprecated key, see details (khm audit keys)
+  ⏳ 2h left  Temporary entry (khm add --ttl); ! expired once khm gc may remove it
 `
 
 	return style.Render(helpText)
@@ -724,9 +1226,11 @@ func (m Model) renderConfirm() string {
 		Margin(1)
 
 	var name string
+	var group hostItem
 	if sel := m.list.SelectedItem(); sel != nil {
 		if hi, ok := sel.(hostItem); ok {
 			name = hi.addressLabel
+			group = hi
 		}
 	}
 	if name == "" {
@@ -734,9 +1238,132 @@ func (m Model) renderConfirm() string {
 	}
 
 	content := fmt.Sprintf("Are you sure you want to delete ALL keys for host %q?\n\nEnter to confirm • Esc to cancel", name)
+	if group.section != "" {
+		content = fmt.Sprintf("Are you sure you want to delete ALL %d keys of the %d hosts in %q?\n\nEnter to confirm • Esc to cancel",
+			len(group.hosts), group.groups, name)
+	}
+
+	if aliases := m.selectedAliases(); len(aliases) > 1 {
+		var b strings.Builder
+		b.WriteString(content)
+		b.WriteString("\n\nOr remove a single alias and keep the rest of the line:\n")
+		for i, a := range aliases {
+			if i >= 9 {
+				break
+			}
+			fmt.Fprintf(&b, "\n  %d  %s", i+1, a)
+		}
+		content = b.String()
+	}
 	return boxStyle.Render(content)
 }
 
+func (m Model) renderResolve() string {
+	boxStyle := lipgloss.NewStyle().
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color("#F59E0B")).
+		Padding(1, 2).
+		Margin(1)
+
+	c := m.resolving
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s has %d different %s keys. Which one should be kept?\n", c.Host, len(c.Keys()), c.Type)
+	for i, k := range c.Keys() {
+		if i >= 9 {
+			break
+		}
+		lines := make([]string, 0)
+		for _, h := range c.Entries {
+			if h.Key == k.Key {
+				lines = append(lines, fmt.Sprintf("%d", h.LineNumber))
+			}
+		}
+		fmt.Fprintf(&b, "\n  %d  %s  (line %s)", i+1, k.Fingerprint(), strings.Join(lines, ", "))
+		if k.Comment != "" {
+			fmt.Fprintf(&b, "  %s", k.Comment)
+		}
+	}
+	b.WriteString("\n\nThe host is removed from the lines with the other keys; their other aliases stay.")
+	b.WriteString("\n1-9 to keep a key • Esc to cancel")
+	return boxStyle.Render(b.String())
+}
+
+func (m Model) renderRestoreConflicts() string {
+	boxStyle := lipgloss.NewStyle().
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color("#F59E0B")).
+		Padding(1, 2).
+		Margin(1)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "known_hosts now has a different key for %d stashed %s:\n",
+		len(m.restoreConflicts), plural(len(m.restoreConflicts), "entry", "entries"))
+	for i, c := range m.restoreConflicts {
+		if i >= 9 {
+			fmt.Fprintf(&b, "\n  … %d more", len(m.restoreConflicts)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n  %s %s\n    stashed   %s", c.Stashed.HostField(), c.Stashed.Type, c.Stashed.Fingerprint())
+		for _, h := range c.Current {
+			fmt.Fprintf(&b, "\n    line %-4d %s", h.LineNumber, h.Fingerprint())
+		}
+	}
+	b.WriteString("\n\n  1  Keep current key (the entry stays stashed)")
+	b.WriteString("\n  2  Restore stashed key and stash the current one")
+	b.WriteString("\n  3  Keep both keys")
+	b.WriteString("\n\n1-3 to choose • Esc to cancel")
+	return boxStyle.Render(b.String())
+}
+
+func (m Model) renderStats() string {
+	boxStyle := lipgloss.NewStyle().
+		BorderStyle(lipgloss.NormalBorder()).
+		BorderForeground(lipgloss.Color("#A78BFA")).
+		Padding(1, 2).
+		Margin(1)
+	headingStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#7D56F4")).
+		Bold(true)
+
+	if m.statsErr != nil {
+		return boxStyle.Render(fmt.Sprintf("Error computing statistics: %v", m.statsErr))
+	}
+	s := m.stats
+
+	var b strings.Builder
+	b.WriteString(headingStyle.Render("Statistics"))
+	fmt.Fprintf(&b, "\n\nEntries      %d", s.Entries)
+	fmt.Fprintf(&b, "\nHosts        %d (%d with several keys)", s.Hosts, s.MultiKeyHosts)
+	fmt.Fprintf(&b, "\nHashed       %d of %d (%.0f%%)", s.Hashed, s.Entries, s.HashedRatio*100)
+	fmt.Fprintf(&b, "\nAddresses    %d IP, %d DNS, %d patterns", s.IPAddresses, s.DNSNames, s.Patterns)
+	fmt.Fprintf(&b, "\nDuplicates   %d", s.Duplicates)
+	fmt.Fprintf(&b, "\nConflicts    %d", s.Conflicts)
+	fmt.Fprintf(&b, "\nStash        %d", s.StashEntries)
+
+	sections := []struct {
+		title  string
+		counts map[string]int
+	}{
+		{"Key types", s.Types},
+		{"Markers", s.Markers},
+		{"Domains", s.Domains},
+	}
+	for _, section := range sections {
+		if len(section.counts) == 0 {
+			continue
+		}
+		b.WriteString("\n\n" + headingStyle.Render(section.title))
+		for i, c := range knownhosts.SortCounts(section.counts) {
+			if i >= 10 {
+				fmt.Fprintf(&b, "\n  … %d more", len(section.counts)-i)
+				break
+			}
+			fmt.Fprintf(&b, "\n  %-30s %d", c.Name, c.Count)
+		}
+	}
+	return boxStyle.Render(b.String())
+}
+
 func (m Model) renderEmptyState() string {
 	style := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#9CA3AF")).
@@ -764,25 +1391,18 @@ func (m Model) renderDetails() string {
 		return m.renderEmptyState()
 	}
 
-	type hostKey struct {
-		Type    string
-		Key     string
-		Comment string
-	}
-	seen := make(map[hostKey]bool)
-
+	keys := m.detailKeys()
 	var lines []string
 
-	for _, h := range hi.hosts {
-		if h == nil {
-			continue
-		}
-
-		hk := hostKey{Type: h.Type, Key: h.Key, Comment: h.Comment}
-		if seen[hk] {
-			continue
+	for i, h := range keys {
+		// With several keys, mark the one s / r act on
+		if len(keys) > 1 {
+			marker := " "
+			if i == m.detailKey {
+				marker = "▶"
+			}
+			lines = append(lines, fmt.Sprintf("%s Key %d of %d", marker, i+1, len(keys)))
 		}
-		seen[hk] = true
 
 		if h.IsHashed && h.HashValue != "" {
 			lines = append(lines, fmt.Sprintf("Hashed host: %s", h.HashValue))
@@ -805,9 +1425,27 @@ func (m Model) renderDetails() string {
 			lines = append(lines, fmt.Sprintf("Comment: %s", h.Comment))
 		}
 
+		// Metadata from the sidecar file
+		if !h.Meta.Empty() {
+			lines = append(lines, h.Meta.Lines()...)
+		}
+
+		// Key audit findings
+		for _, f := range m.findings[h] {
+			lines = append(lines, fmt.Sprintf("Audit: %s: %s", f.Severity, f.Message))
+		}
+
 		lines = append(lines, "")
 	}
 
+	// Keys the host had before, from the history archive
+	if len(m.timeline) > 0 {
+		lines = append(lines, "History:")
+		for _, e := range m.timeline {
+			lines = append(lines, "  "+e.String())
+		}
+	}
+
 	content := strings.TrimSpace(strings.Join(lines, "\n"))
 	if content == "" {
 		content = "No details available for this host."
@@ -879,6 +1517,74 @@ func (m Model) renderDetails() string {
 	return boxStyle.Render(content)
 }
 
+// detailKeys returns the distinct keys of the selected item in the order the
+// details view lists them.
+func (m Model) detailKeys() []*knownhosts.Host {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok {
+		return nil
+	}
+	type hostKey struct {
+		Type    string
+		Key     string
+		Comment string
+	}
+	seen := make(map[hostKey]bool)
+	keys := make([]*knownhosts.Host, 0, len(hi.hosts))
+	for _, h := range hi.hosts {
+		if h == nil {
+			continue
+		}
+		hk := hostKey{Type: h.Type, Key: h.Key, Comment: h.Comment}
+		if !seen[hk] {
+			seen[hk] = true
+			keys = append(keys, h)
+		}
+	}
+	return keys
+}
+
+// sameKey returns the entries of the selected item listing the key of h,
+// i.e. the lines the details view shows as one key.
+func (m Model) sameKey(h *knownhosts.Host) []*knownhosts.Host {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok {
+		return nil
+	}
+	out := make([]*knownhosts.Host, 0, 1)
+	for _, e := range hi.hosts {
+		if e != nil && e.Type == h.Type && e.Key == h.Key && e.Comment == h.Comment {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// stashDetailKey stashes the key chosen in the details view into the
+// default stash, leaving the other keys of the host in known_hosts.
+func (m *Model) stashDetailKey(h *knownhosts.Host) tea.Cmd {
+	targetFile := m.collection.StashFilePath()
+	if targetFile == "" {
+		m.status = "Stash path not available"
+		return nil
+	}
+	if _, err := m.collection.StashHostsWithPath(m.sameKey(h), targetFile); err != nil {
+		m.status = fmt.Sprintf("Error stashing key: %v", err)
+		return nil
+	}
+	m.rebuildList()
+	m.status = fmt.Sprintf("Stashed %s key %s to: %s", h.Type, h.Fingerprint(), targetFile)
+	return nil
+}
+
+// restoreDetailKey restores the stashed key chosen in the details view.
+func (m *Model) restoreDetailKey(h *knownhosts.Host) tea.Cmd {
+	if m.restoreOrAsk(m.sameKey(h)) {
+		m.status = fmt.Sprintf("Restored %s key %s from stash to %s", h.Type, h.Fingerprint(), strings.Join(m.restoredTo, ", "))
+	}
+	return nil
+}
+
 func (m *Model) loadStash() error {
 	stashPath := m.collection.StashFilePath()
 	if stashPath == "" {
@@ -932,42 +1638,80 @@ func (m *Model) restoreSelectedFromStash() tea.Cmd {
 		return nil
 	}
 
-	// Interpret addressLabel as the address key in stash_hosts.
-	address := hi.addressLabel
+	if m.restoreOrAsk(hi.hosts) {
+		m.status = fmt.Sprintf("Restored host %s from stash to %s", hi.addressLabel, strings.Join(m.restoredTo, ", "))
+	}
+	return nil
+}
+
+// restoreOrAsk restores hosts, or opens the conflict dialog when one of
+// them conflicts with known_hosts. It reports whether hosts were restored.
+func (m *Model) restoreOrAsk(hosts []*knownhosts.Host) bool {
+	err := m.restoreEntries(hosts, "")
+	var conflictErr *knownhosts.RestoreConflictError
+	if errors.As(err, &conflictErr) {
+		m.restoring = hosts
+		m.restoreConflicts = conflictErr.Conflicts
+		m.showRestore = true
+		m.status = "Restore conflicts with known_hosts: choose a resolution"
+		m.updateListSize()
+		return false
+	}
+	if err != nil {
+		m.status = fmt.Sprintf("Error restoring: %v", err)
+		return false
+	}
+	return true
+}
+
+// restorePending restores the entries held back by the conflict dialog.
+func (m *Model) restorePending(resolve string) tea.Cmd {
+	hosts := m.restoring
+	m.restoring = nil
+	if err := m.restoreEntries(hosts, resolve); err != nil {
+		m.status = fmt.Sprintf("Error restoring: %v", err)
+		return nil
+	}
+	switch resolve {
+	case knownhosts.KeepCurrent:
+		m.status = "Kept the current keys; conflicting entries stay stashed"
+	case knownhosts.SwapStashed:
+		m.status = "Restored the stashed keys and stashed the keys they replaced"
+	default:
+		m.status = "Restored the stashed keys next to the current ones"
+	}
+	return nil
+}
 
-	// Derive known_hosts path from current stash file path.
+// restoreEntries moves the given stash entries back into known_hosts,
+// resolving conflicts as resolve says, and reloads the stash view.
+func (m *Model) restoreEntries(hosts []*knownhosts.Host, resolve string) error {
+	// In stash view the collection is the stash file itself.
 	stashPath := m.collection.File
 	if stashPath == "" {
 		stashPath = m.collection.StashFilePath()
 	}
 	if stashPath == "" {
-		m.status = "Stash path not available"
-		return nil
+		return fmt.Errorf("stash path not available")
 	}
 
-	dir := filepath.Dir(stashPath)
-	knownPath := filepath.Join(dir, "known_hosts")
-
-	mainCol, err := knownhosts.ParseKnownHosts(knownPath)
+	// Entries go back to the file they were stashed from; entries without
+	// a recorded origin go to the known_hosts file being managed.
+	base := knownhosts.NewHostCollection(m.baseKnownHostsPath)
+	restored, err := base.RestoreEntries(stashPath, hosts, "", resolve)
 	if err != nil {
-		m.status = fmt.Sprintf("Error parsing known_hosts: %v", err)
-		return nil
+		return err
 	}
-
-	// Use UnstashAddress on a collection bound to known_hosts.
-	mainCol.File = knownPath
-	if err := mainCol.UnstashAddress(address); err != nil {
-		m.status = fmt.Sprintf("Error restoring host: %v", err)
-		return nil
+	m.restoredTo = make([]string, 0, len(restored))
+	for file := range restored {
+		m.restoredTo = append(m.restoredTo, file)
 	}
+	sort.Strings(m.restoredTo)
 
 	// After successful restore, reload stash view
 	if err := m.loadStash(); err != nil {
-		m.status = fmt.Sprintf("Restored, but failed to reload stash: %v", err)
-		return nil
+		return fmt.Errorf("restored, but failed to reload stash: %w", err)
 	}
-
-	m.status = fmt.Sprintf("Restored host %s from stash to known_hosts", address)
 	return nil
 }
 
@@ -980,8 +1724,12 @@ func (m *Model) deleteSelectedHost() tea.Cmd {
 
 	selectedItem := selected.(hostItem)
 
-	if err := m.collection.RemoveAllHosts(selectedItem.addressLabel); err != nil {
-		m.status = fmt.Sprintf("Error: %v", err)
+	if err := m.archiveRemoved(selectedItem.hosts); err != nil {
+		m.status = fmt.Sprintf("Error archiving: %v", err)
+		return nil
+	}
+	if m.collection.RemoveEntries(selectedItem.hosts) == 0 {
+		m.status = "Error: host not found"
 		return nil
 	}
 
@@ -997,6 +1745,211 @@ func (m *Model) deleteSelectedHost() tea.Cmd {
 	return nil
 }
 
+// loadTimeline reads the key history of the selected host from the managed
+// file's history archive.
+func (m *Model) loadTimeline() {
+	m.timeline = nil
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok || len(hi.hosts) == 0 || len(hi.hosts[0].Addresses) == 0 {
+		return
+	}
+
+	collection := m.collection
+	if m.showStashView {
+		base, err := knownhosts.ParseKnownHosts(m.baseKnownHostsPath)
+		if err != nil {
+			return
+		}
+		collection = base
+	}
+	timeline, err := collection.Timeline(hi.hosts[0].Addresses[0])
+	if err != nil {
+		m.status = fmt.Sprintf("Error reading history: %v", err)
+		return
+	}
+	m.timeline = timeline
+}
+
+// archiveRemoved records entries about to be deleted in the history archive
+// of the managed file. In stash view they are dropped from the stash.
+func (m *Model) archiveRemoved(hosts []*knownhosts.Host) error {
+	if m.showStashView {
+		base := knownhosts.NewHostCollection(m.baseKnownHostsPath)
+		return base.ArchiveStashed(hosts, knownhosts.OpStashDrop, "")
+	}
+	return m.collection.Archive(hosts, knownhosts.OpDelete, "")
+}
+
+// selectedAliases returns the addresses of the selected item when it is a
+// plain (non-hashed) entry listing more than one address.
+func (m *Model) selectedAliases() []string {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok || len(hi.hosts) == 0 || hi.section != "" || hi.hosts[0].IsHashed {
+		return nil
+	}
+	return hi.hosts[0].Addresses
+}
+
+// removeSelectedAlias rewrites the selected entries without alias.
+func (m *Model) removeSelectedAlias(alias string) tea.Cmd {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok {
+		m.status = "Invalid selection"
+		return nil
+	}
+
+	if !m.showStashView {
+		if err := m.collection.ArchiveAlias(hi.hosts, alias, knownhosts.OpAliasRemove, ""); err != nil {
+			m.status = fmt.Sprintf("Error archiving: %v", err)
+			return nil
+		}
+	}
+	rewritten, removed := m.collection.RemoveAliasFrom(hi.hosts, alias)
+	if rewritten+removed == 0 {
+		m.status = fmt.Sprintf("Alias %s not found", alias)
+		return nil
+	}
+
+	if err := m.collection.Save(); err != nil {
+		m.status = fmt.Sprintf("Error saving: %v", err)
+		return nil
+	}
+
+	m.rebuildList()
+
+	m.status = fmt.Sprintf("Removed alias %s from %d line(s)", alias, rewritten+removed)
+	return nil
+}
+
+// addSelectedAlias appends the alias typed in the prompt to the selected
+// entries.
+func (m *Model) addSelectedAlias() tea.Cmd {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok {
+		m.status = "Invalid selection"
+		return nil
+	}
+
+	alias := strings.TrimSpace(m.aliasInput.Value())
+	m.aliasInput.SetValue("")
+	rewritten, err := m.collection.AddAliasTo(hi.hosts, alias)
+	if err != nil {
+		m.status = fmt.Sprintf("Error adding alias: %v", err)
+		return nil
+	}
+	if rewritten == 0 {
+		m.status = fmt.Sprintf("%s is already listed", alias)
+		return nil
+	}
+
+	if err := m.collection.Save(); err != nil {
+		m.status = fmt.Sprintf("Error saving: %v", err)
+		return nil
+	}
+
+	m.rebuildList()
+
+	m.status = fmt.Sprintf("Added alias %s to %d line(s)", alias, rewritten)
+	return nil
+}
+
+// splitSelectedHost rewrites the selected multi-address line as one line
+// per address.
+func (m *Model) splitSelectedHost() tea.Cmd {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok {
+		m.status = "No host selected"
+		return nil
+	}
+
+	added := m.collection.Split(hi.hosts)
+	if added == 0 {
+		m.status = "Nothing to split: line lists a single address"
+		return nil
+	}
+
+	if err := m.collection.Save(); err != nil {
+		m.status = fmt.Sprintf("Error saving: %v", err)
+		return nil
+	}
+
+	m.rebuildList()
+
+	m.status = fmt.Sprintf("Split %s into %d lines", hi.addressLabel, added+len(hi.hosts))
+	return nil
+}
+
+// consolidateSelectedHost merges every line carrying one of the selected
+// keys into a single line.
+func (m *Model) consolidateSelectedHost() tea.Cmd {
+	hi, ok := m.list.SelectedItem().(hostItem)
+	if !ok {
+		m.status = "No host selected"
+		return nil
+	}
+
+	related := make([]*knownhosts.Host, 0)
+	for _, h := range m.collection.Entries {
+		for _, sel := range hi.hosts {
+			if h.Marker == sel.Marker && h.Type == sel.Type && h.Key == sel.Key {
+				related = append(related, h)
+				break
+			}
+		}
+	}
+
+	removed := m.collection.Consolidate(related)
+	if removed == 0 {
+		m.status = "Nothing to consolidate: no other plain line has this key"
+		return nil
+	}
+
+	if err := m.collection.Save(); err != nil {
+		m.status = fmt.Sprintf("Error saving: %v", err)
+		return nil
+	}
+
+	m.rebuildList()
+
+	m.status = fmt.Sprintf("Merged %d line(s) into %s", removed, hi.addressLabel)
+	return nil
+}
+
+// conflictFor returns the first conflict involving the entries of hi.
+func (m *Model) conflictFor(hi hostItem) (knownhosts.Conflict, bool) {
+	for _, c := range m.conflicts {
+		for _, h := range c.Entries {
+			for _, sel := range hi.hosts {
+				if h == sel {
+					return c, true
+				}
+			}
+		}
+	}
+	return knownhosts.Conflict{}, false
+}
+
+// resolveConflict keeps keep for the conflict shown in the key chooser.
+func (m *Model) resolveConflict(keep *knownhosts.Host) tea.Cmd {
+	c := m.resolving
+	if err := m.collection.ArchiveAlias(c.Stale(keep), c.Host, knownhosts.OpConflict, "kept "+keep.Fingerprint()); err != nil {
+		m.status = fmt.Sprintf("Error archiving: %v", err)
+		return nil
+	}
+	rewritten, removed := m.collection.ResolveConflict(c, keep)
+
+	if err := m.collection.Save(); err != nil {
+		m.status = fmt.Sprintf("Error saving: %v", err)
+		return nil
+	}
+
+	m.rebuildList()
+
+	m.status = fmt.Sprintf("Kept %s for %s: rewrote %d line(s), removed %d line(s)",
+		keep.Fingerprint(), c.Host, rewritten, removed)
+	return nil
+}
+
 func (m *Model) stashSelectedHost() tea.Cmd {
 	selected := m.list.SelectedItem()
 	if selected == nil {
@@ -1019,7 +1972,7 @@ func (m *Model) stashSelectedHost() tea.Cmd {
 		return nil
 	}
 
-	if err := m.collection.StashAddressWithPath(hi.addressLabel, targetFile); err != nil {
+	if _, err := m.collection.StashHostsWithPath(hi.hosts, targetFile); err != nil {
 		m.status = fmt.Sprintf("Error stashing host: %v", err)
 		return nil
 	}
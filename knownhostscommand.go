@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// knownHostsCommandCmd answers OpenSSH's KnownHostsCommand (OpenSSH 8.5+)
+// from the files khm manages, so ssh trusts exactly what khm shows.
+func knownHostsCommandCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "known-hosts-command <%H> [%I] [%K] [%f]",
+		Short: "Print the known_hosts lines for a host, for ssh's KnownHostsCommand",
+		Long: "Print the known_hosts lines that apply to a host, for use as OpenSSH's KnownHostsCommand. Lines are " +
+			"read from --file and every --source; stashes are never used, even when given as a source, and temporary " +
+			"entries whose TTL has passed are left out. When ssh passes the key it was offered (%K) and that key was " +
+			"removed by khm or has expired, the reason is printed to stderr.",
+		Example: `  # ~/.ssh/config
+  Host *
+      KnownHostsCommand /usr/local/bin/khm known-hosts-command %H %I %K %f
+      UserKnownHostsFile none
+
+  khm known-hosts-command --source ~/.ssh/known_hosts_work web1.example`,
+		Args: cobra.RangeArgs(1, 4),
+		// ssh runs this on every connection: it must not change any file,
+		// so the expired stash handling of the root command is skipped.
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			sources, _ := cmd.Flags().GetStringSlice("source")
+
+			host := args[0]
+			var reason, key string
+			if len(args) > 1 {
+				reason = args[1]
+			}
+			if len(args) > 2 {
+				key = args[2]
+			}
+
+			if err := answerKnownHosts(append([]string{path}, sources...), host, reason, key, time.Now()); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	cmd.Flags().StringSlice("source", nil, "Additional known_hosts files to answer from (repeatable)")
+
+	return cmd
+}
+
+// answerKnownHosts prints the trusted lines for host from every file. Missing
+// files are skipped, as ssh does for its known_hosts files.
+func answerKnownHosts(files []string, host, reason, key string, now time.Time) error {
+	collections := make([]*knownhosts.HostCollection, 0, len(files))
+	for _, file := range files {
+		collection, err := knownhosts.ParseKnownHosts(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %w", file, err)
+		}
+		collections = append(collections, collection)
+	}
+
+	seen := make(map[string]bool)
+	for _, collection := range collections {
+		if isStashOf(collections, collection.File) {
+			fmt.Fprintf(os.Stderr, "khm: skipping stash %s\n", collection.File)
+			continue
+		}
+		for _, h := range collection.TrustedFor(host, now) {
+			if line := h.String(); !seen[line] {
+				seen[line] = true
+				fmt.Println(line)
+			}
+		}
+	}
+
+	// ORDER lookups only ask which key types to prefer; there is no key yet.
+	if key == "" || reason == "ORDER" {
+		return nil
+	}
+	for _, collection := range collections {
+		explainUntrustedKey(collection, host, key, now)
+	}
+	return nil
+}
+
+// isStashOf reports whether path is a stash of one of the collections.
+func isStashOf(collections []*knownhosts.HostCollection, path string) bool {
+	for _, c := range collections {
+		if c.IsStash(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// explainUntrustedKey tells the user on stderr why a key ssh was offered is
+// not among the lines printed, when khm knows: it expired or was removed.
+func explainUntrustedKey(collection *knownhosts.HostCollection, host, key string, now time.Time) {
+	for _, h := range collection.Lookup(host) {
+		if h.Key == key && h.Meta.Expired(now) {
+			fmt.Fprintf(os.Stderr, "khm: the key %s of %s expired on %s (%s)\n",
+				h.Fingerprint(), host, h.Meta.ExpiresAt.Local().Format("2006-01-02 15:04"), collection.File)
+			return
+		}
+	}
+
+	records, err := collection.History(host)
+	if err != nil {
+		log.Warn(err)
+		return
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		r := records[i]
+		if r.Key != key {
+			continue
+		}
+		details := r.Operation
+		if r.Reason != "" {
+			details += ": " + r.Reason
+		}
+		fmt.Fprintf(os.Stderr, "khm: the key %s of %s was removed on %s (%s)\n",
+			r.Fingerprint, host, r.RemovedAt.Local().Format("2006-01-02 15:04"), details)
+		return
+	}
+}
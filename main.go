@@ -3,6 +3,10 @@ package main
 import (
 	"os"
 	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
 
 	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
@@ -37,7 +41,7 @@ func init() {
 
 			}
 
-			if err := runUI(path, version); err != nil {
+			if err := runUI(path, version, isDryRun(cmd)); err != nil {
 
 				log.Fatal(err)
 
@@ -46,7 +50,13 @@ func init() {
 		},
 	}
 
+	// Expired stash entries are handled on every run, before the command.
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		expireStashes(cmd)
+	}
+
 	rootCmd.PersistentFlags().StringP("file", "f", "", "Path to known_hosts file (overrides SSH_KNOWN_HOSTS and default)")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Show the changes mutating commands would make as a diff without writing files")
 
 	rootCmd.AddCommand(
 
@@ -54,11 +64,47 @@ func init() {
 
 		listCmd(),
 
+		findCmd(),
+
 		backupCmd(),
 
 		stashCmd(),
 
 		deleteCmd(),
+
+		addCmd(),
+
+		trustCmd(),
+
+		gcCmd(),
+
+		rotateCmd(),
+
+		historyCmd(),
+
+		knownHostsCommandCmd(),
+
+		aliasCmd(),
+
+		splitCmd(),
+
+		consolidateCmd(),
+
+		fmtCmd(),
+
+		dedupeCmd(),
+
+		conflictsCmd(),
+
+		auditCmd(),
+
+		policyCmd(),
+
+		statsCmd(),
+
+		tagCmd(),
+
+		noteCmd(),
 	)
 
 }
@@ -71,25 +117,66 @@ func main() {
 }
 
 func listCmd() *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "list",
 		Short: "List all known hosts",
+		// Read-only commands never rewrite files, not even for expired
+		// stash entries.
+		PersistentPreRun: reportExpiredStashes,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			format, _ := cmd.Flags().GetString("format")
+			query, err := queryFromFlags(cmd)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if err := listKnownHosts(path, format, query); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+
+	cmd.Flags().String("format", "", formatFlagUsage)
+	addQueryFlags(cmd)
+
+	return cmd
+}
+
+// findCmd looks up the entries ssh would use for a host, including hashed ones.
+func findCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:              "find <host>",
+		Short:            "Find known_hosts entries matching a host",
+		Args:             cobra.ExactArgs(1),
+		PersistentPreRun: reportExpiredStashes,
 		Run: func(cmd *cobra.Command, args []string) {
 			path, _ := cmd.Flags().GetString("file")
 			if path == "" {
 				path = getKnownHostsPath()
 			}
-			if err := listKnownHosts(path); err != nil {
+			format, _ := cmd.Flags().GetString("format")
+			if err := findHost(path, args[0], format); err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
+
+	cmd.Flags().String("format", "", formatFlagUsage)
+
+	return cmd
 }
 
+const formatFlagUsage = `Output format: "json" or a Go template, e.g. '{{.Address}} {{.Type}} {{.Fingerprint}}'`
+
 func backupCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "backup",
 		Short: "Create a backup of known_hosts file",
+		// The backup copies known_hosts as it is.
+		PersistentPreRun: reportExpiredStashes,
 		Run: func(cmd *cobra.Command, args []string) {
 			path, _ := cmd.Flags().GetString("file")
 			if path == "" {
@@ -111,65 +198,135 @@ func uiCmd() *cobra.Command {
 			if path == "" {
 				path = getKnownHostsPath()
 			}
-			if err := runUI(path, version); err != nil {
+			if err := runUI(path, version, isDryRun(cmd)); err != nil {
 				log.Fatal(err)
 			}
 		},
 	}
 }
 
-// stashCmd moves (stashes) all keys for the given host/address into stash_hosts
-// next to the known_hosts file, avoiding duplicates in stash.
-func stashCmd() *cobra.Command {
+// deleteCmd removes all keys matching the given hosts, globs, CIDR ranges and
+// filters from known_hosts in a single save.
+func deleteCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "stash <host>",
-		Short: "Stash all keys for a host into a stash_hosts file",
-		Args:  cobra.ExactArgs(1),
+		Use:   "delete <host|glob|cidr>...",
+		Short: "Delete all keys for matching hosts from known_hosts",
 		Run: func(cmd *cobra.Command, args []string) {
-			host := args[0]
-			if host == "" {
-				log.Fatal("host is required")
+			query, err := selectionFromArgs(cmd, args)
+			if err != nil {
+				log.Fatal(err)
 			}
 
-			knownPath, _ := cmd.Flags().GetString("file")
-			if knownPath == "" {
-				knownPath = getKnownHostsPath()
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
 			}
 
-			stashPath, _ := cmd.Flags().GetString("stash-file")
-
-			if err := stashHost(knownPath, stashPath, host); err != nil {
+			yes, _ := cmd.Flags().GetBool("yes")
+			aliasOnly, _ := cmd.Flags().GetBool("alias-only")
+			reason, _ := cmd.Flags().GetString("reason")
+
+			store := storeFor(cmd)
+			if aliasOnly {
+				// The filter flags narrow down the lines the aliases are
+				// removed from.
+				err = removeAliases(store, path, args, query, reason, yes || isDryRun(cmd))
+			} else {
+				err = deleteHosts(store, path, query, reason, yes || isDryRun(cmd))
+			}
+			if err != nil {
 				log.Fatal(err)
 			}
+			reportDryRun(store)
 		},
 	}
 
-	// Optional custom stash file path; if not set, defaults to stash_hosts next to known_hosts.
-	cmd.Flags().StringP("stash-file", "s", "", "Path to stash file (default: stash_hosts next to known_hosts)")
+	cmd.Flags().BoolP("yes", "y", false, "Confirm changes affecting many entries")
+	cmd.Flags().Bool("alias-only", false, "Remove only the given literal addresses from the matching lines, keeping other aliases")
+	cmd.Flags().StringP("reason", "m", "", "Why the keys are removed, kept in the history archive (khm history)")
+	addQueryFlags(cmd)
 
 	return cmd
 }
 
-// deleteCmd removes all keys for the given host/address from known_hosts.
-func deleteCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "delete <host>",
-		Short: "Delete all keys for a host from known_hosts",
-		Args:  cobra.ExactArgs(1),
+// addCmd appends a new entry, either from explicit fields or from a public
+// key file such as /etc/ssh/ssh_host_ed25519_key.pub.
+func addCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add <host>[,alias...] <type> <key> [comment]",
+		Short: "Add a host key to known_hosts",
+		Example: `  khm add web1,10.0.0.5 ssh-ed25519 AAAAC3Nza... owner=ops
+  khm add --from-pubkey ssh_host_ed25519_key.pub --host web1 --port 2222 --hash
+  khm add --ttl 2h ci-runner-7 ssh-ed25519 AAAAC3Nza...`,
 		Run: func(cmd *cobra.Command, args []string) {
-			host := args[0]
-			if host == "" {
-				log.Fatal("host is required")
-			}
-
 			path, _ := cmd.Flags().GetString("file")
 			if path == "" {
 				path = getKnownHostsPath()
 			}
 
-			if err := deleteHost(path, host); err != nil {
+			pubkey, _ := cmd.Flags().GetString("from-pubkey")
+			hosts, _ := cmd.Flags().GetStringSlice("host")
+
+			var entry *knownhosts.Host
+			var err error
+			if pubkey != "" {
+				if len(args) > 0 {
+					log.Fatal("positional arguments cannot be combined with --from-pubkey; use --host")
+				}
+				entry, err = entryFromPubkey(pubkey, hosts)
+			} else {
+				if len(hosts) > 0 {
+					log.Fatal("--host is only used with --from-pubkey")
+				}
+				entry, err = entryFromArgs(args)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			port, _ := cmd.Flags().GetInt("port")
+			if err := applyPort(entry, port); err != nil {
+				log.Fatal(err)
+			}
+
+			entry.Marker, _ = cmd.Flags().GetString("marker")
+			entry.Marker = strings.TrimPrefix(entry.Marker, "@")
+			if comment, _ := cmd.Flags().GetString("comment"); comment != "" {
+				entry.Comment = comment
+			}
+
+			source := "cli"
+			if pubkey != "" {
+				source = "pubkey:" + pubkey
+			}
+			entry.Meta = &knownhosts.Metadata{Source: source}
+			if ttl, _ := cmd.Flags().GetDuration("ttl"); ttl != 0 {
+				if ttl < 0 {
+					log.Fatal("--ttl must be positive")
+				}
+				expires := time.Now().UTC().Add(ttl)
+				entry.Meta.ExpiresAt = &expires
+			}
+
+			hash, _ := cmd.Flags().GetBool("hash")
+			force, _ := cmd.Flags().GetBool("force")
+
+			store := storeFor(cmd)
+			if err := addHost(store, path, entry, hash, force); err != nil {
 				log.Fatal(err)
 			}
+			reportDryRun(store)
 		},
 	}
+
+	cmd.Flags().String("from-pubkey", "", "Read type and key from a public key file")
+	cmd.Flags().StringSlice("host", nil, "Host names for --from-pubkey (repeatable or comma separated)")
+	cmd.Flags().Int("port", 0, "SSH port; non-default ports are written as [host]:port")
+	cmd.Flags().String("marker", "", "Marker for the line: cert-authority or revoked")
+	cmd.Flags().String("comment", "", "Comment to append to the line")
+	cmd.Flags().Bool("hash", false, "Hash host names (one hashed line per host)")
+	cmd.Flags().Bool("force", false, "Add even if the key is a duplicate or conflicts with an existing key")
+	cmd.Flags().Duration("ttl", 0, "Make the entry temporary: khm gc removes it after this long (e.g. 2h)")
+
+	return cmd
 }
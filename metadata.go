@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// tagCmd adds, removes or lists the metadata tags of entries.
+func tagCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tag <host|glob|cidr> [tag]...",
+		Short: "Tag entries, or list their tags",
+		Long: "Add tags to the entries matching the host, glob or CIDR range. With --rm the tags are removed instead; " +
+			"without tags the current tags are listed. Tags are kept in the metadata file next to known_hosts.",
+		Example: `  khm tag '*.prod.example' prod pci
+  khm tag 10.0.0.0/8 --rm legacy
+  khm list -q tag:prod`,
+		Args: cobra.MinimumNArgs(1),
+		// Without tags the command only lists them.
+		PersistentPreRun: expireStashesWhen(func(cmd *cobra.Command, args []string) bool {
+			return len(args) > 1
+		}),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			query, err := selectionFromArgs(cmd, args[:1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			tags := args[1:]
+			remove, _ := cmd.Flags().GetBool("rm")
+
+			if len(tags) == 0 {
+				if remove {
+					log.Fatal("--rm requires at least one tag")
+				}
+				if err := showMetadata(os.Stdout, path, query); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			store := storeFor(cmd)
+			err = editMetadata(store, path, query, func(m *knownhosts.Metadata) {
+				if remove {
+					m.RemoveTags(tags...)
+				} else {
+					m.AddTags(tags...)
+				}
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	cmd.Flags().Bool("rm", false, "Remove the tags instead of adding them")
+	addQueryFlags(cmd)
+	return cmd
+}
+
+// noteCmd sets the note, owner and verification time of entries, or shows
+// their metadata.
+func noteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "note <host|glob|cidr> [text]...",
+		Short: "Attach a note or owner to entries, or show their metadata",
+		Long: "Set the free-form note of the entries matching the host, glob or CIDR range. --owner and --verified " +
+			"update the owner and the last verification time. Without text or flags the metadata is shown.",
+		Example: `  khm note db1 "replaced after disk failure, see OPS-1234"
+  khm note db1 --owner dba-team --verified
+  khm note db1 --clear`,
+		Args: cobra.MinimumNArgs(1),
+		// Without text or flags the command only shows the metadata.
+		PersistentPreRun: expireStashesWhen(func(cmd *cobra.Command, args []string) bool {
+			return len(args) > 1 || cmd.Flags().Changed("clear") || cmd.Flags().Changed("verified") ||
+				cmd.Flags().Changed("owner")
+		}),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			query, err := selectionFromArgs(cmd, args[:1])
+			if err != nil {
+				log.Fatal(err)
+			}
+			text := strings.Join(args[1:], " ")
+			clearNote, _ := cmd.Flags().GetBool("clear")
+			verified, _ := cmd.Flags().GetBool("verified")
+			ownerSet := cmd.Flags().Changed("owner")
+			owner, _ := cmd.Flags().GetString("owner")
+
+			if clearNote && text != "" {
+				log.Fatal("--clear cannot be combined with a note")
+			}
+			if text == "" && !clearNote && !verified && !ownerSet {
+				if err := showMetadata(os.Stdout, path, query); err != nil {
+					log.Fatal(err)
+				}
+				return
+			}
+
+			now := time.Now().UTC()
+			store := storeFor(cmd)
+			err = editMetadata(store, path, query, func(m *knownhosts.Metadata) {
+				switch {
+				case clearNote:
+					m.Note = ""
+				case text != "":
+					m.Note = text
+				}
+				if ownerSet {
+					m.Owner = owner
+				}
+				if verified {
+					m.LastVerifiedAt = &now
+				}
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	cmd.Flags().String("owner", "", "Set the owner (an empty value clears it)")
+	cmd.Flags().Bool("verified", false, "Record that the keys were verified now")
+	cmd.Flags().Bool("clear", false, "Remove the note")
+	addQueryFlags(cmd)
+	return cmd
+}
+
+// editMetadata applies edit to the metadata of every entry matching query
+// and saves its metadata sidecar; the known_hosts file is not rewritten.
+func editMetadata(store knownhosts.Store, knownHostsPath string, query *knownhosts.Query, edit func(*knownhosts.Metadata)) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	targets := collection.Select(query)
+	if len(targets) == 0 {
+		return fmt.Errorf("no matching entries found")
+	}
+	for _, h := range targets {
+		edit(h.EnsureMeta())
+	}
+
+	if err := collection.SaveMetadata(); err != nil {
+		return fmt.Errorf("failed to save metadata: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "Updated %d %s\n", len(targets), plural(len(targets), "entry", "entries"))
+	return nil
+}
+
+// showMetadata prints the metadata of the entries matching query.
+func showMetadata(w io.Writer, knownHostsPath string, query *knownhosts.Query) error {
+	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	targets := collection.Select(query)
+	if len(targets) == 0 {
+		return fmt.Errorf("no matching entries found")
+	}
+	for _, h := range targets {
+		fmt.Fprintf(w, "%s %s %s\n", h.HostField(), h.Type, h.Fingerprint())
+		for _, line := range h.Meta.Lines() {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/FlameInTheDark/khm/internal/policy"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// policyCmd groups the policy file commands.
+func policyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Enforce a policy file on known_hosts files",
+		// Checking a policy only reads the files.
+		PersistentPreRun: reportExpiredStashes,
+	}
+	cmd.AddCommand(policyCheckCmd())
+	return cmd
+}
+
+// policyCheckCmd evaluates a policy file against known_hosts files.
+func policyCheckCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check [file]...",
+		Short: "Check known_hosts files against a policy file",
+		Long: `Check the given files (default: --file) against a YAML policy file and report every
+violation with file, line, rule and severity. Exits with status 1 when a violation is at
+least as severe as --fail-on.
+
+A trailing "khm:ignore" in an entry's comment skips all rules for that entry;
+"khm:ignore=wildcards,owner-comment" skips only the named rules.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			policyPath, _ := cmd.Flags().GetString("policy")
+			format, _ := cmd.Flags().GetString("format")
+			failOn, _ := cmd.Flags().GetString("fail-on")
+
+			threshold, err := knownhosts.ParseSeverity(failOn)
+			if err != nil {
+				log.Fatal(err)
+			}
+			p, err := policy.Load(policyPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			entries, err := loadEntries(auditFiles(cmd, args))
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			findings := p.Check(entries)
+			if err := writeFindings(os.Stdout, format, findings, policy.RuleDescriptions); err != nil {
+				log.Fatal(err)
+			}
+			if len(findings) == 0 && format == "" {
+				fmt.Fprintln(os.Stderr, "Policy satisfied")
+			}
+			if failsAt(findings, threshold) {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("policy", "p", "khm-policy.yaml", "Policy file")
+	cmd.Flags().String("format", "", `Output format: "json", "sarif", "github" or empty for text`)
+	cmd.Flags().String("fail-on", "error", "Exit non-zero for violations of this severity or worse: info, warning, error")
+	return cmd
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// rotateCmd replaces the known keys of a host with the keys it serves now,
+// after its host keys were rotated. The old entries are kept in a named
+// stash so the rotation can be undone with khm stash restore.
+func rotateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rotate <host>",
+		Short: "Replace the keys of a host with its newly scanned keys",
+		Long: "Scan the host with ssh-keyscan, show the old and new fingerprints, move the old entries to a named " +
+			"stash (default \"rotated\") and write the new keys in their place. The new lines keep the host field " +
+			"of the old ones, so aliases and hashing stay the same. Key types the host no longer offers are " +
+			"archived too, unless --type limits the rotation to some types. Nothing is written before the new " +
+			"fingerprints are confirmed at the prompt, or with --yes once they were verified out of band.",
+		Example: `  khm rotate web1.example
+  khm rotate --port 2222 --type ed25519 10.0.3.17
+  khm rotate --yes web1.example            # fingerprints checked against the console
+  khm stash restore rotated web1.example   # undo`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			port, _ := cmd.Flags().GetInt("port")
+			types, _ := cmd.Flags().GetStringSlice("type")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			archive, _ := cmd.Flags().GetString("archive")
+			reason, _ := cmd.Flags().GetString("reason")
+			yes, _ := cmd.Flags().GetBool("yes")
+
+			store := storeFor(cmd)
+			collection, err := knownhosts.ParseKnownHostsFrom(store, path)
+			if err != nil {
+				log.Fatal(fmt.Errorf("failed to parse known_hosts: %w", err))
+			}
+			archivePath, err := collection.NamedStashPath(archive)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			keys, err := knownhosts.ScanHostKeys(args[0], port, types, timeout)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rotation, err := collection.PlanRotation(knownhosts.FormatAddress(args[0], port), keys, len(types) > 0)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			printRotation(os.Stderr, rotation)
+			if !rotation.Changed() {
+				fmt.Fprintln(os.Stderr, "Keys unchanged, nothing to rotate")
+				return
+			}
+
+			// A man in the middle during the scan would be trusted from now
+			// on: the user has to check the new fingerprints first.
+			if !yes && !isDryRun(cmd) {
+				if err := confirmRotation(os.Stdin, os.Stderr, collection.File); err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			if reason == "" {
+				reason = "rotated on " + time.Now().Format("2006-01-02")
+			}
+			written, archived, err := collection.Rotate(rotation, archivePath, reason)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "Archived %d %s to stash %q, wrote %d new %s\n",
+				len(archived), plural(len(archived), "entry", "entries"), archive,
+				len(written), plural(len(written), "entry", "entries"))
+			reportDryRun(store)
+		},
+	}
+
+	cmd.Flags().Int("port", 0, "SSH port; non-default ports are written as [host]:port")
+	cmd.Flags().StringSlice("type", nil, "Rotate only these key types: rsa, ecdsa, ed25519 (default: all)")
+	cmd.Flags().Duration("timeout", 5*time.Second, "How long to wait for the host")
+	cmd.Flags().String("archive", "rotated", "Named stash the old entries are moved to")
+	cmd.Flags().StringP("reason", "m", "", "Reason recorded with the archived entries (default: rotated on <date>)")
+	cmd.Flags().BoolP("yes", "y", false, "Write the new keys without asking; only after verifying the fingerprints")
+	return cmd
+}
+
+// printRotation lists the old and new fingerprint of every key type.
+func printRotation(w io.Writer, r *knownhosts.Rotation) {
+	fmt.Fprintf(w, "Keys of %s:\n", r.Address)
+	for _, c := range r.Changes {
+		fps := make([]string, 0, len(c.Old))
+		seen := make(map[string]bool)
+		for _, h := range c.Old {
+			if fp := h.Fingerprint(); !seen[fp] {
+				seen[fp] = true
+				fps = append(fps, fp)
+			}
+		}
+		old := strings.Join(fps, ", ")
+		if old == "" {
+			old = "(none)"
+		}
+		switch {
+		case c.Unchanged():
+			fmt.Fprintf(w, "  %-20s %s  unchanged\n", c.Type, old)
+		case c.New == nil:
+			fmt.Fprintf(w, "  %-20s %s  -> (no longer offered)\n", c.Type, old)
+		default:
+			fmt.Fprintf(w, "  %-20s %s  -> %s\n", c.Type, old, c.New.Fingerprint())
+		}
+	}
+}
+
+// confirmRotation asks on w whether the scanned keys may be written. Without
+// a terminal on in there is nobody to ask, and --yes is required.
+func confirmRotation(in *os.File, w io.Writer, path string) error {
+	if fi, err := in.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("refusing to write unverified keys: check the new fingerprints and rerun with --yes")
+	}
+	fmt.Fprintf(w, "Do the new fingerprints match the host? Write them to %s [y/N]: ", path)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("rotation aborted, nothing was written")
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// stashCmd moves (stashes) all keys matching the given hosts, globs, CIDR
+// ranges and filters into stash_hosts next to the known_hosts file, avoiding
+// duplicates in stash. Its subcommands manage named stashes the way git
+// stash does; `khm stash <host>` is short for `khm stash push <host>`.
+func stashCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stash <host|glob|cidr>...",
+		Short: "Stash all keys for matching hosts into a stash_hosts file",
+		Long: "Stash all keys for matching hosts into a stash file. Without --name the default stash_hosts file " +
+			"next to known_hosts is used; named stashes are kept in stash_hosts.d.",
+		Example: `  khm stash web1
+  khm stash push --name pre-migration '*.db.example'
+  khm stash list
+  khm stash pop pre-migration db1.db.example`,
+		Run: runStashPush,
+	}
+	addStashPushFlags(cmd)
+
+	push := &cobra.Command{
+		Use:   "push <host|glob|cidr>...",
+		Short: "Stash all keys for matching hosts (the same as khm stash <host>)",
+		Run:   runStashPush,
+	}
+	addStashPushFlags(push)
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List stashes, most recent first",
+		Args:  cobra.NoArgs,
+		// Listing never writes files.
+		PersistentPreRun: reportExpiredStashes,
+		Run: func(cmd *cobra.Command, args []string) {
+			knownPath, _ := cmd.Flags().GetString("file")
+			if knownPath == "" {
+				knownPath = getKnownHostsPath()
+			}
+			format, _ := cmd.Flags().GetString("format")
+			if err := listStashes(os.Stdout, knownPath, format); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	list.Flags().String("format", "", "Output format: json")
+
+	show := &cobra.Command{
+		Use:              "show [name]",
+		Short:            "Show the entries of a stash (default: stash_hosts)",
+		Args:             cobra.MaximumNArgs(1),
+		PersistentPreRun: reportExpiredStashes,
+		Run: func(cmd *cobra.Command, args []string) {
+			stashPath, _ := cmd.Flags().GetString("stash-file")
+			if stashPath == "" {
+				name := ""
+				if len(args) > 0 {
+					name = args[0]
+				}
+				var err error
+				if stashPath, err = knownhosts.NewHostCollection(knownHostsFile(cmd)).NamedStashPath(name); err != nil {
+					log.Fatal(err)
+				}
+			}
+			format, _ := cmd.Flags().GetString("format")
+			if err := showStash(stashPath, format); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	show.Flags().String("format", "", formatFlagUsage)
+	show.Flags().StringP("stash-file", "s", "", "Path to stash file instead of a stash name")
+
+	apply := &cobra.Command{
+		Use:   "apply [name] [host|glob|cidr]...",
+		Short: "Restore stashed entries into known_hosts and keep them in the stash",
+		Run: func(cmd *cobra.Command, args []string) {
+			runStashRestore(cmd, args, false)
+		},
+	}
+	pop := &cobra.Command{
+		Use:   "pop [name] [host|glob|cidr]...",
+		Short: "Restore stashed entries into known_hosts and remove them from the stash",
+		Run: func(cmd *cobra.Command, args []string) {
+			runStashRestore(cmd, args, true)
+		},
+	}
+	restore := &cobra.Command{
+		Use:   "restore [name] [host|glob|cidr]...",
+		Short: "Move stashed entries back into the files they were stashed from",
+		Long: "Move stashed entries back into the known_hosts file each of them was stashed from, which may differ " +
+			"from --file. --to puts every entry into the given file instead; --keep leaves them in the stash.",
+		Run: runStashRestoreOrigin,
+	}
+	restore.Flags().String("to", "", "Restore into this file instead of the files the entries came from")
+	restore.Flags().Bool("keep", false, "Keep the entries in the stash, as apply does")
+
+	drop := &cobra.Command{
+		Use:   "drop [name] [host|glob|cidr]...",
+		Short: "Discard a stash, or only its entries for the given hosts",
+		Run: func(cmd *cobra.Command, args []string) {
+			knownPath, _ := cmd.Flags().GetString("file")
+			if knownPath == "" {
+				knownPath = getKnownHostsPath()
+			}
+			stashPath, hosts, err := stashFromArgs(cmd, args)
+			if err != nil {
+				log.Fatal(err)
+			}
+			query, err := optionalSelection(cmd, hosts)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			store := storeFor(cmd)
+			collection := knownhosts.NewHostCollection(knownPath)
+			collection.Store = store
+			n, err := collection.DropStash(stashPath, query)
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Fprintf(os.Stderr, "Dropped %d %s from %s\n", n, plural(n, "entry", "entries"), stashPath)
+			reportDryRun(store)
+		},
+	}
+	for _, c := range []*cobra.Command{apply, pop, restore, drop} {
+		c.Flags().StringP("stash-file", "s", "", "Path to stash file instead of a stash name; every argument is then a host")
+		c.Flags().StringP("name", "n", "", "Use the named stash; every argument is then a host")
+		addQueryFlags(c)
+	}
+	for _, c := range []*cobra.Command{apply, pop, restore} {
+		c.Flags().String("on-conflict", "", "When known_hosts has a different key of the same type: "+
+			strings.Join(knownhosts.Resolutions, ", "))
+	}
+
+	cmd.AddCommand(push, list, show, apply, pop, restore, drop)
+	return cmd
+}
+
+func addStashPushFlags(cmd *cobra.Command) {
+	// Optional custom stash file path; if not set, defaults to stash_hosts next to known_hosts.
+	cmd.Flags().StringP("stash-file", "s", "", "Path to stash file (default: stash_hosts next to known_hosts)")
+	cmd.Flags().StringP("name", "n", "", "Stash into the named stash in stash_hosts.d")
+	cmd.Flags().BoolP("yes", "y", false, "Confirm changes affecting many entries")
+	cmd.Flags().StringP("reason", "m", "", "Why the entries are stashed, shown by stash show and the TUI")
+	cmd.Flags().Duration("expire", 0, "Leave the stash again after this long (e.g. 24h), on the next khm run")
+	cmd.Flags().String("on-expire", knownhosts.ExpireRestore, "What happens on expiry: restore or drop")
+	addQueryFlags(cmd)
+}
+
+func runStashPush(cmd *cobra.Command, args []string) {
+	query, err := selectionFromArgs(cmd, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	knownPath, _ := cmd.Flags().GetString("file")
+	if knownPath == "" {
+		knownPath = getKnownHostsPath()
+	}
+
+	stashPath, _ := cmd.Flags().GetString("stash-file")
+	name, _ := cmd.Flags().GetString("name")
+	if name != "" {
+		if stashPath != "" {
+			log.Fatal("--name cannot be combined with --stash-file")
+		}
+		if stashPath, err = knownhosts.NewHostCollection(knownPath).NamedStashPath(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+	yes, _ := cmd.Flags().GetBool("yes")
+
+	var opts knownhosts.StashOptions
+	opts.Reason, _ = cmd.Flags().GetString("reason")
+	opts.Expire, _ = cmd.Flags().GetDuration("expire")
+	opts.OnExpiry, _ = cmd.Flags().GetString("on-expire")
+	if opts.Expire < 0 {
+		log.Fatal("--expire must be positive")
+	}
+	if opts.OnExpiry != knownhosts.ExpireRestore && opts.OnExpiry != knownhosts.ExpireDrop {
+		log.Fatalf("--on-expire must be %s or %s", knownhosts.ExpireRestore, knownhosts.ExpireDrop)
+	}
+
+	store := storeFor(cmd)
+	if err := stashHosts(store, knownPath, stashPath, query, opts, yes || isDryRun(cmd)); err != nil {
+		log.Fatal(err)
+	}
+	reportDryRun(store)
+}
+
+func runStashRestore(cmd *cobra.Command, args []string, drop bool) {
+	knownPath, _ := cmd.Flags().GetString("file")
+	if knownPath == "" {
+		knownPath = getKnownHostsPath()
+	}
+	stashPath, hosts, err := stashFromArgs(cmd, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	query, err := optionalSelection(cmd, hosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resolve, _ := cmd.Flags().GetString("on-conflict")
+
+	store := storeFor(cmd)
+	collection := knownhosts.NewHostCollection(knownPath)
+	collection.Store = store
+	n, err := collection.ApplyStash(stashPath, query, drop, resolve)
+	var conflictErr *knownhosts.RestoreConflictError
+	if errors.As(err, &conflictErr) {
+		printRestoreConflicts(os.Stderr, conflictErr.Conflicts)
+		log.Fatal("nothing restored: choose a resolution with --on-conflict")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d %s from %s into %s\n", n, plural(n, "entry", "entries"), stashPath, knownPath)
+	reportDryRun(store)
+}
+
+func runStashRestoreOrigin(cmd *cobra.Command, args []string) {
+	knownPath, _ := cmd.Flags().GetString("file")
+	if knownPath == "" {
+		knownPath = getKnownHostsPath()
+	}
+	stashPath, hosts, err := stashFromArgs(cmd, args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	query, err := optionalSelection(cmd, hosts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	target, _ := cmd.Flags().GetString("to")
+	keep, _ := cmd.Flags().GetBool("keep")
+	resolve, _ := cmd.Flags().GetString("on-conflict")
+
+	store := storeFor(cmd)
+	collection := knownhosts.NewHostCollection(knownPath)
+	collection.Store = store
+	restored, err := collection.RestoreStash(stashPath, query, target, !keep, resolve)
+	files := make([]string, 0, len(restored))
+	for file := range restored {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		n := restored[file]
+		fmt.Fprintf(os.Stderr, "Restored %d %s from %s into %s\n", n, plural(n, "entry", "entries"), stashPath, file)
+	}
+	var conflictErr *knownhosts.RestoreConflictError
+	if errors.As(err, &conflictErr) {
+		printRestoreConflicts(os.Stderr, conflictErr.Conflicts)
+		log.Fatal("nothing restored: choose a resolution with --on-conflict")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	reportDryRun(store)
+}
+
+// printRestoreConflicts lists the stashed keys that differ from the keys
+// known_hosts now holds, with the available resolutions.
+func printRestoreConflicts(w io.Writer, conflicts []knownhosts.RestoreConflict) {
+	fmt.Fprintf(w, "%d stashed %s %s with known_hosts:\n", len(conflicts),
+		plural(len(conflicts), "entry", "entries"), plural(len(conflicts), "conflicts", "conflict"))
+	for _, c := range conflicts {
+		fmt.Fprintf(w, "  %s %s\n    stashed  %s\n", c.Stashed.HostField(), c.Stashed.Type, c.Stashed.Fingerprint())
+		for _, h := range c.Current {
+			fmt.Fprintf(w, "    line %-4d %s  %s\n", h.LineNumber, h.Fingerprint(), h.HostField())
+		}
+	}
+	fmt.Fprintf(w, "Resolutions:\n")
+	fmt.Fprintf(w, "  --on-conflict %-13s keep the current key, leave the entry stashed\n", knownhosts.KeepCurrent)
+	fmt.Fprintf(w, "  --on-conflict %-13s restore the stashed key and stash the current one\n", knownhosts.SwapStashed)
+	fmt.Fprintf(w, "  --on-conflict %-13s restore the stashed key next to the current one\n", knownhosts.KeepBoth)
+}
+
+// stashFromArgs resolves the stash a subcommand works on: --stash-file or
+// --name when set, otherwise the stash named by the first argument if that
+// stash exists ("default" names stash_hosts). Any other first argument is a
+// host, as for push, and the default stash is used. It returns the hosts.
+func stashFromArgs(cmd *cobra.Command, args []string) (string, []string, error) {
+	stashPath, _ := cmd.Flags().GetString("stash-file")
+	name, _ := cmd.Flags().GetString("name")
+	if stashPath != "" {
+		if name != "" {
+			return "", nil, fmt.Errorf("--name cannot be combined with --stash-file")
+		}
+		return stashPath, args, nil
+	}
+
+	collection := knownhosts.NewHostCollection(knownHostsFile(cmd))
+	if name == "" && len(args) > 0 && stashExists(collection, args[0]) {
+		name, args = args[0], args[1:]
+	}
+	stashPath, err := collection.NamedStashPath(name)
+	return stashPath, args, err
+}
+
+// stashExists reports whether name is the default stash or an existing
+// named stash of the collection's file.
+func stashExists(collection *knownhosts.HostCollection, name string) bool {
+	if name == knownhosts.DefaultStash {
+		return true
+	}
+	if knownhosts.ValidateStashName(name) != nil {
+		return false
+	}
+	path, err := collection.NamedStashPath(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func listStashes(w io.Writer, knownHostsPath, format string) error {
+	stashes, err := knownhosts.NewHostCollection(knownHostsPath).Stashes()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "":
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stashes)
+	default:
+		return fmt.Errorf("unknown format %q: expected json", format)
+	}
+
+	if len(stashes) == 0 {
+		fmt.Fprintln(os.Stderr, "No stashes")
+		return nil
+	}
+	for _, s := range stashes {
+		fmt.Fprintf(w, "%-20s %4d %-7s  %s  %s\n", s.Name, s.Entries, plural(s.Entries, "entry", "entries"),
+			s.Modified.Format("2006-01-02 15:04"), s.Path)
+	}
+	return nil
+}
+
+func showStash(stashPath, format string) error {
+	collection, err := knownhosts.ParseKnownHosts(stashPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("stash %s not found", stashPath)
+		}
+		return fmt.Errorf("failed to parse stash: %w", err)
+	}
+
+	if format != "" {
+		printer, err := newHostPrinter(format)
+		if err != nil {
+			return err
+		}
+		return printer.Print(os.Stdout, collection.File, collection.Entries)
+	}
+
+	for _, h := range collection.Entries {
+		fmt.Printf("%d: %s\n", h.LineNumber, h.String())
+		if h.Meta != nil && h.Meta.Stash != nil {
+			fmt.Printf("   stashed %s\n", h.Meta.Stash.Summary())
+		}
+	}
+	return nil
+}
+
+// expireStashes restores or drops the stashed entries whose --expire time
+// has passed. Failures are only logged so they never block the command the
+// user asked for; dry runs leave the stashes alone.
+func expireStashes(cmd *cobra.Command) {
+	if isDryRun(cmd) {
+		reportExpiredStashes(cmd, nil)
+		return
+	}
+
+	report, err := knownhosts.NewHostCollection(knownHostsFile(cmd)).ExpireStashes(time.Now())
+	if err != nil {
+		log.Warn(fmt.Errorf("failed to process expired stash entries: %w", err))
+	}
+	if report.Restored > 0 {
+		fmt.Fprintf(os.Stderr, "Restored %d expired stash %s\n", report.Restored, plural(report.Restored, "entry", "entries"))
+	}
+	if report.Dropped > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d expired stash %s\n", report.Dropped, plural(report.Dropped, "entry", "entries"))
+	}
+	if len(report.Held) > 0 {
+		fmt.Fprintf(os.Stderr, "Kept %d expired stash %s: the host now has a different key of the same type.\n",
+			len(report.Held), plural(len(report.Held), "entry", "entries"))
+		fmt.Fprintln(os.Stderr, "They stay stashed without expiry; use khm stash restore --on-conflict to restore them:")
+		for _, h := range report.Held {
+			fmt.Fprintf(os.Stderr, "  %s:%d: %s\n", h.Source, h.LineNumber, h.String())
+		}
+	}
+}
+
+// reportExpiredStashes is the pre-run of commands that do not write files:
+// expired stash entries are only mentioned, and handled by the next command
+// that writes.
+func reportExpiredStashes(cmd *cobra.Command, _ []string) {
+	expired, err := knownhosts.NewHostCollection(knownHostsFile(cmd)).ExpiredStashEntries(time.Now())
+	if err != nil {
+		log.Warn(fmt.Errorf("failed to read stashes: %w", err))
+	}
+	if len(expired) > 0 {
+		fmt.Fprintf(os.Stderr, "Expired stash entries pending: %d (restored or dropped by the next khm command that changes files)\n",
+			len(expired))
+	}
+}
+
+// expireStashesWhen returns a pre-run for commands that only write files in
+// some modes: expired stash entries are handled when writes reports that the
+// command will change files, and only reported otherwise.
+func expireStashesWhen(writes func(cmd *cobra.Command, args []string) bool) func(*cobra.Command, []string) {
+	return func(cmd *cobra.Command, args []string) {
+		if writes(cmd, args) {
+			expireStashes(cmd)
+		} else {
+			reportExpiredStashes(cmd, args)
+		}
+	}
+}
+
+// knownHostsFile returns the --file path, or the default known_hosts file.
+func knownHostsFile(cmd *cobra.Command) string {
+	if path, _ := cmd.Flags().GetString("file"); path != "" {
+		return path
+	}
+	return getKnownHostsPath()
+}
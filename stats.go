@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// statsCmd prints a summary of the known_hosts file and its stashes.
+func statsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:              "stats",
+		Short:            "Show a summary of known_hosts and its stashes",
+		Args:             cobra.NoArgs,
+		PersistentPreRun: reportExpiredStashes,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			format, _ := cmd.Flags().GetString("format")
+
+			if err := showStats(path, format); err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	cmd.Flags().String("format", "", `Output format: "json" or empty for text`)
+	return cmd
+}
+
+func showStats(knownHostsPath, format string) error {
+	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+	stats, err := collection.Stats()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(stats)
+	case "":
+		writeStats(os.Stdout, stats)
+		return nil
+	}
+	return fmt.Errorf("unknown format %q: expected json", format)
+}
+
+func writeStats(w io.Writer, s knownhosts.Stats) {
+	fmt.Fprintf(w, "Entries:       %d\n", s.Entries)
+	fmt.Fprintf(w, "Hosts:         %d (%d with several keys)\n", s.Hosts, s.MultiKeyHosts)
+	fmt.Fprintf(w, "Hashed:        %d of %d (%.0f%%)\n", s.Hashed, s.Entries, s.HashedRatio*100)
+	fmt.Fprintf(w, "Addresses:     %d IP, %d DNS, %d patterns\n", s.IPAddresses, s.DNSNames, s.Patterns)
+	fmt.Fprintf(w, "Duplicates:    %d\n", s.Duplicates)
+	fmt.Fprintf(w, "Conflicts:     %d\n", s.Conflicts)
+	fmt.Fprintf(w, "Stash:         %d entr%s\n", s.StashEntries, plural(s.StashEntries, "y", "ies"))
+
+	sections := []struct {
+		title  string
+		counts map[string]int
+	}{
+		{"Key types", s.Types},
+		{"Markers", s.Markers},
+		{"Domains", s.Domains},
+	}
+	for _, section := range sections {
+		if len(section.counts) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		for _, c := range knownhosts.SortCounts(section.counts) {
+			fmt.Fprintf(w, "  %-34s %d\n", c.Name, c.Count)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/FlameInTheDark/khm/internal/knownhosts"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+)
+
+// trustCmd fetches the host keys of the given hosts with ssh-keyscan and
+// adds them, trusting them on first use. With --ttl the entries are
+// temporary, for CI runners and short-lived instances.
+func trustCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "trust <host>...",
+		Short: "Scan hosts with ssh-keyscan and add their keys",
+		Long: "Fetch the host keys of each host with ssh-keyscan and add them to known_hosts (trust on first use). " +
+			"Keys that are already known get their verification time and, with --ttl, their expiry refreshed. " +
+			"With --ttl the entries are temporary and khm gc removes them once they expire.",
+		Example: `  khm trust --ttl 2h 10.0.3.17
+  khm trust --port 2222 --type ed25519 ci-runner-7.example`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			port, _ := cmd.Flags().GetInt("port")
+			types, _ := cmd.Flags().GetStringSlice("type")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			ttl, _ := cmd.Flags().GetDuration("ttl")
+			hash, _ := cmd.Flags().GetBool("hash")
+			force, _ := cmd.Flags().GetBool("force")
+			if ttl < 0 {
+				log.Fatal("--ttl must be positive")
+			}
+
+			store := storeFor(cmd)
+			collection, err := knownhosts.ParseKnownHostsFrom(store, path)
+			if err != nil {
+				if !errors.Is(err, fs.ErrNotExist) {
+					log.Fatal(fmt.Errorf("failed to parse known_hosts: %w", err))
+				}
+				collection = knownhosts.NewHostCollection(path)
+				collection.Store = store
+			}
+
+			now := time.Now().UTC()
+			var expires *time.Time
+			if ttl > 0 {
+				t := now.Add(ttl)
+				expires = &t
+			}
+
+			added := 0
+			for _, host := range args {
+				keys, err := knownhosts.ScanHostKeys(host, port, types, timeout)
+				if err != nil {
+					log.Fatal(err)
+				}
+				for _, key := range keys {
+					address := key.Addresses[0]
+					if known := knownKey(collection, address, key); len(known) > 0 {
+						for _, h := range known {
+							meta := h.EnsureMeta()
+							meta.LastVerifiedAt = &now
+							// Re-trusting extends a temporary entry; permanent ones stay permanent.
+							if expires != nil && meta.ExpiresAt != nil && meta.ExpiresAt.Before(*expires) {
+								meta.ExpiresAt = expires
+							}
+						}
+						fmt.Fprintf(os.Stderr, "Already trusted %s: %s %s\n", address, key.Type, key.Fingerprint())
+						continue
+					}
+
+					key.Meta = &knownhosts.Metadata{Source: "keyscan", LastVerifiedAt: &now, ExpiresAt: expires}
+					if _, err := collection.AddEntry(key, hash, force); err != nil {
+						log.Fatal(fmt.Errorf("failed to add %s: %w", address, err))
+					}
+					added++
+					fmt.Fprintf(os.Stderr, "Trusted %s: %s %s%s\n", address, key.Type, key.Fingerprint(), ttlSuffix(key.Meta))
+				}
+			}
+
+			// Re-trusting known keys only touches their metadata.
+			save := collection.SaveMetadata
+			if added > 0 {
+				save = func() error { return collection.SaveToFile(collection.File) }
+			}
+			if err := save(); err != nil {
+				log.Fatal(fmt.Errorf("failed to save known_hosts: %w", err))
+			}
+			reportDryRun(store)
+		},
+	}
+
+	cmd.Flags().Int("port", 0, "SSH port; non-default ports are written as [host]:port")
+	cmd.Flags().StringSlice("type", nil, "Key types to fetch: rsa, ecdsa, ed25519 (default: all)")
+	cmd.Flags().Duration("timeout", 5*time.Second, "How long to wait for each host")
+	cmd.Flags().Duration("ttl", 0, "Make the entries temporary: khm gc removes them after this long (e.g. 2h)")
+	cmd.Flags().Bool("hash", false, "Hash host names")
+	cmd.Flags().Bool("force", false, "Add even if the host has a different key of the same type")
+	return cmd
+}
+
+// knownKey returns the unmarked entries listing address with the key of k.
+func knownKey(collection *knownhosts.HostCollection, address string, k *knownhosts.Host) []*knownhosts.Host {
+	out := make([]*knownhosts.Host, 0)
+	for _, h := range collection.Entries {
+		if h.Marker == "" && h.Type == k.Type && h.Key == k.Key && h.HasAddress(address) {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func ttlSuffix(meta *knownhosts.Metadata) string {
+	if meta == nil || meta.ExpiresAt == nil {
+		return ""
+	}
+	return " (" + meta.Remaining(time.Now()) + ")"
+}
+
+// gcCmd removes temporary entries whose TTL has passed and, optionally, IP
+// entries that have not been seen for a while.
+func gcCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "gc",
+		Short: "Remove expired temporary entries and, optionally, stale IP entries",
+		Long: "Remove the entries added with --ttl whose expiry has passed. With --unseen-ip-days N, entries listing " +
+			"only IP addresses that were last added or verified more than N days ago are removed too; entries " +
+			"without a recorded time are kept.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			path, _ := cmd.Flags().GetString("file")
+			if path == "" {
+				path = getKnownHostsPath()
+			}
+			days, _ := cmd.Flags().GetInt("unseen-ip-days")
+			if days < 0 {
+				log.Fatal("--unseen-ip-days must be positive")
+			}
+
+			store := storeFor(cmd)
+			if err := collectGarbage(store, path, time.Now(), days); err != nil {
+				log.Fatal(err)
+			}
+			reportDryRun(store)
+		},
+	}
+	cmd.Flags().Int("unseen-ip-days", 0, "Also remove IP-only entries not added or verified in this many days")
+	return cmd
+}
+
+func collectGarbage(store knownhosts.Store, path string, now time.Time, unseenDays int) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, path)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	reasons := make(map[*knownhosts.Host]string)
+	expired := collection.ExpiredEntries(now)
+	for _, h := range expired {
+		reasons[h] = "expired " + h.Meta.ExpiresAt.Local().Format("2006-01-02 15:04")
+	}
+	unseen := make([]*knownhosts.Host, 0)
+	if unseenDays > 0 {
+		for _, h := range collection.UnseenIPEntries(now.AddDate(0, 0, -unseenDays)) {
+			if _, ok := reasons[h]; !ok {
+				reasons[h] = "not seen since " + h.Meta.LastSeen().Local().Format("2006-01-02")
+				unseen = append(unseen, h)
+			}
+		}
+	}
+	if len(reasons) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to remove")
+		return nil
+	}
+
+	removed := make([]*knownhosts.Host, 0, len(reasons))
+	fmt.Fprintf(os.Stderr, "Removing %d %s from %s:\n", len(reasons), plural(len(reasons), "entry", "entries"), collection.File)
+	for _, h := range collection.Entries {
+		if reason, ok := reasons[h]; ok {
+			fmt.Fprintf(os.Stderr, "  %d: %s (%s)\n", h.LineNumber, h.String(), reason)
+			removed = append(removed, h)
+		}
+	}
+	if err := collection.Archive(expired, knownhosts.OpGC, "expired"); err != nil {
+		return err
+	}
+	if err := collection.Archive(unseen, knownhosts.OpGC, fmt.Sprintf("not seen for %d days", unseenDays)); err != nil {
+		return err
+	}
+	collection.RemoveEntries(removed)
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts: %w", err)
+	}
+	return nil
+}
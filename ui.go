@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/FlameInTheDark/khm/internal/knownhosts"
@@ -10,7 +13,12 @@ import (
 	tea "github.com/charmbracelet/bubbletea"
 )
 
-func runUI(knownHostsPath, version string) error {
+func runUI(knownHostsPath, version string, dryRun bool) error {
+	// The TUI saves each change as it is made; there is nothing to preview.
+	if dryRun {
+		return fmt.Errorf("the TUI does not support --dry-run; preview changes with the CLI commands instead")
+	}
+
 	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -42,26 +50,26 @@ func getKnownHostsPath() string {
 	return home + "/.ssh/known_hosts"
 }
 
-func listKnownHosts(knownHostsPath string) error {
+func listKnownHosts(knownHostsPath, format string, query *knownhosts.Query) error {
 	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
 	if err != nil {
 		return fmt.Errorf("failed to parse known_hosts: %w", err)
 	}
 
+	if format != "" {
+		printer, err := newHostPrinter(format)
+		if err != nil {
+			return err
+		}
+		return printer.Print(os.Stdout, collection.File, collection.Select(query))
+	}
+
 	fmt.Println("SSH Known Hosts:")
 	fmt.Println("================")
 
-	for _, addr := range collection.GetAllAddresses() {
-		hosts := collection.GetHostsByAddress(addr)
-		for i, host := range hosts {
-			displayAddr := addr
-			if host.IsHashed && host.HashValue != "" {
-				displayAddr = host.HashValue
-			} else if len(host.Addresses) > 0 {
-				displayAddr = host.Addresses[0]
-			}
-
-			fmt.Printf("%d. %s (%s)\n", i+1, displayAddr, host.Type)
+	for _, group := range knownhosts.GroupEntries(collection.Select(query)) {
+		for i, host := range group.Entries {
+			fmt.Printf("%d. %s (%s)\n", i+1, group.Label, host.Type)
 			if host.Comment != "" {
 				fmt.Printf("   Comment: %s\n", host.Comment)
 			}
@@ -72,6 +80,33 @@ func listKnownHosts(knownHostsPath string) error {
 	return nil
 }
 
+func findHost(knownHostsPath, host, format string) error {
+	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	matches := collection.Lookup(host)
+	if len(matches) == 0 {
+		return fmt.Errorf("host %q not found in %s", host, collection.File)
+	}
+
+	if format != "" {
+		printer, err := newHostPrinter(format)
+		if err != nil {
+			return err
+		}
+		return printer.Print(os.Stdout, collection.File, matches)
+	}
+
+	for _, h := range matches {
+		fmt.Printf("# Host %s found: line %d\n", host, h.LineNumber)
+		fmt.Println(h.String())
+	}
+
+	return nil
+}
+
 func backupKnownHosts(sourcePath string) error {
 	backupPath := sourcePath + ".backup." + fmt.Sprintf("%d", getTimestamp())
 
@@ -87,35 +122,121 @@ func getTimestamp() int64 {
 	return time.Now().Unix()
 }
 
-func stashHost(knownHostsPath, stashPath, host string) error {
+// bulkConfirmThreshold is the number of entries above which bulk delete and
+// stash refuse to run without --yes.
+const bulkConfirmThreshold = 5
+
+// selectForChange selects the entries matching query, prints a preview of the
+// affected lines and enforces --yes for large batches.
+func selectForChange(collection *knownhosts.HostCollection, query *knownhosts.Query, action string, yes bool) ([]*knownhosts.Host, error) {
+	hosts := collection.Select(query)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no entries match")
+	}
+
+	fmt.Fprintf(os.Stderr, "%s %d entr%s from %s:\n", action, len(hosts), plural(len(hosts), "y", "ies"), collection.File)
+	for _, h := range hosts {
+		fmt.Fprintf(os.Stderr, "  %d: %s\n", h.LineNumber, h.String())
+	}
+
+	if len(hosts) > bulkConfirmThreshold && !yes {
+		return nil, fmt.Errorf("refusing to change %d entries without --yes", len(hosts))
+	}
+
+	return hosts, nil
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+func stashHosts(store knownhosts.Store, knownHostsPath, stashPath string, query *knownhosts.Query, opts knownhosts.StashOptions, yes bool) error {
 	if knownHostsPath == "" {
 		knownHostsPath = getKnownHostsPath()
 	}
 
-	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
 	if err != nil {
 		return fmt.Errorf("failed to parse known_hosts: %w", err)
 	}
 
-	if err := collection.StashAddressWithPath(host, stashPath); err != nil {
-		return fmt.Errorf("failed to stash host %q: %w", host, err)
+	if stashPath == "" {
+		stashPath = collection.StashFilePath()
+	}
+
+	hosts, err := selectForChange(collection, query, "Stashing", yes)
+	if err != nil {
+		return err
+	}
+
+	if _, err := collection.StashHostsWithOptions(hosts, stashPath, opts); err != nil {
+		return fmt.Errorf("failed to stash hosts: %w", err)
 	}
 
 	return nil
 }
 
-func deleteHost(knownHostsPath, host string) error {
+func deleteHosts(store knownhosts.Store, knownHostsPath string, query *knownhosts.Query, reason string, yes bool) error {
 	if knownHostsPath == "" {
 		knownHostsPath = getKnownHostsPath()
 	}
 
-	collection, err := knownhosts.ParseKnownHosts(knownHostsPath)
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse known_hosts: %w", err)
+	}
+
+	hosts, err := selectForChange(collection, query, "Deleting", yes)
+	if err != nil {
+		return err
+	}
+
+	if err := collection.Archive(hosts, knownhosts.OpDelete, reason); err != nil {
+		return err
+	}
+	collection.RemoveEntries(hosts)
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after delete: %w", err)
+	}
+
+	return nil
+}
+
+// removeAliases drops literal addresses from the lines selected by query;
+// lines left without any address are removed entirely.
+func removeAliases(store knownhosts.Store, knownHostsPath string, aliases []string, query *knownhosts.Query, reason string, yes bool) error {
+	if len(aliases) == 0 {
+		return fmt.Errorf("--alias-only requires at least one host")
+	}
+	for _, alias := range aliases {
+		if strings.ContainsAny(alias, "*?/") {
+			return fmt.Errorf("--alias-only takes literal hosts, got %q", alias)
+		}
+	}
+
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
 	if err != nil {
 		return fmt.Errorf("failed to parse known_hosts: %w", err)
 	}
 
-	if err := collection.RemoveAllHosts(host); err != nil {
-		return fmt.Errorf("failed to delete host %q: %w", host, err)
+	hosts, err := selectForChange(collection, query, "Removing aliases in", yes)
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		if err := collection.ArchiveAlias(hosts, alias, knownhosts.OpAliasRemove, reason); err != nil {
+			return err
+		}
+		rewritten, removed := collection.RemoveAliasFrom(hosts, alias)
+		if rewritten+removed == 0 {
+			return fmt.Errorf("failed to remove %q: host not found in the selected entries", alias)
+		}
+		fmt.Fprintf(os.Stderr, "%s: rewrote %d line(s), removed %d line(s)\n", alias, rewritten, removed)
 	}
 
 	if err := collection.SaveToFile(collection.File); err != nil {
@@ -124,3 +245,89 @@ func deleteHost(knownHostsPath, host string) error {
 
 	return nil
 }
+
+func entryFromArgs(args []string) (*knownhosts.Host, error) {
+	if len(args) < 3 {
+		return nil, fmt.Errorf("expected <host>[,alias...] <type> <key> [comment]")
+	}
+	return &knownhosts.Host{
+		Addresses: splitHosts(args[0]),
+		Type:      args[1],
+		Key:       args[2],
+		Comment:   strings.Join(args[3:], " "),
+	}, nil
+}
+
+func entryFromPubkey(path string, hosts []string) (*knownhosts.Host, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("--host is required with --from-pubkey")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("%s is not an OpenSSH public key", path)
+	}
+
+	entry := &knownhosts.Host{
+		Type: fields[0],
+		Key:  fields[1],
+	}
+	for _, h := range hosts {
+		entry.Addresses = append(entry.Addresses, splitHosts(h)...)
+	}
+	return entry, nil
+}
+
+func splitHosts(field string) []string {
+	out := make([]string, 0)
+	for _, h := range strings.Split(field, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+func applyPort(entry *knownhosts.Host, port int) error {
+	if port == 0 {
+		return nil
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	for i, addr := range entry.Addresses {
+		if strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("%s already has a port; drop --port", addr)
+		}
+		entry.Addresses[i] = knownhosts.FormatAddress(addr, port)
+	}
+	return nil
+}
+
+func addHost(store knownhosts.Store, knownHostsPath string, entry *knownhosts.Host, hash, force bool) error {
+	collection, err := knownhosts.ParseKnownHostsFrom(store, knownHostsPath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to parse known_hosts: %w", err)
+		}
+		collection = knownhosts.NewHostCollection(knownHostsPath)
+		collection.Store = store
+	}
+
+	added, err := collection.AddEntry(entry, hash, force)
+	if err != nil {
+		return fmt.Errorf("failed to add host: %w", err)
+	}
+
+	if err := collection.SaveToFile(collection.File); err != nil {
+		return fmt.Errorf("failed to save known_hosts after add: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Added %d line(s) for %s: %s %s\n",
+		len(added), strings.Join(entry.Addresses, ","), entry.Type, knownhosts.KeyFingerprint(entry.Key))
+	return nil
+}